@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/alexflint/go-arg"
+	"github.com/alexflint/go-scalar"
+	"sigs.k8s.io/yaml"
+)
+
+// loadConfig parses args into a Config whose values come from, in increasing
+// precedence, the default tags, the YAML file given by --config, the environment
+// and args. It is only needed with --config; go-arg alone handles the rest.
+func loadConfig(path string, args []string) (Config, error) {
+	var cfg Config
+	defaults, err := arg.NewParser(arg.Config{IgnoreEnv: true}, &cfg)
+	if err != nil {
+		return cfg, err
+	}
+	if err := defaults.Parse(nil); err != nil {
+		return cfg, err
+	}
+	if err := applyConfigFile(&cfg, path); err != nil {
+		return cfg, err
+	}
+	overrides, err := arg.NewParser(arg.Config{IgnoreDefault: true}, &cfg)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, overrides.Parse(args)
+}
+
+// applyConfigFile sets the fields of cfg named in the YAML file at path. Keys are
+// the flag names in camelCase, e.g. queryDomain for --query-domain, matched
+// regardless of case; values are written as on the command line, with lists as
+// YAML sequences.
+func applyConfigFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	var settings map[string]any
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	fields := make(map[string]int)
+	t := reflect.TypeOf(*cfg)
+	for i := range t.NumField() {
+		if name := flagName(t.Field(i)); name != "" && name != "config" {
+			fields[strings.ToLower(camelCase(name))] = i
+		}
+	}
+	v := reflect.ValueOf(cfg).Elem()
+	for key, value := range settings {
+		i, ok := fields[strings.ToLower(key)]
+		if !ok {
+			return fmt.Errorf("unknown setting %q in config file %s", key, path)
+		}
+		if err := setField(v.Field(i), value); err != nil {
+			return fmt.Errorf("setting %s from config file %s: %w", key, path, err)
+		}
+	}
+	return nil
+}
+
+// flagName returns the long flag of a Config field without its dashes, or "" for
+// fields without one, such as subcommands.
+func flagName(f reflect.StructField) string {
+	for _, part := range strings.Split(f.Tag.Get("arg"), ",") {
+		if name, ok := strings.CutPrefix(part, "--"); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// camelCase turns a flag name such as query-domain into queryDomain.
+func camelCase(name string) string {
+	parts := strings.Split(name, "-")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// setField parses value, as decoded from YAML, into field like go-arg parses a
+// flag, element by element for slices.
+func setField(field reflect.Value, value any) error {
+	if field.Kind() != reflect.Slice {
+		return scalar.ParseValue(field, scalarString(value))
+	}
+	items, ok := value.([]any)
+	if !ok {
+		items = []any{value}
+	}
+	slice := reflect.MakeSlice(field.Type(), len(items), len(items))
+	for i, item := range items {
+		if err := scalar.ParseValue(slice.Index(i), scalarString(item)); err != nil {
+			return err
+		}
+	}
+	field.Set(slice)
+	return nil
+}
+
+// scalarString renders a YAML scalar the way it would be given as a flag.
+func scalarString(value any) string {
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
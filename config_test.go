@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "probe.yaml")
+	file := `queryDomain: kubernetes.default.svc.cluster.local
+queryTimeout: 250ms
+loopInterval: 1s
+rttBuckets: [10, 100, 1000]
+shardNames:
+  - a.example.com
+  - b.example.com
+probeClusterIP: true
+corednsMetricsPort: 9153
+targetConcurrency: [baseline=1]
+targetMaxQPS: [service=5, pod=50]
+`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatalf("writing config file: %v", err)
+	}
+	t.Setenv("LOOP_INTERVAL", "2s")
+	t.Setenv("SUMMARY_INTERVAL", "30s")
+
+	cfg, err := loadConfig(path, []string{"--config", path, "--summary-interval", "1m", "--shard-names", "c.example.com"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	// defaults < file < env < flags
+	if cfg.QueryType != "A" {
+		t.Errorf("expected the default query type, got %q", cfg.QueryType)
+	}
+	if cfg.QueryDomain != "kubernetes.default.svc.cluster.local" || cfg.QueryTimeout != 250*time.Millisecond || !cfg.ProbeClusterIP || cfg.CoreDNSMetrics != 9153 {
+		t.Errorf("expected the file's settings, got %+v", cfg)
+	}
+	if !slices.Equal(cfg.RTTBuckets, []float64{10, 100, 1000}) {
+		t.Errorf("expected RTT buckets from the file, got %v", cfg.RTTBuckets)
+	}
+	if !slices.Equal(cfg.TargetWorkers, []string{"baseline=1"}) || !slices.Equal(cfg.TargetMaxQPS, []string{"service=5", "pod=50"}) {
+		t.Errorf("expected per-target limits from the file, got %v and %v", cfg.TargetWorkers, cfg.TargetMaxQPS)
+	}
+	if cfg.LoopInterval != 2*time.Second {
+		t.Errorf("expected the environment to override the file, got loop interval %v", cfg.LoopInterval)
+	}
+	if cfg.SummaryInterval != time.Minute {
+		t.Errorf("expected the flag to override the environment, got summary interval %v", cfg.SummaryInterval)
+	}
+	if !slices.Equal(cfg.ShardNames, []string{"c.example.com"}) {
+		t.Errorf("expected the flag to replace the file's list, got %v", cfg.ShardNames)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	testCases := map[string]string{
+		"unknown":      "queryDomian: bing.com\n",
+		"invalid_type": "queryTimeout: soon\n",
+		"not_yaml":     "queryDomain: [\n",
+	}
+	for name, file := range testCases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name+".yaml")
+			if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+				t.Fatalf("writing config file: %v", err)
+			}
+			if _, err := loadConfig(path, nil); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
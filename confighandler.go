@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// secretFields are the Config fields whose values /config never shows. Webhook
+// URLs of e.g. Slack and Teams are credentials themselves.
+var secretFields = map[string]bool{"MetricsPassword": true, "RemoteWritePass": true, "AlertWebhook": true}
+
+// redacted replaces secret values on /config.
+const redacted = "REDACTED"
+
+// configHandler serves the effective configuration and the endpoints currently
+// probed as JSON, to check how defaults, the config file, env vars and flags
+// resolved and what discovery found. Settings are keyed like in the config file;
+// secrets, and passwords in URLs, are redacted. The endpoints are empty until
+// probed is set, once discovery has started.
+func configHandler(cfg Config, probed *atomic.Pointer[targets]) http.Handler {
+	settings := effectiveSettings(cfg)
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		type endpointView struct {
+			Addr   string `json:"addr"`
+			Port   int32  `json:"port"`
+			Family string `json:"family"`
+			Pod    string `json:"pod,omitempty"`
+			Node   string `json:"node,omitempty"`
+			Zone   string `json:"zone,omitempty"`
+			Ready  bool   `json:"ready"`
+			Target string `json:"target"`
+		}
+		eps := []endpointView{}
+		if tg := probed.Load(); tg != nil {
+			servers, discovered, _ := tg.snapshot()
+			for _, addr := range servers {
+				ep := discovered[addr]
+				eps = append(eps, endpointView{ep.Addr, ep.Port, string(ep.Family), ep.Pod, ep.Node, ep.Zone, ep.Ready, ep.Target})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(struct {
+			Config        map[string]any `json:"config"`
+			EndpointCount int            `json:"endpointCount"`
+			Endpoints     []endpointView `json:"endpoints"`
+		}{settings, len(eps), eps}); err != nil {
+			log.Printf("writing /config: %v", err)
+		}
+	})
+}
+
+// effectiveSettings returns the flag settings of cfg keyed by their camelCase
+// names, with durations as strings such as 100ms and secrets redacted. URLs lose
+// their password and query string, which often carries a token.
+func effectiveSettings(cfg Config) map[string]any {
+	settings := make(map[string]any)
+	t, v := reflect.TypeOf(cfg), reflect.ValueOf(cfg)
+	for i := range t.NumField() {
+		name := flagName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		var value any = v.Field(i).Interface()
+		switch s := value.(type) {
+		case time.Duration:
+			value = s.String()
+		case string:
+			if secretFields[t.Field(i).Name] && s != "" {
+				value = redacted
+			} else if u, err := url.Parse(s); err == nil && u.Host != "" {
+				u.RawQuery, u.Fragment = "", ""
+				value = u.Redacted()
+			}
+		}
+		settings[camelCase(name)] = value
+	}
+	return settings
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/paulgmiller/corednsprobe/pkg/criteria"
+)
+
+// clientCookie is the DNS cookie, RFC 7873, the probe sends with --dns-cookies:
+// 8 random bytes in hex, fixed for the life of the process like the client
+// secret of a resolver.
+var clientCookie = newClientCookie()
+
+func newClientCookie() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// serverCookies holds the last server cookie, in hex, of each endpoint by
+// host:port, which the next query to it sends back.
+var serverCookies sync.Map
+
+// setCookie replaces the COOKIE option of m with clientCookie and the server
+// cookie last seen from hostPort, if any. m must have an OPT record.
+func setCookie(m *dns.Msg, hostPort string) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	cookie := clientCookie
+	if server, ok := serverCookies.Load(hostPort); ok {
+		cookie += server.(string)
+	}
+	opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool { return o.Option() == dns.EDNS0COOKIE })
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+}
+
+// checkCookie validates the COOKIE option of the response r from hostPort as in
+// RFC 7873 section 5.3 and remembers its server cookie. A response without one is
+// accepted, since the server may not support cookies; one that does not echo
+// clientCookie, or whose server cookie is not 8 to 32 bytes, is reported as
+// criteria.ErrCookieMismatch.
+func checkCookie(r *dns.Msg, hostPort string) error {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		c, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		client, server := c.Cookie[:min(len(c.Cookie), len(clientCookie))], c.Cookie[min(len(c.Cookie), len(clientCookie)):]
+		if client != clientCookie {
+			return fmt.Errorf("%w: client cookie %q, sent %q", criteria.ErrCookieMismatch, client, clientCookie)
+		}
+		if len(server) < 16 || len(server) > 64 {
+			return fmt.Errorf("%w: server cookie of %d bytes", criteria.ErrCookieMismatch, len(server)/2)
+		}
+		serverCookies.Store(hostPort, server)
+	}
+	return nil
+}
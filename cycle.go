@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulgmiller/corednsprobe/pkg/criteria"
+	"github.com/paulgmiller/corednsprobe/pkg/metrics"
+	"github.com/paulgmiller/corednsprobe/pkg/tracing"
+	"golang.org/x/time/rate"
+)
+
+// lookupFunc queries name through the CoreDNS endpoint addr over proto, "udp", "tcp", "dot" or "doh".
+type lookupFunc func(ctx context.Context, addr, proto, name string) ([]string, time.Duration, error)
+
+var errCycleTimeout = errors.New("probe cycle exceeded --max-cycle-duration")
+
+// queriesSent counts all probe queries, including those to endpoints that have
+// since been removed, for the queries-per-second gauge.
+var queriesSent atomic.Int64
+
+// runCycle probes every server once per protocol in parallel, at most
+// --concurrency at a time, and waits for all queries. With negativeDomain set,
+// each of these probes is paired with a negative one, and with truncationDomain
+// set, each server also gets a truncation test. With jitter set, each query
+// is delayed by a random part of jitter × loopInterval so that they do not reach
+// CoreDNS in one burst. With maxCycleDuration set, queries still outstanding when
+// it elapses are cancelled and recorded as QueryCycleTimeout, so slow endpoints
+// cannot stall the loop. With --max-qps set, each query first waits for the
+// limiter and is skipped if that would outlast the cycle, which without
+// maxCycleDuration ends for this purpose after loopInterval. Endpoints whose
+// target kind has its own --target-concurrency or --target-max-qps use those
+// instead, see throttle.
+func runCycle(ctx context.Context, servers []string, stats []*epStats, lookup lookupFunc) {
+	if maxCycleDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, maxCycleDuration, errCycleTimeout)
+		defer cancel()
+	}
+
+	// Without a cycle bound, throttled queries would wait indefinitely and delay
+	// the following cycles rather than being skipped.
+	waitCtx := ctx
+	if (limiter != nil || len(targetLimiters) > 0) && maxCycleDuration <= 0 && loopInterval > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, loopInterval)
+		defer cancel()
+	}
+
+	d := dispatcher{waitCtx: waitCtx, stagger: time.Duration(jitter * float64(loopInterval))}
+	for idx, ip := range servers {
+		workers, limiter := throttle(stats[idx].target)
+		for _, proto := range protocols {
+			d.run(workers, limiter, func() { probe(ctx, stats[idx], ip, proto, lookup) })
+			if negativeDomain != "" {
+				d.run(workers, limiter, func() { probeNegative(ctx, stats[idx], ip, proto, lookup) })
+			}
+		}
+		if truncationDomain != "" {
+			d.run(workers, limiter, func() { probeTruncation(ctx, stats[idx], ip, lookup) })
+		}
+	}
+	d.wg.Wait()
+}
+
+// dispatcher hands the queries of runCycle and runColdStart to their pool, or a
+// goroutine of their own without one, after waiting for their limiter.
+type dispatcher struct {
+	wg      sync.WaitGroup
+	waitCtx context.Context // bounds the wait for the limiter
+	stagger time.Duration   // upper bound of the random delay of each query
+}
+
+// run dispatches f to workers once limiter allows it. f is skipped and counted
+// with metrics.RecordThrottledQuery if waitCtx is done first.
+func (d *dispatcher) run(workers *pool, limiter *rate.Limiter, f func()) {
+	d.wg.Add(1)
+	task := func() {
+		defer d.wg.Done()
+		if limiter != nil && limiter.Wait(d.waitCtx) != nil {
+			metrics.RecordThrottledQuery()
+			return
+		}
+		f()
+	}
+	dispatch := func() {
+		if workers == nil {
+			go task()
+			return
+		}
+		// Workers stop when their context is done, so the task is dropped
+		// rather than sent to a pool nobody reads from.
+		select {
+		case workers.tasks <- task:
+		case <-workers.done:
+			d.wg.Done()
+		}
+	}
+	// The delay is spent in a timer rather than a worker, so staggering does
+	// not reduce --concurrency.
+	if d.stagger > 0 {
+		time.AfterFunc(rand.N(d.stagger), dispatch)
+	} else {
+		dispatch()
+	}
+}
+
+// runColdStart probes the servers still in their --coldstart-window once per
+// protocol, see targets.update, and records the results only in the cold-start
+// histogram, so that startup latency is kept apart from the steady state. The
+// endpoints are probed by runCycle as well. Like there, queries go through the
+// pool and limiter of their target kind, see throttle, and are skipped if the
+// limiter outlasts coldStartEvery.
+func runColdStart(ctx context.Context, servers []string, stats []*epStats, lookup lookupFunc) {
+	name := queryDomain
+	if len(shardNames) > 0 {
+		name = shardNames[0]
+	}
+	c := criteriaFor(name)
+	waitCtx, cancel := context.WithTimeout(ctx, coldStartEvery)
+	defer cancel()
+
+	now := time.Now()
+	d := dispatcher{waitCtx: waitCtx}
+	for idx, ip := range servers {
+		if !now.Before(stats[idx].coldUntil) {
+			continue
+		}
+		workers, limiter := throttle(stats[idx].target)
+		for _, proto := range protocols {
+			d.run(workers, limiter, func() {
+				qname := name
+				if randomizeQuery {
+					qname = randomizeName(name)
+				}
+				status, _, rtt, _ := query(ctx, ip, proto, qname, c, lookup)
+				if !warmingUp() {
+					metrics.RecordColdStartQuery(proto, status, rtt)
+				}
+			})
+		}
+	}
+	d.wg.Wait()
+}
+
+// jittered returns d moved by a random amount of up to ±jitter × d, so that
+// replicas started together do not keep probing in lockstep.
+func jittered(d time.Duration) time.Duration {
+	spread := time.Duration(jitter * float64(d))
+	if spread <= 0 {
+		return d
+	}
+	return d - spread + rand.N(2*spread+1)
+}
+
+// workers runs the queries of runCycle when --concurrency is set; otherwise each
+// query gets its own goroutine.
+var workers *pool
+
+// limiter caps the queries per second across all endpoints when --max-qps is
+// set, so that the probe does not become a load generator in large clusters.
+var limiter *rate.Limiter
+
+// targetWorkers and targetLimiters replace workers and limiter for the target
+// kinds, e.g. targetPod, given in --target-concurrency and --target-max-qps, so
+// that e.g. a baseline resolver is probed more gently than the CoreDNS pods.
+var (
+	targetWorkers  map[string]*pool
+	targetLimiters map[string]*rate.Limiter
+)
+
+// throttle returns the pool and limiter for the queries to an endpoint of the
+// given target kind: its own if configured, otherwise the global ones.
+func throttle(target string) (*pool, *rate.Limiter) {
+	p, ok := targetWorkers[target]
+	if !ok {
+		p = workers
+	}
+	l, ok := targetLimiters[target]
+	if !ok {
+		l = limiter
+	}
+	return p, l
+}
+
+// parseTargetLimits parses the kind=value entries of --target-concurrency or
+// --target-max-qps, keyed by target kind. Values must be positive.
+func parseTargetLimits[T int | float64](entries []string, parse func(string) (T, error)) (map[string]T, error) {
+	limits := make(map[string]T, len(entries))
+	for _, entry := range entries {
+		kind, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected kind=value, got %q", entry)
+		}
+		if !slices.Contains([]string{targetPod, targetService, targetStatic, targetBaseline, targetNodeLocal}, kind) {
+			return nil, fmt.Errorf("unknown target kind %q, expected %s, %s, %s, %s or %s", kind, targetPod, targetService, targetStatic, targetBaseline, targetNodeLocal)
+		}
+		v, err := parse(value)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("%s: expected a positive number, got %q", kind, value)
+		}
+		limits[kind] = v
+	}
+	return limits, nil
+}
+
+// warmupUntil is when --warmup ends. Queries before then warm up the caches of
+// CoreDNS and are sent, but their results are neither counted nor recorded.
+var warmupUntil time.Time
+
+// warmingUp reports whether --warmup is still running.
+func warmingUp() bool {
+	return time.Now().Before(warmupUntil)
+}
+
+// pool is a fixed set of long-lived goroutines running tasks, which bounds the
+// number of concurrent queries and avoids starting goroutines on every tick.
+type pool struct {
+	tasks chan func()
+	done  <-chan struct{} // closed once the workers stop
+}
+
+// newPool starts n workers that run tasks until ctx is done.
+func newPool(ctx context.Context, n int) *pool {
+	p := &pool{tasks: make(chan func()), done: ctx.Done()}
+	for range n {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case task := <-p.tasks:
+					task()
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// probe sends one query to addr over proto and records the result in st and the metrics.
+func probe(ctx context.Context, st *epStats, addr, proto string, lookup lookupFunc) {
+	name, ns := queryDomain, (*nameStats)(nil)
+	if len(shardNames) > 0 {
+		n := int(st.next.Add(1)-1) % len(shardNames)
+		name, ns = shardNames[n], st.names[n]
+	}
+
+	qname := name
+	if randomizeQuery {
+		qname = randomizeName(name)
+	}
+	status, reason, rtt, answers := query(ctx, addr, proto, qname, criteriaFor(name), lookup)
+	if warmingUp() {
+		return
+	}
+	metrics.RecordQuery(addr, metrics.TestPositive, queryType, proto, status, string(reason), rtt)
+	if answers >= 0 {
+		metrics.RecordAnswerCount(addr, name, answers)
+	}
+	st.add(status, reason, rtt)
+	if ns != nil {
+		metrics.RecordNameQuery(addr, name, status, rtt)
+		ns.add(status, reason, rtt)
+	}
+
+	if status != metrics.QuerySuccess {
+		st.recordFailure(reason)
+		return
+	}
+	st.observeRTT(rtt)
+	if reason == criteria.ReasonSlow {
+		metrics.RecordSlowQuery(addr)
+	}
+}
+
+// parseAnswerRegexes compiles the name=regex entries of --answer-regex, keyed by
+// answerRegexKey of the name. The name ends at the first "=", so the expression
+// may contain more.
+func parseAnswerRegexes(entries []string) (map[string]*regexp.Regexp, error) {
+	regexes := make(map[string]*regexp.Regexp, len(entries))
+	for _, entry := range entries {
+		name, expr, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected name=regex, got %q", entry)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		regexes[answerRegexKey(name)] = re
+	}
+	return regexes, nil
+}
+
+// answerRegexKey normalizes a query name for looking up its --answer-regex.
+func answerRegexKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// criteriaFor returns successCriteria with the --answer-regex of name, if any.
+func criteriaFor(name string) criteria.Criteria {
+	c := successCriteria
+	c.AnswerRegex = answerRegexes[answerRegexKey(name)]
+	return c
+}
+
+// probeNegative queries negativeDomain, which must not exist, and records in
+// st.negative and the metrics whether addr answered NXDOMAIN. Failures are also
+// counted among the endpoint's failure reasons, prefixed with "negative-", so
+// that e.g. SERVFAIL for missing names stands out.
+func probeNegative(ctx context.Context, st *epStats, addr, proto string, lookup lookupFunc) {
+	status, reason, rtt, _ := query(ctx, addr, proto, negativeDomain, negativeCriteria, lookup)
+	if warmingUp() {
+		return
+	}
+	metrics.RecordQuery(addr, metrics.TestNegative, queryType, proto, status, string(reason), rtt)
+	st.negative.add(status, reason, rtt)
+	if status != metrics.QuerySuccess {
+		st.recordFailure("negative-" + reason)
+	}
+}
+
+// probeTruncation queries truncationDomain over UDP and, once the response is
+// truncated, over TCP, see lookupTruncated, and records in st.truncation and the
+// metrics whether the answer made it through. Failures are counted among the
+// endpoint's failure reasons prefixed with "truncation-", e.g.
+// truncation-timeout when TCP is blocked.
+func probeTruncation(ctx context.Context, st *epStats, addr string, lookup lookupFunc) {
+	status, reason, rtt, _ := query(ctx, addr, protoTruncation, truncationDomain, truncationCriteria, lookup)
+	if warmingUp() {
+		return
+	}
+	metrics.RecordQuery(addr, metrics.TestTruncation, truncationType, protoTruncation, status, string(reason), rtt)
+	st.truncation.add(status, reason, rtt)
+	if status != metrics.QuerySuccess {
+		st.recordFailure("truncation-" + reason)
+	}
+}
+
+// query sends qname to addr over proto and classifies the result with c. It also
+// returns the number of answers of a NOERROR response, or -1 without one. Queries
+// cut off by maxCycleDuration are reported as QueryCycleTimeout. Each query is a
+// trace span, exported with --otlp-endpoint.
+func query(ctx context.Context, addr, proto, qname string, c criteria.Criteria, lookup lookupFunc) (metrics.QueryStatus, criteria.Reason, time.Duration, int) {
+	queriesSent.Add(1)
+	metrics.QueryStarted(addr)
+	spanCtx, span := tracing.StartQuery(ctx, addr, proto, queryType, qname)
+	answers, rtt, err := lookup(spanCtx, addr, proto, qname)
+	metrics.QueryFinished(addr)
+	status, reason := c.Classify(criteria.Result{Answers: len(answers), Values: answers, RTT: rtt, Err: err})
+	if status != metrics.QuerySuccess && errors.Is(context.Cause(ctx), errCycleTimeout) {
+		status, reason = metrics.QueryCycleTimeout, criteria.Reason(metrics.QueryCycleTimeout)
+	}
+	span.End(string(status), string(reason), rtt)
+	n := len(answers)
+	if err != nil {
+		n = -1
+	}
+	return status, reason, rtt, n
+}
+
+// randomizeName prepends a random label to name, e.g. probe-3k2x9f0q1v7a.bing.com,
+// so that every query misses the cache and is resolved upstream.
+func randomizeName(name string) string {
+	b := make([]byte, 0, len("probe-")+13+1+len(name))
+	b = append(b, "probe-"...)
+	b = strconv.AppendUint(b, rand.Uint64(), 36)
+	b = append(b, '.')
+	b = append(b, name...)
+	return string(b)
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/paulgmiller/corednsprobe/pkg/criteria"
+	"golang.org/x/time/rate"
+)
+
+func TestRunCycleMaxDuration(t *testing.T) {
+	queryTimeout, protocols = time.Second, []string{"udp"}
+	maxCycleDuration = 50 * time.Millisecond
+	successCriteria = criteria.Default(queryTimeout)
+	defer func() { maxCycleDuration = 0 }()
+
+	servers := []string{"10.0.0.1", "10.0.0.2"}
+	stats := []*epStats{newEpStats(0), newEpStats(0)}
+	lookup := func(ctx context.Context, addr, _, _ string) ([]string, time.Duration, error) {
+		start := time.Now()
+		if addr == "10.0.0.1" {
+			return []string{"192.0.2.1"}, time.Since(start), nil
+		}
+		// Slower than the cycle bound but within the query timeout.
+		select {
+		case <-time.After(500 * time.Millisecond):
+			return []string{"192.0.2.1"}, time.Since(start), nil
+		case <-ctx.Done():
+			return nil, time.Since(start), ctx.Err()
+		}
+	}
+
+	start := time.Now()
+	runCycle(context.Background(), servers, stats, lookup)
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("cycle took %v, expected it to be cut off near %v", elapsed, maxCycleDuration)
+	}
+
+	if fail := stats[0].load().fail; fail != 0 {
+		t.Errorf("fast endpoint: expected 0 failures, got %d", fail)
+	}
+	if fail := stats[1].load().fail; fail != 1 {
+		t.Errorf("slow endpoint: expected 1 failure, got %d", fail)
+	}
+	if got := stats[1].failureReasons(); got != "cycle_timeout: 1" {
+		t.Errorf("slow endpoint: expected cycle_timeout reason, got %q", got)
+	}
+}
+
+func TestRunCycleConcurrency(t *testing.T) {
+	queryTimeout, protocols = time.Second, []string{"udp", "tcp"}
+	successCriteria = criteria.Default(queryTimeout)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	workers = newPool(ctx, 2)
+	defer func() { workers = nil }()
+
+	var inFlight, maxInFlight atomic.Int32
+	lookup := func(context.Context, string, string, string) ([]string, time.Duration, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return []string{"192.0.2.1"}, time.Millisecond, nil
+	}
+
+	servers := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	stats := []*epStats{newEpStats(0), newEpStats(0), newEpStats(0)}
+	runCycle(ctx, servers, stats, lookup)
+
+	for i, st := range stats {
+		if got := st.load().total; got != 2 {
+			t.Errorf("%s: expected 2 queries, got %d", servers[i], got)
+		}
+	}
+	if got := maxInFlight.Load(); got > 2 {
+		t.Errorf("expected at most 2 concurrent queries, got %d", got)
+	}
+}
+
+func TestRunCycleTargetConcurrency(t *testing.T) {
+	queryTimeout, protocols = time.Second, []string{"udp", "tcp"}
+	successCriteria = criteria.Default(queryTimeout)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	targetWorkers = map[string]*pool{targetBaseline: newPool(ctx, 1)}
+	defer func() { targetWorkers = nil }()
+
+	// Only the baseline resolvers are bounded; the pods keep one goroutine per query.
+	var inFlight, maxInFlight atomic.Int32
+	lookup := func(_ context.Context, addr, _, _ string) ([]string, time.Duration, error) {
+		if strings.HasPrefix(addr, "192.0.2.") {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				m := maxInFlight.Load()
+				if n <= m || maxInFlight.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return []string{"192.0.2.1"}, time.Millisecond, nil
+	}
+
+	servers := []string{"10.0.0.1", "10.0.0.2", "192.0.2.53", "192.0.2.54"}
+	stats := make([]*epStats, len(servers))
+	for i := range stats {
+		stats[i] = newEpStats(0)
+		stats[i].target = targetPod
+	}
+	stats[2].target, stats[3].target = targetBaseline, targetBaseline
+	runCycle(ctx, servers, stats, lookup)
+
+	for i, st := range stats {
+		if got := st.load().total; got != 2 {
+			t.Errorf("%s: expected 2 queries, got %d", servers[i], got)
+		}
+	}
+	if got := maxInFlight.Load(); got != 1 {
+		t.Errorf("expected 1 concurrent baseline query, got %d", got)
+	}
+}
+
+func TestRunCycleConcurrencyCancel(t *testing.T) {
+	queryTimeout, protocols = time.Second, []string{"udp"}
+	successCriteria = criteria.Default(queryTimeout)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	workers = newPool(ctx, 1)
+	defer func() { workers = nil }()
+
+	// The first query cancels the context, which stops the only worker while the
+	// other queries are still waiting for it.
+	lookup := func(context.Context, string, string, string) ([]string, time.Duration, error) {
+		cancel()
+		return []string{"192.0.2.1"}, time.Millisecond, nil
+	}
+	servers := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	stats := []*epStats{newEpStats(0), newEpStats(0), newEpStats(0), newEpStats(0)}
+	done := make(chan struct{})
+	go func() {
+		runCycle(ctx, servers, stats, lookup)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected runCycle to return once the context was cancelled")
+	}
+}
+
+func TestRunCycleMaxQPS(t *testing.T) {
+	queryTimeout, protocols = time.Second, []string{"udp"}
+	successCriteria = criteria.Default(queryTimeout)
+	defer func() { limiter, maxCycleDuration, loopInterval = nil, 0, 0 }()
+
+	// Tokens at 0 and 100ms fit into the cycle; the rest would outlast it.
+	testCases := []struct {
+		name             string
+		maxCycleDuration time.Duration
+		loopInterval     time.Duration
+	}{
+		{name: "max_cycle_duration", maxCycleDuration: 150 * time.Millisecond, loopInterval: time.Hour},
+		{name: "loop_interval", loopInterval: 150 * time.Millisecond},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			limiter = rate.NewLimiter(10, 1)
+			maxCycleDuration, loopInterval = tc.maxCycleDuration, tc.loopInterval
+
+			var sent atomic.Int32
+			lookup := func(context.Context, string, string, string) ([]string, time.Duration, error) {
+				sent.Add(1)
+				return []string{"192.0.2.1"}, time.Millisecond, nil
+			}
+			servers := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"}
+			stats := []*epStats{newEpStats(0), newEpStats(0), newEpStats(0), newEpStats(0), newEpStats(0)}
+			start := time.Now()
+			runCycle(context.Background(), servers, stats, lookup)
+
+			if got := sent.Load(); got != 2 {
+				t.Errorf("expected 2 queries within the limit, got %d", got)
+			}
+			var total int64
+			for _, st := range stats {
+				total += st.load().total
+				if fail := st.load().fail; fail != 0 {
+					t.Errorf("expected throttled queries to be skipped rather than failed, got %d failures", fail)
+				}
+			}
+			if total != 2 {
+				t.Errorf("expected only sent queries to be counted, got %d", total)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("expected throttled queries not to hold up the cycle, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestRunCycleWarmup(t *testing.T) {
+	queryTimeout, protocols = time.Second, []string{"udp"}
+	successCriteria = criteria.Default(queryTimeout)
+	warmupUntil = time.Now().Add(time.Hour)
+	defer func() { warmupUntil = time.Time{} }()
+
+	var sent atomic.Int32
+	lookup := func(context.Context, string, string, string) ([]string, time.Duration, error) {
+		sent.Add(1)
+		return []string{"192.0.2.1"}, time.Millisecond, nil
+	}
+	stats := []*epStats{newEpStats(0)}
+	runCycle(context.Background(), []string{"10.0.0.1"}, stats, lookup)
+	if got, total := sent.Load(), stats[0].load().total; got != 1 || total != 0 {
+		t.Errorf("expected the query to be sent but not counted during warmup, got %d sent and %d counted", got, total)
+	}
+
+	warmupUntil = time.Now()
+	runCycle(context.Background(), []string{"10.0.0.1"}, stats, lookup)
+	if got := stats[0].load().total; got != 1 {
+		t.Errorf("expected queries after warmup to be counted, got %d", got)
+	}
+}
+
+func TestRunCycleSlowSuccess(t *testing.T) {
+	queryTimeout, protocols = time.Second, []string{"udp"}
+	successCriteria = criteria.Default(queryTimeout)
+	successCriteria.MaxLatency = 100 * time.Millisecond
+	defer func() { successCriteria = criteria.Default(queryTimeout) }()
+
+	stats := []*epStats{newEpStats(0)}
+	lookup := func(context.Context, string, string, string) ([]string, time.Duration, error) {
+		return []string{"192.0.2.1"}, 200 * time.Millisecond, nil
+	}
+	runCycle(context.Background(), []string{"10.0.0.1"}, stats, lookup)
+
+	if got := stats[0].load().fail; got != 0 {
+		t.Errorf("expected a slow answer not to be a failure, got %d failures", got)
+	}
+	if got := stats[0].load().slow; got != 1 {
+		t.Errorf("expected 1 slow query, got %d", got)
+	}
+	if got := formatRate(stats[0].load()); got != "success 100.0 % (1/1)  fail 0.0 %  slow 100.0 %  avgRTT 200.00 ms" {
+		t.Errorf("unexpected summary %q", got)
+	}
+}
+
+func TestRunCycleAnswerRegex(t *testing.T) {
+	queryTimeout, protocols, shardNames = time.Second, []string{"udp"}, []string{"a.example", "b.example"}
+	successCriteria = criteria.Default(queryTimeout)
+	answerRegexes = map[string]*regexp.Regexp{"b.example": regexp.MustCompile(`^192\.0\.2\.`)}
+	defer func() { shardNames, answerRegexes = nil, nil }()
+
+	stats := []*epStats{newEpStats(len(shardNames))}
+	lookup := func(_ context.Context, _, _, name string) ([]string, time.Duration, error) {
+		return []string{"10.0.0.1"}, time.Millisecond, nil
+	}
+	for range 2 {
+		runCycle(context.Background(), []string{"10.0.0.1"}, stats, lookup)
+	}
+
+	// Only b.example has a regex, which its answer does not match.
+	if got := stats[0].failureReasons(); got != "bad-answer: 1" {
+		t.Errorf("expected failure reasons %q, got %q", "bad-answer: 1", got)
+	}
+}
+
+func TestParseAnswerRegexes(t *testing.T) {
+	regexes, err := parseAnswerRegexes([]string{"Bing.com.=^v=spf1 ", "_sip._tcp.example=^10 "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if re := regexes["bing.com"]; re == nil || !re.MatchString("v=spf1 -all") {
+		t.Errorf("expected bing.com to match v=spf1, got %v", re)
+	}
+	if re := regexes["_sip._tcp.example"]; re == nil || re.String() != "^10 " {
+		t.Errorf("expected ^10 for _sip._tcp.example, got %v", re)
+	}
+	for _, entry := range []string{"bing.com", "=^1", "bing.com=[0-9"} {
+		if _, err := parseAnswerRegexes([]string{entry}); err == nil {
+			t.Errorf("%q: expected an error", entry)
+		}
+	}
+}
+
+func TestParseTargetLimits(t *testing.T) {
+	limits, err := parseTargetLimits([]string{"pod=8", "baseline=1"}, strconv.Atoi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits[targetPod] != 8 || limits[targetBaseline] != 1 || len(limits) != 2 {
+		t.Errorf("expected pod=8 and baseline=1, got %v", limits)
+	}
+	for _, entry := range []string{"pod", "pods=1", "pod=0", "pod=-1", "pod=x", "pod=1.5"} {
+		if _, err := parseTargetLimits([]string{entry}, strconv.Atoi); err == nil {
+			t.Errorf("%q: expected an error", entry)
+		}
+	}
+}
+
+func TestRunColdStart(t *testing.T) {
+	queryTimeout, protocols, queryDomain, coldStartEvery = time.Second, []string{"udp", "tcp"}, "bing.com", 10*time.Millisecond
+	successCriteria = criteria.Default(queryTimeout)
+	stats := []*epStats{newEpStats(0), newEpStats(0)}
+	stats[1].coldUntil = time.Now().Add(time.Minute)
+
+	var mu sync.Mutex
+	queried := map[string]int{}
+	lookup := func(_ context.Context, addr, _, _ string) ([]string, time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		queried[addr]++
+		return []string{"192.0.2.1"}, time.Millisecond, nil
+	}
+	runColdStart(context.Background(), []string{"10.0.0.1", "10.0.0.2"}, stats, lookup)
+
+	if queried["10.0.0.1"] != 0 || queried["10.0.0.2"] != 2 {
+		t.Errorf("expected one query per protocol to the cold endpoint only, got %v", queried)
+	}
+	// The results stay out of the endpoint's stats.
+	if got := stats[1].load().total; got != 0 {
+		t.Errorf("expected no queries in the stats, got %d", got)
+	}
+}
+
+func TestRunColdStartConcurrency(t *testing.T) {
+	queryTimeout, protocols, queryDomain, coldStartEvery = time.Second, []string{"udp", "tcp"}, "bing.com", time.Second
+	successCriteria = criteria.Default(queryTimeout)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	workers = newPool(ctx, 1)
+	defer func() { workers = nil }()
+
+	var inFlight, maxInFlight, total atomic.Int32
+	lookup := func(context.Context, string, string, string) ([]string, time.Duration, error) {
+		total.Add(1)
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return []string{"192.0.2.1"}, time.Millisecond, nil
+	}
+
+	stats := []*epStats{newEpStats(0), newEpStats(0)}
+	for _, st := range stats {
+		st.coldUntil = time.Now().Add(time.Minute)
+	}
+	runColdStart(ctx, []string{"10.0.0.1", "10.0.0.2"}, stats, lookup)
+
+	if got := total.Load(); got != 4 {
+		t.Errorf("expected 4 queries, got %d", got)
+	}
+	if got := maxInFlight.Load(); got > 1 {
+		t.Errorf("expected cold-start queries to share --concurrency 1, got %d at once", got)
+	}
+}
+
+func TestRandomizeName(t *testing.T) {
+	a, b := randomizeName("bing.com"), randomizeName("bing.com")
+	for _, name := range []string{a, b} {
+		if !strings.HasPrefix(name, "probe-") || !strings.HasSuffix(name, ".bing.com") {
+			t.Errorf("expected probe-<rand>.bing.com, got %q", name)
+		}
+	}
+	if a == b {
+		t.Errorf("expected different names, got %q twice", a)
+	}
+}
+
+func TestJittered(t *testing.T) {
+	defer func() { jitter = 0 }()
+	jitter = 0
+	if got := jittered(time.Second); got != time.Second {
+		t.Errorf("expected no jitter by default, got %v", got)
+	}
+
+	jitter = 0.25
+	var lower, higher bool
+	for range 1000 {
+		got := jittered(time.Second)
+		if got < 750*time.Millisecond || got > 1250*time.Millisecond {
+			t.Fatalf("expected an interval within ±25%% of 1s, got %v", got)
+		}
+		lower = lower || got < time.Second
+		higher = higher || got > time.Second
+	}
+	if !lower || !higher {
+		t.Errorf("expected intervals both below and above 1s")
+	}
+}
+
+func TestRunCycleStagger(t *testing.T) {
+	queryTimeout, protocols = time.Second, []string{"udp"}
+	successCriteria = criteria.Default(queryTimeout)
+	loopInterval, jitter = 200*time.Millisecond, 0.5
+	defer func() { loopInterval, jitter = 0, 0 }()
+
+	servers := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	stats := make([]*epStats, len(servers))
+	for i := range stats {
+		stats[i] = newEpStats(0)
+	}
+	var mu sync.Mutex
+	var sentAt []time.Time
+	lookup := func(context.Context, string, string, string) ([]string, time.Duration, error) {
+		mu.Lock()
+		sentAt = append(sentAt, time.Now())
+		mu.Unlock()
+		return []string{"192.0.2.1"}, time.Millisecond, nil
+	}
+
+	start := time.Now()
+	runCycle(context.Background(), servers, stats, lookup)
+	if len(sentAt) != len(servers) {
+		t.Fatalf("expected %d queries, got %d", len(servers), len(sentAt))
+	}
+	for i, at := range sentAt {
+		if d := at.Sub(start); d > 150*time.Millisecond {
+			t.Errorf("query %d was delayed by %v, expected at most %v", i, d, 100*time.Millisecond)
+		}
+	}
+	for i, st := range stats {
+		if st.load().total != 1 || st.load().fail != 0 {
+			t.Errorf("endpoint %d: expected 1 successful query, got total %d fail %d", i, st.load().total, st.load().fail)
+		}
+	}
+}
+
+func TestRunCycleNegative(t *testing.T) {
+	queryTimeout, protocols, queryDomain = time.Second, []string{"udp"}, "kubernetes.default.svc.cluster.local"
+	successCriteria = criteria.Default(queryTimeout)
+	negativeDomain = "does-not-exist.cluster.local"
+	negativeCriteria = criteria.Criteria{Rcodes: []string{criteria.RcodeNXDomain}}
+	defer func() { queryDomain, negativeDomain = "", "" }()
+
+	servers := []string{"10.0.0.1", "10.0.0.2"}
+	stats := []*epStats{newEpStats(0), newEpStats(0)}
+	lookup := func(_ context.Context, addr, _, name string) ([]string, time.Duration, error) {
+		switch {
+		case name == queryDomain:
+			return []string{"10.96.0.1"}, time.Millisecond, nil
+		case addr == "10.0.0.1":
+			return nil, time.Millisecond, &criteria.RcodeError{Rcode: criteria.RcodeNXDomain}
+		default:
+			return nil, time.Millisecond, &criteria.RcodeError{Rcode: criteria.RcodeServFail}
+		}
+	}
+	runCycle(context.Background(), servers, stats, lookup)
+
+	for i, st := range stats {
+		if st.load().total != 1 || st.load().fail != 0 {
+			t.Errorf("endpoint %d: expected 1 successful positive query, got total %d fail %d", i, st.load().total, st.load().fail)
+		}
+		if st.negative.load().total != 1 {
+			t.Errorf("endpoint %d: expected 1 negative query, got %d", i, st.negative.load().total)
+		}
+	}
+	if fail := stats[0].negative.load().fail; fail != 0 {
+		t.Errorf("expected NXDOMAIN to pass the negative probe, got %d failures", fail)
+	}
+	if fail := stats[1].negative.load().fail; fail != 1 {
+		t.Errorf("expected SERVFAIL to fail the negative probe, got %d failures", fail)
+	}
+	if got := stats[1].failureReasons(); got != "negative-servfail: 1" {
+		t.Errorf("expected reason negative-servfail, got %q", got)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// dnsPortPreferredName is the name CoreDNS deployments give their UDP DNS port.
+const dnsPortPreferredName = "dns"
+
+// dnsTCPPortPreferredName is the name CoreDNS deployments give their TCP DNS port.
+const dnsTCPPortPreferredName = "dns-tcp"
+
+// defaultDNSPort is used when neither the Service nor the EndpointSlice names a DNS port.
+const defaultDNSPort = 53
+
+// Kinds of probed endpoints, exported as the target label of the endpoint info metric.
+const (
+	targetPod       = "pod"       // a CoreDNS pod from an EndpointSlice
+	targetService   = "service"   // the ClusterIP of the Service, reached through kube-proxy
+	targetStatic    = "static"    // a server from --servers
+	targetBaseline  = "baseline"  // a resolver outside the cluster from --baseline-resolver, for comparison
+	targetNodeLocal = "nodelocal" // the NodeLocal DNSCache of the probe's node from --node-local
+)
+
+// endpoint is a single DNS server address to probe, usually a CoreDNS pod
+// discovered from an EndpointSlice.
+type endpoint struct {
+	Addr    string
+	Port    int32
+	TCPPort int32          // port for queries over TCP if it differs from Port, 0 otherwise
+	Family  v1.AddressType // IPv4 or IPv6
+	Pod     string         // name of the backing pod from targetRef, empty if unknown
+	Node    string         // node of the backing pod, empty if unknown
+	Zone    string         // topology zone of the backing pod, empty if unknown
+	Ready   bool
+	Target  string // targetPod, targetService, targetStatic, targetBaseline or targetNodeLocal
+}
+
+// hostPort is the address DNS queries are sent to.
+func (e endpoint) hostPort() string {
+	return net.JoinHostPort(e.Addr, strconv.Itoa(int(e.Port)))
+}
+
+// hostPortFor is the address queries over proto are sent to: TCPPort, if set, for
+// "tcp", dotPort for "dot" and dohPort for "doh", since encrypted DNS listens
+// apart from plain DNS, and hostPort otherwise.
+func (e endpoint) hostPortFor(proto string) string {
+	switch proto {
+	case "tcp":
+		if e.TCPPort != 0 {
+			return net.JoinHostPort(e.Addr, strconv.Itoa(int(e.TCPPort)))
+		}
+	case "dot":
+		return net.JoinHostPort(e.Addr, strconv.Itoa(dotPort))
+	case "doh":
+		return net.JoinHostPort(e.Addr, strconv.Itoa(dohPort))
+	}
+	return e.hostPort()
+}
+
+// endpointsFromSlices flattens EndpointSlices into endpoints, skipping not-ready
+// ones unless includeNotReady is set. The DNS ports are resolved with dnsPortName
+// and dnsTCPPortName, using svc when it is not nil. Dual-stack services publish one slice per
+// address family, so a pod shows up once per family; the result is ordered by pod
+// and then family to keep the addresses of the same pod together.
+func endpointsFromSlices(items []v1.EndpointSlice, svc *corev1.Service, includeNotReady bool) []endpoint {
+	name, tcpName := dnsPortName(svc), dnsTCPPortName(svc)
+	var eps []endpoint
+	for _, es := range items {
+		port := slicePort(es, name, corev1.ProtocolUDP, defaultDNSPort)
+		tcpPort := slicePort(es, tcpName, corev1.ProtocolTCP, port)
+		for _, ep := range es.Endpoints {
+			// A nil Ready condition means unknown and is treated as ready, per the API docs.
+			ready := ep.Conditions.Ready == nil || *ep.Conditions.Ready
+			if !ready && !includeNotReady {
+				continue
+			}
+			pod, node := "", ""
+			if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" {
+				pod = ep.TargetRef.Name
+			}
+			if ep.NodeName != nil {
+				node = *ep.NodeName
+			}
+			zone := ep.DeprecatedTopology[corev1.LabelTopologyZone]
+			if ep.Zone != nil {
+				zone = *ep.Zone
+			}
+			for _, addr := range ep.Addresses {
+				eps = append(eps, endpoint{Addr: addr, Port: port, TCPPort: otherPort(tcpPort, port), Family: es.AddressType, Pod: pod, Node: node, Zone: zone, Ready: ready, Target: targetPod})
+			}
+		}
+	}
+	sortByPod(eps)
+	return eps
+}
+
+// sortByPod orders eps by pod and then family, keeping the addresses of a pod
+// together.
+func sortByPod(eps []endpoint) {
+	slices.SortStableFunc(eps, func(a, b endpoint) int {
+		return cmp.Or(cmp.Compare(a.Pod, b.Pod), cmp.Compare(a.Family, b.Family))
+	})
+}
+
+// probedEndpoints is endpointsFromSlices for discovery: it skips not-ready
+// endpoints unless probeNotReady is set and, with onlyZone set, those in other
+// zones or without one.
+func probedEndpoints(items []v1.EndpointSlice, svc *corev1.Service) []endpoint {
+	return inZone(endpointsFromSlices(items, svc, probeNotReady))
+}
+
+// inZone drops the endpoints outside onlyZone, if set.
+func inZone(eps []endpoint) []endpoint {
+	if onlyZone == "" {
+		return eps
+	}
+	return slices.DeleteFunc(eps, func(e endpoint) bool { return e.Zone != onlyZone })
+}
+
+// endpointsFromEndpoints is endpointsFromSlices for the core/v1 Endpoints of a
+// Service, on clusters without EndpointSlices. These carry no zone.
+func endpointsFromEndpoints(e *corev1.Endpoints, svc *corev1.Service, includeNotReady bool) []endpoint {
+	name, tcpName := dnsPortName(svc), dnsTCPPortName(svc)
+	var eps []endpoint
+	for _, subset := range e.Subsets {
+		port := subsetPort(subset, name, corev1.ProtocolUDP, defaultDNSPort)
+		tcpPort := otherPort(subsetPort(subset, tcpName, corev1.ProtocolTCP, port), port)
+		add := func(addrs []corev1.EndpointAddress, ready bool) {
+			for _, a := range addrs {
+				ep := endpoint{Addr: a.IP, Port: port, TCPPort: tcpPort, Family: v1.AddressTypeIPv4, Ready: ready, Target: targetPod}
+				if addr, err := netip.ParseAddr(a.IP); err == nil && addr.Is6() {
+					ep.Family = v1.AddressTypeIPv6
+				}
+				if a.TargetRef != nil && a.TargetRef.Kind == "Pod" {
+					ep.Pod = a.TargetRef.Name
+				}
+				if a.NodeName != nil {
+					ep.Node = *a.NodeName
+				}
+				eps = append(eps, ep)
+			}
+		}
+		add(subset.Addresses, true)
+		if includeNotReady {
+			add(subset.NotReadyAddresses, false)
+		}
+	}
+	sortByPod(eps)
+	return eps
+}
+
+// subsetPort is slicePort for a subset of core/v1 Endpoints.
+func subsetPort(subset corev1.EndpointSubset, name string, protocol corev1.Protocol, fallback int32) int32 {
+	for _, p := range subset.Ports {
+		if p.Protocol == protocol && p.Name == name {
+			return p.Port
+		}
+	}
+	warnPortOnce("Endpoints", "Endpoints have no %s port named %q, using port %d", protocol, name, fallback)
+	return fallback
+}
+
+// nodeZone returns the zone of the named node from its topology.kubernetes.io/zone
+// label, for the probe to find its own zone.
+func nodeZone(ctx context.Context, client kubernetes.Interface, name string) (string, error) {
+	node, err := client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("getting node %s: %w", name, err)
+	}
+	zone := node.Labels[corev1.LabelTopologyZone]
+	if zone == "" {
+		return "", fmt.Errorf("node %s has no %s label", name, corev1.LabelTopologyZone)
+	}
+	return zone, nil
+}
+
+// staticEndpoints turns the --servers list into endpoints. Each entry is an IP
+// address, probed on defaultDNSPort, or an address with a port such as
+// 10.0.0.10:5353 or [fd00::10]:53.
+func staticEndpoints(addrs []string) ([]endpoint, error) {
+	eps := make([]endpoint, 0, len(addrs))
+	for _, a := range addrs {
+		ap, err := netip.ParseAddrPort(a)
+		if err != nil {
+			addr, err := netip.ParseAddr(a)
+			if err != nil {
+				return nil, fmt.Errorf("invalid server %q, expected an IP address with an optional port", a)
+			}
+			ap = netip.AddrPortFrom(addr, defaultDNSPort)
+		}
+		family := v1.AddressTypeIPv4
+		if ap.Addr().Is6() && !ap.Addr().Is4In6() {
+			family = v1.AddressTypeIPv6
+		}
+		eps = append(eps, endpoint{Addr: ap.Addr().String(), Port: int32(ap.Port()), Family: family, Ready: true, Target: targetStatic})
+	}
+	return eps, nil
+}
+
+// baselineEndpoint parses --baseline-resolver like an entry of --servers.
+func baselineEndpoint(addr string) (endpoint, error) {
+	eps, err := staticEndpoints([]string{addr})
+	if err != nil {
+		return endpoint{}, err
+	}
+	eps[0].Target = targetBaseline
+	return eps[0], nil
+}
+
+// nodeLocalEndpoint parses --node-local like an entry of --servers, for the
+// NodeLocal DNSCache on node.
+func nodeLocalEndpoint(addr, node string) (endpoint, error) {
+	eps, err := staticEndpoints([]string{addr})
+	if err != nil {
+		return endpoint{}, err
+	}
+	eps[0].Target, eps[0].Node = targetNodeLocal, node
+	return eps[0], nil
+}
+
+// isCoreDNS reports whether e is a single CoreDNS server with its health and
+// metrics ports, rather than the ClusterIP, behind which every request may reach
+// another pod, the baseline resolver or NodeLocal DNSCache.
+func (e endpoint) isCoreDNS() bool {
+	return e.Target == targetPod || e.Target == targetStatic
+}
+
+// serviceEndpoints returns an endpoint for each ClusterIP of svc, one per address
+// family, on the Service's DNS port.
+func serviceEndpoints(svc *corev1.Service) ([]endpoint, error) {
+	ips := svc.Spec.ClusterIPs
+	if len(ips) == 0 && svc.Spec.ClusterIP != "" {
+		ips = []string{svc.Spec.ClusterIP}
+	}
+	if len(ips) == 0 || ips[0] == corev1.ClusterIPNone {
+		return nil, fmt.Errorf("service %s/%s has no ClusterIP", svc.Namespace, svc.Name)
+	}
+	name, tcpName := dnsPortName(svc), dnsTCPPortName(svc)
+	port, tcpPort := int32(defaultDNSPort), int32(0)
+	for _, p := range svc.Spec.Ports {
+		switch {
+		case p.Protocol == corev1.ProtocolUDP && p.Name == name:
+			port = p.Port
+		case p.Protocol == corev1.ProtocolTCP && p.Name == tcpName:
+			tcpPort = p.Port
+		}
+	}
+	tcpPort = otherPort(tcpPort, port)
+	eps := make([]endpoint, 0, len(ips))
+	for _, ip := range ips {
+		family := v1.AddressTypeIPv4
+		if addr, err := netip.ParseAddr(ip); err == nil && addr.Is6() {
+			family = v1.AddressTypeIPv6
+		}
+		eps = append(eps, endpoint{Addr: ip, Port: port, TCPPort: tcpPort, Family: family, Ready: true, Target: targetService})
+	}
+	return eps, nil
+}
+
+// dnsPortName picks the name of the Service's UDP DNS port: the one named
+// dnsPortPreferredName if present, otherwise the first UDP port. Without a Service
+// the conventional name is assumed.
+func dnsPortName(svc *corev1.Service) string {
+	if svc == nil {
+		return dnsPortPreferredName
+	}
+	var first string
+	for _, p := range svc.Spec.Ports {
+		if p.Protocol != corev1.ProtocolUDP {
+			continue
+		}
+		if p.Name == dnsPortPreferredName {
+			return p.Name
+		}
+		if first == "" {
+			first = p.Name
+		}
+	}
+	if first == "" {
+		return dnsPortPreferredName
+	}
+	return first
+}
+
+// dnsTCPPortName picks the name of the Service's TCP DNS port: the one named
+// dnsTCPPortPreferredName if present, otherwise the TCP port on the same port as
+// the UDP DNS port. Without either the conventional name is assumed, which a slice
+// lacking it answers with the UDP port.
+func dnsTCPPortName(svc *corev1.Service) string {
+	if svc == nil {
+		return dnsTCPPortPreferredName
+	}
+	name := dnsPortName(svc)
+	udpPort := int32(-1)
+	for _, p := range svc.Spec.Ports {
+		if p.Protocol == corev1.ProtocolUDP && p.Name == name {
+			udpPort = p.Port
+			break
+		}
+	}
+	same, found := "", false
+	for _, p := range svc.Spec.Ports {
+		if p.Protocol != corev1.ProtocolTCP {
+			continue
+		}
+		if p.Name == dnsTCPPortPreferredName {
+			return p.Name
+		}
+		if p.Port == udpPort && !found {
+			same, found = p.Name, true
+		}
+	}
+	if !found {
+		return dnsTCPPortPreferredName
+	}
+	return same
+}
+
+// slicePort returns the port called name with protocol in the EndpointSlice, which
+// holds the resolved target port of the pods, falling back to fallback with a
+// warning.
+func slicePort(es v1.EndpointSlice, name string, protocol corev1.Protocol, fallback int32) int32 {
+	for _, p := range es.Ports {
+		proto := corev1.ProtocolTCP
+		if p.Protocol != nil {
+			proto = *p.Protocol
+		}
+		if p.Port != nil && proto == protocol && (p.Name == nil && name == "" || p.Name != nil && *p.Name == name) {
+			return *p.Port
+		}
+	}
+	warnPortOnce(es.Name, "EndpointSlice %s has no %s port named %q, using port %d", es.Name, protocol, name, fallback)
+	return fallback
+}
+
+// warnedPorts holds the port fallbacks already logged, keyed by the object and
+// the message, so watch events and polls of an unchanged slice log them once.
+var warnedPorts sync.Map
+
+// warnPortOnce logs a port fallback of the named object the first time it is seen.
+func warnPortOnce(object, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if _, seen := warnedPorts.LoadOrStore(object+"\x00"+msg, struct{}{}); !seen {
+		log.Print(msg)
+	}
+}
+
+// otherPort is the TCPPort of an endpoint on port whose TCP DNS port is tcpPort:
+// 0 when they are the same.
+func otherPort(tcpPort, port int32) int32 {
+	if tcpPort == port {
+		return 0
+	}
+	return tcpPort
+}
+
+// summarySuffix annotates a summary line with the pod, family and node, so the IPv4
+// and IPv6 results of a dual-stack pod can be compared, and flags not-ready endpoints.
+func (e endpoint) summarySuffix() string {
+	var suffix string
+	switch {
+	case e.Target == targetService:
+		suffix = "  [service " + string(e.Family) + "]"
+	case e.Target == targetBaseline:
+		suffix = "  [baseline]"
+	case e.Target == targetNodeLocal && e.Node != "":
+		suffix = "  [nodelocal on " + e.Node + "]"
+	case e.Target == targetNodeLocal:
+		suffix = "  [nodelocal]"
+	case e.Pod != "" && e.Node != "":
+		suffix = "  [" + e.Pod + " " + string(e.Family) + " on " + e.Node + "]"
+	case e.Pod != "":
+		suffix = "  [" + e.Pod + " " + string(e.Family) + "]"
+	}
+	if !e.Ready {
+		suffix += "  (not ready)"
+	}
+	return suffix
+}
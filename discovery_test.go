@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEndpointsFromSlices(t *testing.T) {
+	ready, notReady := true, false
+	node, zone := "node-1", "zone-1"
+	podRef := func(name string) *corev1.ObjectReference {
+		return &corev1.ObjectReference{Kind: "Pod", Name: name}
+	}
+	items := []v1.EndpointSlice{
+		{
+			AddressType: v1.AddressTypeIPv6,
+			Endpoints: []v1.Endpoint{
+				{Addresses: []string{"fd00::b"}, Conditions: v1.EndpointConditions{Ready: &ready}, TargetRef: podRef("coredns-b")},
+				{Addresses: []string{"fd00::a"}, Conditions: v1.EndpointConditions{Ready: &ready}, TargetRef: podRef("coredns-a"), DeprecatedTopology: map[string]string{corev1.LabelTopologyZone: "zone-1"}},
+			},
+		},
+		{
+			AddressType: v1.AddressTypeIPv4,
+			Endpoints: []v1.Endpoint{
+				{Addresses: []string{"10.0.0.1"}, Conditions: v1.EndpointConditions{Ready: &ready}, TargetRef: podRef("coredns-a"), NodeName: &node, Zone: &zone},
+				{Addresses: []string{"10.0.0.2"}, TargetRef: podRef("coredns-b")},
+				{Addresses: []string{"10.0.0.3"}, Conditions: v1.EndpointConditions{Ready: &notReady}, TargetRef: podRef("coredns-c")},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name            string
+		includeNotReady bool
+		expected        []endpoint
+	}{
+		{
+			name: "dual_stack_grouped_by_pod",
+			expected: []endpoint{
+				{Addr: "10.0.0.1", Port: 53, Family: v1.AddressTypeIPv4, Pod: "coredns-a", Node: "node-1", Zone: "zone-1", Ready: true, Target: targetPod},
+				{Addr: "fd00::a", Port: 53, Family: v1.AddressTypeIPv6, Pod: "coredns-a", Zone: "zone-1", Ready: true, Target: targetPod},
+				{Addr: "10.0.0.2", Port: 53, Family: v1.AddressTypeIPv4, Pod: "coredns-b", Ready: true, Target: targetPod},
+				{Addr: "fd00::b", Port: 53, Family: v1.AddressTypeIPv6, Pod: "coredns-b", Ready: true, Target: targetPod},
+			},
+		},
+		{
+			name:            "include_not_ready",
+			includeNotReady: true,
+			expected: []endpoint{
+				{Addr: "10.0.0.1", Port: 53, Family: v1.AddressTypeIPv4, Pod: "coredns-a", Node: "node-1", Zone: "zone-1", Ready: true, Target: targetPod},
+				{Addr: "fd00::a", Port: 53, Family: v1.AddressTypeIPv6, Pod: "coredns-a", Zone: "zone-1", Ready: true, Target: targetPod},
+				{Addr: "10.0.0.2", Port: 53, Family: v1.AddressTypeIPv4, Pod: "coredns-b", Ready: true, Target: targetPod},
+				{Addr: "fd00::b", Port: 53, Family: v1.AddressTypeIPv6, Pod: "coredns-b", Ready: true, Target: targetPod},
+				{Addr: "10.0.0.3", Port: 53, Family: v1.AddressTypeIPv4, Pod: "coredns-c", Ready: false, Target: targetPod},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := endpointsFromSlices(items, nil, tc.includeNotReady)
+			if !slices.Equal(got, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestProbedEndpointsSameZone(t *testing.T) {
+	zoneA, zoneB := "zone-a", "zone-b"
+	items := []v1.EndpointSlice{{
+		AddressType: v1.AddressTypeIPv4,
+		Endpoints: []v1.Endpoint{
+			{Addresses: []string{"10.0.0.1"}, Zone: &zoneA},
+			{Addresses: []string{"10.0.0.2"}, Zone: &zoneB},
+			{Addresses: []string{"10.0.0.3"}},
+		},
+	}}
+	defer func() { onlyZone = "" }()
+
+	testCases := []struct {
+		zone     string
+		expected []string
+	}{
+		{zone: "", expected: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{zone: "zone-a", expected: []string{"10.0.0.1"}},
+		{zone: "zone-c", expected: nil},
+	}
+	for _, tc := range testCases {
+		onlyZone = tc.zone
+		var got []string
+		for _, ep := range probedEndpoints(items, nil) {
+			got = append(got, ep.Addr)
+		}
+		if !slices.Equal(got, tc.expected) {
+			t.Errorf("zone %q: expected %v, got %v", tc.zone, tc.expected, got)
+		}
+	}
+}
+
+func TestNodeZone(t *testing.T) {
+	client := fake.NewClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{corev1.LabelTopologyZone: "eastus-1"}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+	)
+	if zone, err := nodeZone(context.Background(), client, "node-1"); err != nil || zone != "eastus-1" {
+		t.Errorf("expected zone eastus-1, got %q, %v", zone, err)
+	}
+	for _, name := range []string{"node-2", "missing"} {
+		if _, err := nodeZone(context.Background(), client, name); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+}
+
+func TestEndpointsFromSlicesNamedPorts(t *testing.T) {
+	udp, tcp := corev1.ProtocolUDP, corev1.ProtocolTCP
+	port := func(name string, protocol corev1.Protocol, number int32) v1.EndpointPort {
+		return v1.EndpointPort{Name: &name, Protocol: &protocol, Port: &number}
+	}
+	slice := v1.EndpointSlice{
+		AddressType: v1.AddressTypeIPv4,
+		Ports: []v1.EndpointPort{
+			port("dns-tcp", tcp, 1053),
+			port("metrics", tcp, 9153),
+			port("dns", udp, 1053),
+			port("dns-alt", udp, 5353),
+		},
+		Endpoints: []v1.Endpoint{{Addresses: []string{"10.0.0.1"}}},
+	}
+	service := func(ports ...corev1.ServicePort) *corev1.Service {
+		return &corev1.Service{Spec: corev1.ServiceSpec{Ports: ports}}
+	}
+
+	testCases := []struct {
+		name        string
+		svc         *corev1.Service
+		slice       v1.EndpointSlice
+		expected    int32
+		expectedTCP string
+	}{
+		{
+			name:        "no_service_uses_dns_name",
+			slice:       slice,
+			expected:    1053,
+			expectedTCP: "10.0.0.1:1053",
+		},
+		{
+			name: "service_prefers_dns_name",
+			svc: service(
+				corev1.ServicePort{Name: "dns-tcp", Protocol: tcp, Port: 53},
+				corev1.ServicePort{Name: "dns", Protocol: udp, Port: 53},
+			),
+			slice:       slice,
+			expected:    1053,
+			expectedTCP: "10.0.0.1:1053",
+		},
+		{
+			name: "service_custom_udp_name",
+			svc: service(
+				corev1.ServicePort{Name: "metrics", Protocol: tcp, Port: 9153},
+				corev1.ServicePort{Name: "dns-alt", Protocol: udp, Port: 53},
+			),
+			slice:       slice,
+			expected:    5353,
+			expectedTCP: "10.0.0.1:1053",
+		},
+		{
+			name: "service_tcp_port_on_udp_port",
+			svc: service(
+				corev1.ServicePort{Name: "metrics", Protocol: tcp, Port: 9153},
+				corev1.ServicePort{Name: "dns-alt", Protocol: udp, Port: 53},
+				corev1.ServicePort{Name: "metrics", Protocol: tcp, Port: 53},
+			),
+			slice:       slice,
+			expected:    5353,
+			expectedTCP: "10.0.0.1:9153",
+		},
+		{
+			name:        "no_matching_slice_port_falls_back",
+			svc:         service(corev1.ServicePort{Name: "dns", Protocol: udp, Port: 53}),
+			slice:       v1.EndpointSlice{AddressType: v1.AddressTypeIPv4, Endpoints: slice.Endpoints},
+			expected:    defaultDNSPort,
+			expectedTCP: "10.0.0.1:53",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			eps := endpointsFromSlices([]v1.EndpointSlice{tc.slice}, tc.svc, false)
+			if len(eps) != 1 {
+				t.Fatalf("expected 1 endpoint, got %d", len(eps))
+			}
+			if eps[0].Port != tc.expected {
+				t.Errorf("expected port %d, got %d", tc.expected, eps[0].Port)
+			}
+			if got := eps[0].hostPortFor("tcp"); got != tc.expectedTCP {
+				t.Errorf("expected TCP probes to %s, got %s", tc.expectedTCP, got)
+			}
+		})
+	}
+}
+
+func TestStaticEndpoints(t *testing.T) {
+	testCases := []struct {
+		name     string
+		addrs    []string
+		expected []endpoint
+		err      bool
+	}{
+		{
+			name:  "ips_and_ports",
+			addrs: []string{"10.0.0.10", "192.0.2.1:5353", "fd00::10", "[fd00::11]:1053"},
+			expected: []endpoint{
+				{Addr: "10.0.0.10", Port: 53, Family: v1.AddressTypeIPv4, Ready: true, Target: targetStatic},
+				{Addr: "192.0.2.1", Port: 5353, Family: v1.AddressTypeIPv4, Ready: true, Target: targetStatic},
+				{Addr: "fd00::10", Port: 53, Family: v1.AddressTypeIPv6, Ready: true, Target: targetStatic},
+				{Addr: "fd00::11", Port: 1053, Family: v1.AddressTypeIPv6, Ready: true, Target: targetStatic},
+			},
+		},
+		{
+			name:  "hostname",
+			addrs: []string{"dns.example.com"},
+			err:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := staticEndpoints(tc.addrs)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("staticEndpoints: %v", err)
+			}
+			if !slices.Equal(got, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestServiceEndpoints(t *testing.T) {
+	udp, tcp := corev1.ProtocolUDP, corev1.ProtocolTCP
+	svc := &corev1.Service{Spec: corev1.ServiceSpec{
+		ClusterIPs: []string{"10.96.0.10", "fd00:96::a"},
+		Ports: []corev1.ServicePort{
+			{Name: "dns-tcp", Protocol: tcp, Port: 53},
+			{Name: "dns", Protocol: udp, Port: 5353},
+		},
+	}}
+	expected := []endpoint{
+		{Addr: "10.96.0.10", Port: 5353, TCPPort: 53, Family: v1.AddressTypeIPv4, Ready: true, Target: targetService},
+		{Addr: "fd00:96::a", Port: 5353, TCPPort: 53, Family: v1.AddressTypeIPv6, Ready: true, Target: targetService},
+	}
+	got, err := serviceEndpoints(svc)
+	if err != nil {
+		t.Fatalf("serviceEndpoints: %v", err)
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+
+	headless := &corev1.Service{Spec: corev1.ServiceSpec{ClusterIP: corev1.ClusterIPNone, ClusterIPs: []string{corev1.ClusterIPNone}}}
+	if _, err := serviceEndpoints(headless); err == nil {
+		t.Error("expected an error for a headless Service")
+	}
+}
+
+func TestBaselineEndpoint(t *testing.T) {
+	got, err := baselineEndpoint("8.8.8.8")
+	if err != nil {
+		t.Fatalf("baselineEndpoint: %v", err)
+	}
+	expected := endpoint{Addr: "8.8.8.8", Port: 53, Family: v1.AddressTypeIPv4, Ready: true, Target: targetBaseline}
+	if got != expected {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+	if _, err := baselineEndpoint("dns.google"); err == nil {
+		t.Error("expected an error for a host name")
+	}
+}
+
+func TestNodeLocalEndpoint(t *testing.T) {
+	got, err := nodeLocalEndpoint("169.254.20.10", "node-a")
+	if err != nil {
+		t.Fatalf("nodeLocalEndpoint: %v", err)
+	}
+	expected := endpoint{Addr: "169.254.20.10", Port: 53, Family: v1.AddressTypeIPv4, Node: "node-a", Ready: true, Target: targetNodeLocal}
+	if got != expected {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+	if got.isCoreDNS() {
+		t.Error("expected NodeLocal DNSCache not to be health-checked or scraped as CoreDNS")
+	}
+	if suffix := got.summarySuffix(); suffix != "  [nodelocal on node-a]" {
+		t.Errorf("expected summary suffix [nodelocal on node-a], got %q", suffix)
+	}
+}
+
+func TestIsCoreDNS(t *testing.T) {
+	for target, expected := range map[string]bool{
+		targetPod:       true,
+		targetStatic:    true,
+		targetService:   false,
+		targetBaseline:  false,
+		targetNodeLocal: false,
+	} {
+		if got := (endpoint{Addr: "10.96.0.10", Port: 53, Target: target}).isCoreDNS(); got != expected {
+			t.Errorf("%s: expected isCoreDNS %v, got %v", target, expected, got)
+		}
+	}
+}
+
+func TestHostPortFor(t *testing.T) {
+	dotPort, dohPort = 853, 443
+	defer func() { dotPort, dohPort = 0, 0 }()
+	ep := endpoint{Addr: "fd00::10", Port: 5353, TCPPort: 1053}
+	for proto, expected := range map[string]string{
+		"udp": "[fd00::10]:5353",
+		"tcp": "[fd00::10]:1053",
+		"dot": "[fd00::10]:853",
+		"doh": "[fd00::10]:443",
+	} {
+		if got := ep.hostPortFor(proto); got != expected {
+			t.Errorf("%s: expected %s, got %s", proto, expected, got)
+		}
+	}
+}
+
+func TestEndpointsFromEndpoints(t *testing.T) {
+	node := "node-1"
+	e := &corev1.Endpoints{
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{
+				{IP: "10.0.0.2", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "coredns-b"}},
+				{IP: "10.0.0.1", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "coredns-a"}, NodeName: &node},
+			},
+			NotReadyAddresses: []corev1.EndpointAddress{{IP: "fd00::c"}},
+			Ports: []corev1.EndpointPort{
+				{Name: "dns-tcp", Port: 53, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 5353, Protocol: corev1.ProtocolUDP},
+			},
+		}},
+	}
+
+	testCases := []struct {
+		name            string
+		includeNotReady bool
+		expected        []endpoint
+	}{
+		{
+			name: "ready",
+			expected: []endpoint{
+				{Addr: "10.0.0.1", Port: 5353, TCPPort: 53, Family: v1.AddressTypeIPv4, Pod: "coredns-a", Node: "node-1", Ready: true, Target: targetPod},
+				{Addr: "10.0.0.2", Port: 5353, TCPPort: 53, Family: v1.AddressTypeIPv4, Pod: "coredns-b", Ready: true, Target: targetPod},
+			},
+		},
+		{
+			name:            "include_not_ready",
+			includeNotReady: true,
+			expected: []endpoint{
+				{Addr: "fd00::c", Port: 5353, TCPPort: 53, Family: v1.AddressTypeIPv6, Ready: false, Target: targetPod},
+				{Addr: "10.0.0.1", Port: 5353, TCPPort: 53, Family: v1.AddressTypeIPv4, Pod: "coredns-a", Node: "node-1", Ready: true, Target: targetPod},
+				{Addr: "10.0.0.2", Port: 5353, TCPPort: 53, Family: v1.AddressTypeIPv4, Pod: "coredns-b", Ready: true, Target: targetPod},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := endpointsFromEndpoints(e, nil, tc.includeNotReady)
+			if !slices.Equal(got, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// defaultEDNSBufSize is advertised when --dns-flags asks for EDNS0 without
+// --edns-bufsize or +bufsize, the size recommended by DNS Flag Day 2020.
+const defaultEDNSBufSize = 1232
+
+// dnsFlags are the header bits and EDNS0 settings of every query, parsed from
+// --dns-flags on top of the granular flags.
+type dnsFlags struct {
+	recurse   bool   // RD
+	cd        bool   // checking disabled
+	ad        bool   // authentic data
+	dnssec    bool   // the DO bit, which needs EDNS0
+	cookie    bool   // DNS cookies, which need EDNS0, see setCookie
+	bufSize   int    // EDNS0 UDP payload size, 0 for no OPT record
+	compress  bool   // name compression of queries and of the measured response sizes
+	transport string // "udp" or "tcp" with +notcp or +tcp, "" to keep --protocol
+}
+
+// queryFlags are set on every query; populated in main().
+var queryFlags = dnsFlags{recurse: true}
+
+// parseDNSFlags applies the dig-style options in s, e.g. "+dnssec +norecurse
+// +tcp", to base in order, so later options win like in dig. The supported
+// subset is +[no]recurse (or +[no]rd), +[no]cd (or +[no]cdflag), +[no]ad (or
+// +[no]adflag), +[no]dnssec, +[no]cookie, +[no]edns, +bufsize=N and +[no]tcp.
+// +dnssec, +cookie and +edns add an OPT record of defaultEDNSBufSize unless a
+// size is already set; +noedns drops it along with the DO bit and cookies.
+func parseDNSFlags(s string, base dnsFlags) (dnsFlags, error) {
+	f := base
+	for _, opt := range strings.Fields(s) {
+		name, ok := strings.CutPrefix(opt, "+")
+		if !ok {
+			return f, fmt.Errorf("invalid option %q, expected e.g. +dnssec or +norecurse", opt)
+		}
+		if name, value, ok := strings.Cut(name, "="); ok {
+			if name != "bufsize" {
+				return f, fmt.Errorf("unsupported option %q", opt)
+			}
+			size, err := strconv.Atoi(value)
+			if err != nil || size < dns.MinMsgSize || size > dns.MaxMsgSize {
+				return f, fmt.Errorf("+bufsize must be between %d and %d, got %q", dns.MinMsgSize, dns.MaxMsgSize, value)
+			}
+			f.bufSize = size
+			continue
+		}
+		on := true
+		if n, ok := strings.CutPrefix(name, "no"); ok {
+			name, on = n, false
+		}
+		switch name {
+		case "recurse", "rd":
+			f.recurse = on
+		case "cd", "cdflag":
+			f.cd = on
+		case "ad", "adflag":
+			f.ad = on
+		case "dnssec":
+			f.dnssec = on
+			if on && f.bufSize == 0 {
+				f.bufSize = defaultEDNSBufSize
+			}
+		case "cookie":
+			f.cookie = on
+			if on && f.bufSize == 0 {
+				f.bufSize = defaultEDNSBufSize
+			}
+		case "edns":
+			if !on {
+				f.bufSize, f.dnssec, f.cookie = 0, false, false
+			} else if f.bufSize == 0 {
+				f.bufSize = defaultEDNSBufSize
+			}
+		case "tcp":
+			f.transport = "udp"
+			if on {
+				f.transport = "tcp"
+			}
+		default:
+			return f, fmt.Errorf("unsupported option %q", opt)
+		}
+	}
+	return f, nil
+}
+
+// apply sets the header bits and the OPT record of f on m.
+func (f dnsFlags) apply(m *dns.Msg) {
+	m.RecursionDesired = f.recurse
+	m.CheckingDisabled = f.cd
+	m.AuthenticatedData = f.ad
+	m.Compress = f.compress
+	if f.bufSize > 0 {
+		m.SetEdns0(uint16(f.bufSize), f.dnssec)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseDNSFlags(t *testing.T) {
+	base := dnsFlags{recurse: true}
+	testCases := []struct {
+		flags     string
+		base      dnsFlags
+		expected  dnsFlags
+		expectErr bool
+	}{
+		{flags: "", base: base, expected: base},
+		{flags: "+dnssec +nord +tcp", base: base, expected: dnsFlags{dnssec: true, bufSize: defaultEDNSBufSize, transport: "tcp"}},
+		{flags: "+norecurse +cd +adflag", base: base, expected: dnsFlags{cd: true, ad: true}},
+		{flags: "+dnssec", base: dnsFlags{recurse: true, bufSize: 4096}, expected: dnsFlags{recurse: true, dnssec: true, bufSize: 4096}},
+		{flags: "+bufsize=512 +edns", base: base, expected: dnsFlags{recurse: true, bufSize: 512}},
+		{flags: "+dnssec +noedns", base: base, expected: base},
+		{flags: "+tcp +notcp", base: base, expected: dnsFlags{recurse: true, transport: "udp"}},
+		{flags: "+bufsize=100", base: base, expectErr: true},
+		{flags: "+cookie", base: base, expected: dnsFlags{recurse: true, cookie: true, bufSize: defaultEDNSBufSize}},
+		{flags: "+cookie +noedns", base: base, expected: base},
+		{flags: "+nsid", base: base, expectErr: true},
+		{flags: "dnssec", base: base, expectErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := parseDNSFlags(tc.flags, tc.base)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", tc.flags)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.flags, err)
+			continue
+		}
+		if got != tc.expected {
+			t.Errorf("%q: expected %+v, got %+v", tc.flags, tc.expected, got)
+		}
+	}
+}
+
+func TestDNSFlagsApply(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("bing.com.", dns.TypeA)
+	dnsFlags{cd: true, dnssec: true, bufSize: 1232}.apply(m)
+	if m.RecursionDesired || !m.CheckingDisabled || m.AuthenticatedData {
+		t.Errorf("expected only CD set, got RD %v CD %v AD %v", m.RecursionDesired, m.CheckingDisabled, m.AuthenticatedData)
+	}
+	opt := m.IsEdns0()
+	if opt == nil || opt.UDPSize() != 1232 || !opt.Do() {
+		t.Errorf("expected an OPT record of 1232 bytes with DO set, got %v", opt)
+	}
+
+	m = new(dns.Msg)
+	m.SetQuestion("bing.com.", dns.TypeA)
+	dnsFlags{recurse: true}.apply(m)
+	if !m.RecursionDesired || m.IsEdns0() != nil {
+		t.Errorf("expected RD without an OPT record, got RD %v OPT %v", m.RecursionDesired, m.IsEdns0())
+	}
+}
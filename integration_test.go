@@ -0,0 +1,643 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/paulgmiller/corednsprobe/pkg/criteria"
+	"github.com/paulgmiller/corednsprobe/pkg/dnstest"
+	"github.com/paulgmiller/corednsprobe/pkg/golden"
+	"github.com/paulgmiller/corednsprobe/pkg/metrics"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TestProbeAgainstFakeServer runs probe cycles through the real resolver against an
+// in-process DNS server and checks classification and the exported histogram.
+func TestProbeAgainstFakeServer(t *testing.T) {
+	server := dnstest.Start(t)
+	server.Handle("ok.example", dnstest.Response{Answers: []string{"192.0.2.1", "2001:db8::1"}})
+	server.Handle("servfail.example", dnstest.Response{Rcode: dns.RcodeServerFailure})
+	server.Handle("slow.example", dnstest.Response{Answers: []string{"192.0.2.1"}, Delay: 300 * time.Millisecond})
+
+	queryType, queryTimeout, protocols = "A", 100*time.Millisecond, []string{"udp", "tcp"}
+	successCriteria = criteria.Default(queryTimeout)
+	if err := metrics.Register(); err != nil {
+		t.Fatalf("registering metrics: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		endpoint string // distinct endpoint label per case
+		domain   string
+		status   metrics.QueryStatus
+		reason   string
+	}{
+		{name: "success", endpoint: "fake-ok", domain: "ok.example", status: metrics.QuerySuccess},
+		{name: "servfail", endpoint: "fake-servfail", domain: "servfail.example", status: metrics.QueryError, reason: "servfail: 4"},
+		{name: "nxdomain", endpoint: "fake-nxdomain", domain: "missing.example", status: metrics.QueryError, reason: "nxdomain: 4"},
+		{name: "timeout", endpoint: "fake-slow", domain: "slow.example", status: metrics.QueryTimeout, reason: "timeout: 4"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			queryDomain = tc.domain
+			stats := []*epStats{newEpStats(0)}
+			lookup := func(ctx context.Context, _, proto, name string) ([]string, time.Duration, error) {
+				return lookupThrough(ctx, server.Addr, proto, name)
+			}
+			for range 2 {
+				runCycle(context.Background(), []string{tc.endpoint}, stats, lookup)
+			}
+
+			// Two cycles, each with one UDP and one TCP query.
+			if got := stats[0].load().total; got != 4 {
+				t.Errorf("expected 4 queries, got %d", got)
+			}
+			if got := stats[0].failureReasons(); got != tc.reason {
+				t.Errorf("expected failure reasons %q, got %q", tc.reason, got)
+			}
+			for _, proto := range protocols {
+				if got := histogramCount(t, tc.endpoint, proto, tc.status); got != 2 {
+					t.Errorf("expected 2 %s %s observations for %s, got %d", proto, tc.status, tc.endpoint, got)
+				}
+			}
+		})
+	}
+}
+
+// TestLookupThroughSingleQuery checks that a lookup is one exchange by default,
+// without the retries and search-list expansion of the system resolver.
+func TestLookupThroughSingleQuery(t *testing.T) {
+	server := dnstest.Start(t)
+	server.Handle("slow.example", dnstest.Response{Answers: []string{"192.0.2.1"}, Delay: 300 * time.Millisecond})
+	queryType, queryTimeout = "A", 100*time.Millisecond
+
+	_, rtt, err := lookupThrough(context.Background(), server.Addr, "udp", "slow.example")
+	if err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if rtt < queryTimeout {
+		t.Errorf("expected the RTT of a timed out query to be at least %v, got %v", queryTimeout, rtt)
+	}
+	if got := server.Queries(); got != 1 {
+		t.Errorf("expected exactly 1 query, got %d", got)
+	}
+}
+
+func TestLookupThroughRetries(t *testing.T) {
+	server := dnstest.Start(t)
+	server.Handle("slow.example", dnstest.Response{Answers: []string{"192.0.2.1"}, Delay: 300 * time.Millisecond})
+	queryType, queryTimeout, queryRetries = "A", 150*time.Millisecond, 2
+	defer func() { queryRetries = 0 }()
+
+	_, rtt, err := lookupThrough(context.Background(), server.Addr, "udp", "slow.example")
+	if err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if rtt < queryTimeout || rtt > 2*queryTimeout {
+		t.Errorf("expected the retries to share the %v timeout, took %v", queryTimeout, rtt)
+	}
+	if got := server.Queries(); got != 3 {
+		t.Errorf("expected 3 attempts, got %d", got)
+	}
+}
+
+func TestLookupThroughRetryOnServFail(t *testing.T) {
+	server := dnstest.Start(t)
+	server.Handle("servfail.example", dnstest.Response{Rcode: dns.RcodeServerFailure})
+	queryType, queryTimeout, queryRetries = "A", time.Second, 2
+	retryNoResponse, retryServFail = false, true
+	defer func() { queryRetries, retryNoResponse, retryServFail = 0, true, false }()
+	if err := metrics.Register(); err != nil {
+		t.Fatalf("registering metrics: %v", err)
+	}
+
+	before := servfailCount(t, "127.0.0.1")
+	_, _, err := lookupThrough(context.Background(), server.Addr, "udp", "servfail.example")
+	var rcodeErr *criteria.RcodeError
+	if !errors.As(err, &rcodeErr) || rcodeErr.Rcode != "SERVFAIL" {
+		t.Fatalf("expected SERVFAIL after the retries, got %v", err)
+	}
+	if got := server.Queries(); got != 3 {
+		t.Errorf("expected 3 attempts, got %d", got)
+	}
+	if got := servfailCount(t, "127.0.0.1") - before; got != 3 {
+		t.Errorf("expected 3 SERVFAIL responses to be counted, got %v", got)
+	}
+
+	// NXDOMAIN is final, as for real resolvers.
+	if _, _, err := lookupThrough(context.Background(), server.Addr, "udp", "missing.example"); !errors.As(err, &rcodeErr) || rcodeErr.Rcode != "NXDOMAIN" {
+		t.Fatalf("expected NXDOMAIN, got %v", err)
+	}
+	if got := server.Queries(); got != 4 {
+		t.Errorf("expected NXDOMAIN not to be retried, got %d queries", got-3)
+	}
+}
+
+func TestLookupThroughSearchDomains(t *testing.T) {
+	server := dnstest.Start(t)
+	server.Handle("bing.com", dnstest.Response{Answers: []string{"192.0.2.1"}})
+	// NOERROR without A records moves on like NXDOMAIN.
+	server.Handle("bing.com.svc.cluster.local", dnstest.Response{Answers: []string{"2001:db8::1"}})
+	queryType, queryTimeout = "A", time.Second
+	searchList, ndots = []string{"default.svc.cluster.local", "svc.cluster.local", "cluster.local"}, 5
+	defer func() { searchList, ndots = nil, 0 }()
+	if err := metrics.Register(); err != nil {
+		t.Fatalf("registering metrics: %v", err)
+	}
+
+	before := searchQueriesSum(t, "127.0.0.1")
+	answers, _, err := lookupThrough(context.Background(), server.Addr, "udp", "bing.com")
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if !slices.Equal(answers, []string{"192.0.2.1"}) {
+		t.Errorf("expected answer 192.0.2.1, got %v", answers)
+	}
+	if got := server.Queries(); got != 4 {
+		t.Errorf("expected 3 search domains and the name itself to be queried, got %d queries", got)
+	}
+	if got := searchQueriesSum(t, "127.0.0.1") - before; got != 4 {
+		t.Errorf("expected a lookup of 4 queries to be recorded, got %v", got)
+	}
+}
+
+// searchQueriesSum returns the sample sum of coredns_probe_search_queries for an
+// endpoint.
+func searchQueriesSum(t *testing.T, endpoint string) float64 {
+	t.Helper()
+	families, err := metrics.Gatherer().Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "coredns_probe_search_queries" {
+			continue
+		}
+		for _, m := range family.Metric {
+			if labelValue(m, "endpoint") == endpoint {
+				return m.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	return 0
+}
+
+// TestLookupThroughDialDuration checks that each exchange records its dial apart
+// from the RTT.
+func TestLookupThroughDialDuration(t *testing.T) {
+	server := dnstest.Start(t)
+	server.Handle("ok.example", dnstest.Response{Answers: []string{"192.0.2.1"}})
+	queryType, queryTimeout = "A", time.Second
+	if err := metrics.Register(); err != nil {
+		t.Fatalf("registering metrics: %v", err)
+	}
+
+	for _, proto := range []string{"udp", "tcp"} {
+		before := dialCount(t, "127.0.0.1", proto)
+		if _, _, err := lookupThrough(context.Background(), server.Addr, proto, "ok.example"); err != nil {
+			t.Fatalf("%s lookup: %v", proto, err)
+		}
+		if got := dialCount(t, "127.0.0.1", proto) - before; got != 1 {
+			t.Errorf("expected 1 %s dial to be recorded, got %d", proto, got)
+		}
+	}
+}
+
+// TestLookupThroughReuseConnections checks that with --reuse-connections a TCP
+// query goes over the connection of the previous one, and that a connection
+// closed in the meantime is replaced within the query.
+func TestLookupThroughReuseConnections(t *testing.T) {
+	server := dnstest.Start(t)
+	server.Handle("ok.example", dnstest.Response{Answers: []string{"192.0.2.1"}})
+	queryType, queryTimeout, reuseConns = "A", time.Second, true
+	defer func() {
+		reuseConns = false
+		connPool.forget("127.0.0.1")
+	}()
+	if err := metrics.Register(); err != nil {
+		t.Fatalf("registering metrics: %v", err)
+	}
+
+	newBefore := connectionCount(t, "coredns_probe_connections_total", "127.0.0.1", "tcp")
+	reusedBefore := connectionCount(t, "coredns_probe_connection_reuses_total", "127.0.0.1", "tcp")
+	dialsBefore := dialCount(t, "127.0.0.1", "tcp")
+	for range 2 {
+		if _, _, err := lookupThrough(context.Background(), server.Addr, "tcp", "ok.example"); err != nil {
+			t.Fatalf("lookup: %v", err)
+		}
+	}
+	if got := connectionCount(t, "coredns_probe_connections_total", "127.0.0.1", "tcp") - newBefore; got != 1 {
+		t.Errorf("expected 1 new connection, got %v", got)
+	}
+	if got := connectionCount(t, "coredns_probe_connection_reuses_total", "127.0.0.1", "tcp") - reusedBefore; got != 1 {
+		t.Errorf("expected 1 reused connection, got %v", got)
+	}
+	if got := dialCount(t, "127.0.0.1", "tcp") - dialsBefore; got != 1 {
+		t.Errorf("expected only the new connection to record a dial, got %d", got)
+	}
+
+	key := connKey{"tcp", server.Addr}
+	conn := connPool.get(key)
+	if conn == nil {
+		t.Fatal("expected the connection to be kept")
+	}
+	conn.Close()
+	connPool.put(key, conn)
+	if _, _, err := lookupThrough(context.Background(), server.Addr, "tcp", "ok.example"); err != nil {
+		t.Fatalf("expected a closed connection to be replaced, got %v", err)
+	}
+	if got := connectionCount(t, "coredns_probe_connections_total", "127.0.0.1", "tcp") - newBefore; got != 2 {
+		t.Errorf("expected the closed connection to be replaced by a new one, got %v new connections", got)
+	}
+}
+
+// TestLookupThroughResponseSize checks that the size of each response is
+// recorded, and recorded smaller with --compress.
+func TestLookupThroughResponseSize(t *testing.T) {
+	server := dnstest.Start(t)
+	answers := make([]string, 20)
+	for i := range answers {
+		answers[i] = fmt.Sprintf("192.0.2.%d", i+1)
+	}
+	server.Handle("large.example", dnstest.Response{Answers: answers})
+	queryType, queryTimeout = "A", time.Second
+	defer func() { queryFlags.compress = false }()
+	if err := metrics.Register(); err != nil {
+		t.Fatalf("registering metrics: %v", err)
+	}
+
+	var sizes []float64
+	for _, compress := range []bool{false, true} {
+		queryFlags.compress = compress
+		count, sum := responseSizes(t, "127.0.0.1", "tcp")
+		if _, _, err := lookupThrough(context.Background(), server.Addr, "tcp", "large.example"); err != nil {
+			t.Fatalf("lookup: %v", err)
+		}
+		gotCount, gotSum := responseSizes(t, "127.0.0.1", "tcp")
+		if gotCount-count != 1 {
+			t.Fatalf("expected 1 response size to be recorded, got %d", gotCount-count)
+		}
+		sizes = append(sizes, gotSum-sum)
+	}
+	// 20 A records of 16 bytes compressed, or 29 with the name in full.
+	if sizes[0] <= 512 || sizes[1] >= 512 {
+		t.Errorf("expected the response to exceed 512 bytes only uncompressed, got %v uncompressed and %v compressed", sizes[0], sizes[1])
+	}
+}
+
+// TestExchangePhases checks that with --phase-latency the phases of an exchange
+// add up to its RTT and, with the dial, to the time the exchange took.
+func TestExchangePhases(t *testing.T) {
+	server := dnstest.Start(t)
+	server.Handle("slow.example", dnstest.Response{Answers: []string{"192.0.2.1"}, Delay: 50 * time.Millisecond})
+	phaseLatency = true
+	defer func() { phaseLatency = false }()
+
+	for _, proto := range []string{"udp", "tcp"} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		start := time.Now()
+		r, rtt, p, err := exchangeOnce(ctx, newQuery("slow.example.", dns.TypeA), server.Addr, proto)
+		elapsed := time.Since(start)
+		cancel()
+		if err != nil || r.Rcode != dns.RcodeSuccess {
+			t.Fatalf("%s exchange: %v, %v", proto, r, err)
+		}
+		if rtt != p.write+p.read {
+			t.Errorf("%s: expected the RTT %v to be write %v + read %v", proto, rtt, p.write, p.read)
+		}
+		if p.read < 50*time.Millisecond || p.write >= p.read {
+			t.Errorf("%s: expected the read %v to take the 50ms delay, not the write %v", proto, p.read, p.write)
+		}
+		if total := p.dial + p.write + p.read; total > elapsed || elapsed-total > 10*time.Millisecond {
+			t.Errorf("%s: expected dial, write and read (%v) to add up to about %v", proto, total, elapsed)
+		}
+	}
+}
+
+// TestLookupThroughDoH queries the fake server through a DNS-over-HTTPS frontend
+// that forwards the wire format over TCP, like CoreDNS's https server block.
+func TestLookupThroughDoH(t *testing.T) {
+	server := dnstest.Start(t)
+	server.Handle("ok.example", dnstest.Response{Answers: []string{"192.0.2.1"}})
+	server.Handle("servfail.example", dnstest.Response{Rcode: dns.RcodeServerFailure})
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != dohMediaType {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := dns.Exchange(req, server.Addr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		wire, _ := resp.Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(wire)
+	}))
+	defer doh.Close()
+	queryType, queryTimeout = "A", time.Second
+	dohClient, dohPath = newDoHClient("", true, false), "/dns-query"
+	defer func() { dohClient, dohPath = nil, "" }()
+	if err := metrics.Register(); err != nil {
+		t.Fatalf("registering metrics: %v", err)
+	}
+	host := doh.Listener.Addr().String()
+
+	before := dialCount(t, "127.0.0.1", "doh")
+	answers, _, err := lookupThrough(context.Background(), host, "doh", "ok.example")
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if !slices.Equal(answers, []string{"192.0.2.1"}) {
+		t.Errorf("expected answer 192.0.2.1, got %v", answers)
+	}
+	if got := dialCount(t, "127.0.0.1", "doh") - before; got != 1 {
+		t.Errorf("expected 1 doh dial to be recorded, got %d", got)
+	}
+
+	var rcodeErr *criteria.RcodeError
+	if _, _, err := lookupThrough(context.Background(), host, "doh", "servfail.example"); !errors.As(err, &rcodeErr) || rcodeErr.Rcode != "SERVFAIL" {
+		t.Errorf("expected SERVFAIL, got %v", err)
+	}
+
+	dohPath = "/wrong"
+	if _, _, err := lookupThrough(context.Background(), host, "doh", "ok.example"); err == nil {
+		t.Error("expected an error for a path without a DNS-over-HTTPS handler")
+	}
+}
+
+func TestLookupTruncated(t *testing.T) {
+	var large []string
+	for i := range 40 {
+		large = append(large, fmt.Sprintf("192.0.2.%d", i+1))
+	}
+	server := dnstest.Start(t)
+	server.Handle("large.example", dnstest.Response{Answers: large})
+	server.Handle("blocked.example", dnstest.Response{Answers: large, NoTCP: true})
+	server.Handle("small.example", dnstest.Response{Answers: []string{"192.0.2.1"}})
+	queryTimeout, truncationType = 100*time.Millisecond, "A"
+	truncationCriteria = criteria.Criteria{Rcodes: []string{criteria.RcodeNoError}}
+
+	testCases := []struct {
+		name     string
+		endpoint string // distinct endpoint label per case
+		domain   string
+		status   metrics.QueryStatus
+		reason   criteria.Reason
+		answers  int
+	}{
+		{name: "fallback", endpoint: "trunc-ok", domain: "large.example", status: metrics.QuerySuccess, answers: 40},
+		{name: "tcp_blocked", endpoint: "trunc-blocked", domain: "blocked.example", status: metrics.QueryTimeout, reason: criteria.ReasonTimeout},
+		{name: "not_truncated", endpoint: "trunc-small", domain: "small.example", status: metrics.QueryError, reason: criteria.ReasonNotTruncated},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var answers []string
+			lookup := func(ctx context.Context, _, proto, name string) ([]string, time.Duration, error) {
+				if proto != protoTruncation {
+					t.Fatalf("expected the truncation test, got proto %s", proto)
+				}
+				a, rtt, err := lookupTruncated(ctx, server.Addr, server.Addr, name)
+				answers = a
+				return a, rtt, err
+			}
+			status, reason, _, _ := query(context.Background(), tc.endpoint, protoTruncation, tc.domain, truncationCriteria, lookup)
+			if status != tc.status || reason != tc.reason {
+				t.Errorf("expected %s %q, got %s %q", tc.status, tc.reason, status, reason)
+			}
+			if len(answers) != tc.answers {
+				t.Errorf("expected %d answers, got %d", tc.answers, len(answers))
+			}
+		})
+	}
+}
+
+// TestLookupThroughEDNSBufSize checks that --edns-bufsize lets answers over 512
+// bytes through UDP untruncated.
+func TestLookupThroughEDNSBufSize(t *testing.T) {
+	var large []string
+	for i := range 40 {
+		large = append(large, fmt.Sprintf("192.0.2.%d", i+1))
+	}
+	server := dnstest.Start(t)
+	server.Handle("large.example", dnstest.Response{Answers: large})
+	queryType, queryTimeout = "A", time.Second
+	defer func() { queryFlags.bufSize = 0 }()
+
+	for _, tc := range []struct {
+		bufSize   int
+		truncated bool
+	}{
+		{bufSize: 0, truncated: true},
+		{bufSize: 1232, truncated: false},
+	} {
+		queryFlags.bufSize = tc.bufSize
+		answers, _, err := lookupThrough(context.Background(), server.Addr, "udp", "large.example")
+		if err != nil {
+			t.Fatalf("buffer size %d: %v", tc.bufSize, err)
+		}
+		if truncated := len(answers) < len(large); truncated != tc.truncated {
+			t.Errorf("buffer size %d: expected truncated %v, got %d of %d answers", tc.bufSize, tc.truncated, len(answers), len(large))
+		}
+	}
+}
+
+// TestLookupThroughDNSCookies checks that with --dns-cookies the client cookie is
+// sent, the server cookie echoed on the next query, and responses with a wrong
+// or malformed cookie are recorded as a cookie mismatch.
+func TestLookupThroughDNSCookies(t *testing.T) {
+	server := dnstest.Start(t)
+	server.Handle("ok.example", dnstest.Response{Answers: []string{"192.0.2.1"}, ServerCookie: "0102030405060708"})
+	server.Handle("plain.example", dnstest.Response{Answers: []string{"192.0.2.1"}})
+	server.Handle("spoofed.example", dnstest.Response{Answers: []string{"192.0.2.1"}, ServerCookie: "0102030405060708", ClientCookie: "0000000000000000"})
+	server.Handle("short.example", dnstest.Response{Answers: []string{"192.0.2.1"}, ServerCookie: "0102"})
+	queryType, queryTimeout = "A", time.Second
+	queryFlags = dnsFlags{recurse: true, cookie: true, bufSize: defaultEDNSBufSize}
+	defer func() { queryFlags = dnsFlags{recurse: true} }()
+
+	for i, expected := range []string{clientCookie, clientCookie + "0102030405060708"} {
+		if _, _, err := lookupThrough(context.Background(), server.Addr, "udp", "ok.example"); err != nil {
+			t.Fatalf("lookup %d: %v", i, err)
+		}
+		if got := server.LastCookie(); got != expected {
+			t.Errorf("lookup %d: expected cookie %q, got %q", i, expected, got)
+		}
+	}
+	if _, _, err := lookupThrough(context.Background(), server.Addr, "udp", "plain.example"); err != nil {
+		t.Errorf("expected a response without a cookie to be accepted, got %v", err)
+	}
+	for _, name := range []string{"spoofed.example", "short.example"} {
+		_, _, err := lookupThrough(context.Background(), server.Addr, "tcp", name)
+		if status, _ := criteria.Default(queryTimeout).Classify(criteria.Result{Err: err}); status != metrics.QueryCookieMismatch {
+			t.Errorf("%s: expected %s, got %s (%v)", name, metrics.QueryCookieMismatch, status, err)
+		}
+	}
+}
+
+// dialCount returns the sample count of coredns_probe_dial_duration_seconds for an
+// endpoint and proto.
+func dialCount(t *testing.T, endpoint, proto string) uint64 {
+	t.Helper()
+	families, err := metrics.Gatherer().Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "coredns_probe_dial_duration_seconds" {
+			continue
+		}
+		for _, m := range family.Metric {
+			if labelValue(m, "endpoint") == endpoint && labelValue(m, "proto") == proto {
+				return m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+// connectionCount returns the counter name, coredns_probe_connections_total or
+// coredns_probe_connection_reuses_total, for an endpoint and proto.
+func connectionCount(t *testing.T, name, endpoint, proto string) float64 {
+	t.Helper()
+	families, err := metrics.Gatherer().Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.Metric {
+			if labelValue(m, "endpoint") == endpoint && labelValue(m, "proto") == proto {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+// responseSizes returns the sample count and sum of
+// coredns_probe_response_size_bytes for an endpoint and proto.
+func responseSizes(t *testing.T, endpoint, proto string) (uint64, float64) {
+	t.Helper()
+	families, err := metrics.Gatherer().Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "coredns_probe_response_size_bytes" {
+			continue
+		}
+		for _, m := range family.Metric {
+			if labelValue(m, "endpoint") == endpoint && labelValue(m, "proto") == proto {
+				return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	return 0, 0
+}
+
+// servfailCount returns coredns_probe_servfail_total for an endpoint.
+func servfailCount(t *testing.T, endpoint string) float64 {
+	t.Helper()
+	families, err := metrics.Gatherer().Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "coredns_probe_servfail_total" {
+			continue
+		}
+		for _, m := range family.Metric {
+			if labelValue(m, "endpoint") == endpoint {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+// histogramCount returns the sample count of coredns_probe_rtt_milliseconds for A queries to an
+// endpoint over proto with the given status.
+func histogramCount(t *testing.T, endpoint, proto string, status metrics.QueryStatus) uint64 {
+	t.Helper()
+	families, err := metrics.Gatherer().Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "coredns_probe_rtt_milliseconds" {
+			continue
+		}
+		for _, m := range family.Metric {
+			if labelValue(m, "endpoint") == endpoint && labelValue(m, "test") == metrics.TestPositive && labelValue(m, "type") == "A" &&
+				labelValue(m, "proto") == proto && labelValue(m, "status") == string(status) {
+				return m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.Label {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// TestRunOnceGoldenShardNames checks that the golden snapshot covers every shard
+// name, not just the first one.
+func TestRunOnceGoldenShardNames(t *testing.T) {
+	server := dnstest.Start(t)
+	server.Handle("a.example", dnstest.Response{Answers: []string{"192.0.2.1", "192.0.2.2"}})
+	server.Handle("b.example", dnstest.Response{Answers: []string{"192.0.2.3"}})
+
+	queryType, queryTimeout, protocols = "A", time.Second, []string{"udp"}
+	successCriteria = criteria.Default(queryTimeout)
+	shardNames, goldenFile = []string{"a.example", "b.example"}, filepath.Join(t.TempDir(), "golden.json")
+	defer func() { shardNames, goldenFile = nil, "" }()
+	eps, err := staticEndpoints([]string{server.Addr})
+	if err != nil {
+		t.Fatalf("staticEndpoints: %v", err)
+	}
+	discovered := map[string]endpoint{"fake-golden": eps[0]}
+
+	if err := runOnce(context.Background(), []string{"fake-golden"}, discovered); err != nil {
+		t.Fatalf("recording the golden file: %v", err)
+	}
+	want, err := golden.Read(goldenFile)
+	if err != nil {
+		t.Fatalf("reading the golden file: %v", err)
+	}
+	if len(want.Answers) != 2 || !slices.Equal(want.Answers["b.example"], []string{"192.0.2.3"}) {
+		t.Fatalf("expected answers for both shard names, got %v", want.Answers)
+	}
+
+	if err := runOnce(context.Background(), []string{"fake-golden"}, discovered); err != nil {
+		t.Errorf("expected unchanged answers to match, got %v", err)
+	}
+	server.Handle("b.example", dnstest.Response{Answers: []string{"192.0.2.9"}})
+	if err := runOnce(context.Background(), []string{"fake-golden"}, discovered); err == nil || !strings.Contains(err.Error(), "b.example") {
+		t.Errorf("expected a diff for the second shard name, got %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Timing of the leader election, the client-go defaults: a standby takes over
+// at most leaseDuration after the leader stopped renewing.
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// electLeader campaigns for the Lease name in namespace as identity and blocks
+// until this replica leads or ctx is done. The returned context is done once the
+// replica stops leading, so that it stops probing before another one starts. The
+// Lease is released when ctx is done, letting a standby take over right away on
+// graceful shutdown.
+func electLeader(ctx context.Context, client kubernetes.Interface, name, identity string) (context.Context, error) {
+	leading := make(chan context.Context, 1)
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) { leading <- leaderCtx },
+			OnStoppedLeading: func() {
+				if ctx.Err() == nil {
+					log.Printf("lost the leadership of Lease %s/%s", namespace, name)
+				}
+			},
+			OnNewLeader: func(id string) {
+				if id != identity {
+					log.Printf("%s leads Lease %s/%s, waiting as standby", id, namespace, name)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	go elector.Run(ctx)
+	select {
+	case leaderCtx := <-leading:
+		return leaderCtx, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
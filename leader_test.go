@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestElectLeader(t *testing.T) {
+	namespace = "kube-system"
+	client := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	leaderCtx, err := electLeader(ctx, client, "coredns-probe-leader", "probe-a")
+	if err != nil {
+		t.Fatalf("electing the first replica: %v", err)
+	}
+	lease, err := client.CoordinationV1().Leases(namespace).Get(ctx, "coredns-probe-leader", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting the Lease: %v", err)
+	}
+	if got := *lease.Spec.HolderIdentity; got != "probe-a" {
+		t.Errorf("expected probe-a to hold the Lease, got %s", got)
+	}
+
+	// A second replica stays a standby while the first one leads.
+	standbyCtx, cancelStandby := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelStandby()
+	if _, err := electLeader(standbyCtx, client, "coredns-probe-leader", "probe-b"); err == nil {
+		t.Error("expected probe-b to wait while probe-a leads")
+	}
+
+	// Shutting down ends the leadership.
+	cancel()
+	select {
+	case <-leaderCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("expected the leader context to be done after shutdown")
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/paulgmiller/corednsprobe/pkg/criteria"
+	"github.com/paulgmiller/corednsprobe/pkg/metrics"
+)
+
+// queryTypes are the record types accepted by --query-type.
+var queryTypes = []string{"A", "AAAA", "TXT", "MX", "SRV", "NS", "CNAME", "PTR"}
+
+// dnsClients are shared by all queries, one per protocol. A dns.Client holds no
+// per-server state, exchangeOnce dials the connections, and the timeout comes
+// from the query context, so nothing has to be built per lookup.
+var dnsClients = map[string]*dns.Client{
+	"udp": {Net: "udp"},
+	"tcp": {Net: "tcp"},
+}
+
+// newDoTClient returns the client for DNS-over-TLS, which verifies the server
+// certificate against serverName, or the dialed IP when it is empty, unless
+// insecure is set.
+func newDoTClient(serverName string, insecure bool) *dns.Client {
+	return &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecure,
+	}}
+}
+
+// dohMediaType is the content type of DNS messages in DNS-over-HTTPS, RFC 8484.
+const dohMediaType = "application/dns-message"
+
+// dohClient sends the queries with --protocol doh. Like the DNS clients, it opens
+// a new connection per query unless reuse is on, so that every query exercises
+// the TLS handshake and does not ride on a connection to a pod that has since
+// gone away.
+var dohClient *http.Client
+
+// newDoHClient returns the client for DNS-over-HTTPS, verifying the server
+// certificate like newDoTClient. With reuse, idle connections are kept for the
+// next query like connPool does for the other protocols.
+func newDoHClient(serverName string, insecure, reuse bool) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: insecure,
+		},
+		DisableKeepAlives:   !reuse,
+		MaxIdleConnsPerHost: maxIdleConns,
+	}}
+}
+
+// reuseConns keeps the connections of tcp, dot and doh open after a query for
+// the next one to the same endpoint with --reuse-connections, as long-lived
+// clients do; populated in main(). UDP has no connection to reuse.
+var reuseConns bool
+
+// maxIdleConns is how many idle connections are kept per endpoint and protocol
+// with reuseConns. More are only opened while queries to an endpoint overlap.
+const maxIdleConns = 2
+
+// connKey identifies the idle connections of connPool.
+type connKey struct {
+	proto, hostPort string
+}
+
+// connPool holds the idle tcp and dot connections with reuseConns.
+var connPool = &idleConns{idle: map[connKey][]*dns.Conn{}}
+
+// idleConns are connections kept open between queries, by protocol and endpoint.
+type idleConns struct {
+	mu   sync.Mutex
+	idle map[connKey][]*dns.Conn
+}
+
+// get takes an idle connection for key, or returns nil if there is none.
+func (c *idleConns) get(key connKey) *dns.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conns := c.idle[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	conn := conns[len(conns)-1]
+	c.idle[key] = conns[:len(conns)-1]
+	return conn
+}
+
+// put keeps conn for the next query to key, or closes it if maxIdleConns are
+// already kept.
+func (c *idleConns) put(key connKey, conn *dns.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle[key]) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	c.idle[key] = append(c.idle[key], conn)
+}
+
+// forget closes the idle connections to host, e.g. once it is no longer probed.
+func (c *idleConns) forget(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, conns := range c.idle {
+		if h, _, _ := net.SplitHostPort(key.hostPort); h != host {
+			continue
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+		delete(c.idle, key)
+	}
+}
+
+// Which attempts are retried with --query-retries, see --retry-on; populated in
+// main().
+var (
+	retryNoResponse = true
+	retryServFail   bool
+)
+
+// lookupThrough sends a queryType query for name to the DNS server at hostPort
+// over proto, "udp", "tcp", "dot" or "doh". With searchList set, name is resolved
+// like a stub resolver would, see searchNames, trying each name in turn within
+// queryTimeout while the answer is NXDOMAIN or empty, and the number of queries
+// is recorded. With queryRetries set, an attempt that gets no response, e.g. a
+// dropped UDP packet, or with retryServFail a SERVFAIL, is retried up to that
+// many times, each attempt getting an equal share of queryTimeout; see
+// retryable. The RTT is that of the exchange, without dialing, or the total time
+// across all attempts and names once there were several; for errors it is the
+// time until the query gave up. The time to dial, including the TCP and TLS
+// handshakes, is recorded separately. A response code other than NOERROR is
+// returned as a criteria.RcodeError.
+func lookupThrough(ctx context.Context, hostPort, proto, name string) ([]string, time.Duration, error) {
+	qtype, qnames := dns.StringToType[queryType], searchNames(name)
+	if qtype == dns.TypePTR {
+		qname, err := dns.ReverseAddr(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		qnames = []string{qname}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	host, _, _ := net.SplitHostPort(hostPort)
+	start := time.Now()
+	var (
+		r     *dns.Msg
+		rtt   time.Duration
+		err   error
+		tried int
+	)
+	for _, qname := range qnames {
+		tried++
+		r, rtt, err = exchangeRetrying(ctx, newQuery(qname, qtype), host, hostPort, proto)
+		if err != nil || !searchOn(r, qtype) {
+			break
+		}
+	}
+	if tried > 1 {
+		rtt = time.Since(start)
+	}
+	if len(qnames) > 1 && !warmingUp() {
+		metrics.RecordSearchQueries(host, tried)
+	}
+	if err != nil {
+		return nil, time.Since(start), markMalformed(err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, rtt, &criteria.RcodeError{Rcode: dns.RcodeToString[r.Rcode]}
+	}
+	return answerStrings(r, qtype), rtt, nil
+}
+
+// exchangeRetrying is exchange with the retries of --query-retries, each attempt
+// getting an equal share of queryTimeout. The RTT of a retried query is the
+// total time across its attempts.
+func exchangeRetrying(ctx context.Context, m *dns.Msg, host, hostPort, proto string) (*dns.Msg, time.Duration, error) {
+	attemptTimeout := queryTimeout / time.Duration(queryRetries+1)
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancelAttempt := context.WithTimeout(ctx, attemptTimeout)
+		r, rtt, err := exchange(attemptCtx, m, host, hostPort, proto)
+		cancelAttempt()
+		if attempt > 0 {
+			rtt = time.Since(start)
+		}
+		if !retryable(r, err) || attempt == queryRetries || ctx.Err() != nil {
+			return r, rtt, err
+		}
+		if !warmingUp() {
+			metrics.RecordRetry(host)
+		}
+	}
+}
+
+// resolvConf is where --use-search-domains reads the search list from.
+const resolvConf = "/etc/resolv.conf"
+
+// The search list and ndots of resolv.conf with --use-search-domains; populated
+// in main().
+var (
+	searchList []string
+	ndots      int
+)
+
+// loadSearchDomains reads the search list and ndots option of the resolv.conf
+// at path, e.g. /etc/resolv.conf of the probe's pod.
+func loadSearchDomains(path string) ([]string, int, error) {
+	conf, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return conf.Search, conf.Ndots, nil
+}
+
+// searchNames returns the names a stub resolver tries for name with searchList
+// and ndots: name is tried as is first if it has at least ndots dots, and last
+// otherwise, after name with each search domain appended. In a pod with the
+// default ndots of 5, bing.com thus comes after e.g. bing.com.svc.cluster.local.
+// A fully qualified name, ending in a dot, is only tried as is, as is any name
+// without a search list.
+func searchNames(name string) []string {
+	if len(searchList) == 0 || dns.IsFqdn(name) {
+		return []string{dns.Fqdn(name)}
+	}
+	names := make([]string, 0, len(searchList)+1)
+	for _, domain := range searchList {
+		names = append(names, dns.Fqdn(name+"."+strings.TrimSuffix(domain, ".")))
+	}
+	if strings.Count(name, ".") >= ndots {
+		return append([]string{dns.Fqdn(name)}, names...)
+	}
+	return append(names, dns.Fqdn(name))
+}
+
+// searchOn reports whether a stub resolver moves on to the next name of its
+// search list after the response r: for NXDOMAIN and for NOERROR without answers
+// of type qtype, but not for other response codes such as SERVFAIL.
+func searchOn(r *dns.Msg, qtype uint16) bool {
+	return r.Rcode == dns.RcodeNameError || r.Rcode == dns.RcodeSuccess && len(answerStrings(r, qtype)) == 0
+}
+
+// retryable reports whether an attempt that got r or err is retried under
+// --retry-on. Like real resolvers, NXDOMAIN and other answers are final, and so
+// is a DNS cookie mismatch, which is reported rather than waited out.
+func retryable(r *dns.Msg, err error) bool {
+	if err != nil {
+		return retryNoResponse && !errors.Is(err, criteria.ErrCookieMismatch)
+	}
+	return retryServFail && r.Rcode == dns.RcodeServerFailure
+}
+
+// protoTruncation is the proto of the truncation test, see lookupTruncated.
+const protoTruncation = "udp-tcp"
+
+// lookupTruncated checks the UDP to TCP fallback of the DNS server at hostPort: it
+// sends a truncationType query for name over UDP, so that an answer over 512
+// bytes, or --edns-bufsize, comes back truncated, and retries it over TCP to
+// tcpHostPort as a stub resolver would. Each exchange gets queryTimeout. An answer that fit into
+// UDP is returned as criteria.ErrNotTruncated, since the fallback was not
+// exercised; otherwise the result is that of the TCP retry, which is also counted
+// with metrics.RecordTruncation. The RTT is that of both exchanges.
+func lookupTruncated(ctx context.Context, hostPort, tcpHostPort, name string) ([]string, time.Duration, error) {
+	qtype := dns.StringToType[truncationType]
+	m := newQuery(dns.Fqdn(name), qtype)
+	host, _, _ := net.SplitHostPort(hostPort)
+	start := time.Now()
+
+	udpCtx, cancel := context.WithTimeout(ctx, queryTimeout)
+	r, udpRTT, err := exchange(udpCtx, m, host, hostPort, "udp")
+	cancel()
+	switch {
+	case err != nil:
+		return nil, time.Since(start), markMalformed(err)
+	case r.Rcode != dns.RcodeSuccess:
+		return nil, udpRTT, &criteria.RcodeError{Rcode: dns.RcodeToString[r.Rcode]}
+	case !r.Truncated:
+		return nil, udpRTT, criteria.ErrNotTruncated
+	}
+
+	tcpCtx, cancel := context.WithTimeout(ctx, queryTimeout)
+	r, tcpRTT, err := exchange(tcpCtx, m, host, tcpHostPort, "tcp")
+	cancel()
+	if !warmingUp() {
+		metrics.RecordTruncation(host, err == nil)
+	}
+	if err != nil {
+		return nil, time.Since(start), fmt.Errorf("retrying truncated answer over TCP: %w", markMalformed(err))
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, udpRTT + tcpRTT, &criteria.RcodeError{Rcode: dns.RcodeToString[r.Rcode]}
+	}
+	return answerStrings(r, qtype), udpRTT + tcpRTT, nil
+}
+
+// markMalformed wraps the errors of responses that could not be parsed with
+// criteria.ErrMalformed.
+func markMalformed(err error) error {
+	var dnsErr *dns.Error
+	if errors.As(err, &dnsErr) {
+		return fmt.Errorf("%w: %w", criteria.ErrMalformed, err)
+	}
+	return err
+}
+
+// newQuery returns a query for qname of type qtype with the header bits of
+// queryFlags, advertising its buffer size in an EDNS0 OPT record when set, and
+// without one otherwise, which limits UDP answers to 512 bytes.
+func newQuery(qname string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(qname, qtype)
+	queryFlags.apply(m)
+	return m
+}
+
+// phaseLatency records the write and read phases of each exchange with
+// --phase-latency; populated in main().
+var phaseLatency bool
+
+// phases are the parts of an exchange: dialing, sending the query and waiting
+// for the response. write and read are only measured with phaseLatency. reused
+// is set when the exchange went over an idle connection instead of a dial.
+type phases struct {
+	dial, write, read time.Duration
+	reused            bool
+}
+
+// exchange is dns.Client.ExchangeContext with the dial timed apart from the
+// exchange, recorded for host, and with phaseLatency the write and read phases.
+// The size of each response, see responseSize, and SERVFAIL responses are
+// recorded for host as well, and with reuseConns whether
+// the exchange needed a new connection. None of these are recorded during
+// --warmup. With --dns-cookies, m carries the DNS cookies for hostPort and
+// the response must pass checkCookie.
+func exchange(ctx context.Context, m *dns.Msg, host, hostPort, proto string) (*dns.Msg, time.Duration, error) {
+	if queryFlags.cookie {
+		setCookie(m, hostPort)
+	}
+	r, rtt, p, err := exchangeOnce(ctx, m, hostPort, proto)
+	if queryFlags.cookie && err == nil {
+		err = checkCookie(r, hostPort)
+	}
+	if warmingUp() {
+		return r, rtt, err
+	}
+	if p.dial > 0 {
+		metrics.RecordDial(host, proto, p.dial)
+	}
+	if phaseLatency && (p.write > 0 || p.read > 0) {
+		metrics.RecordPhases(host, proto, p.write, p.read)
+	}
+	if reuseConns && proto != "udp" && (p.reused || p.dial > 0) {
+		metrics.RecordConnection(host, proto, p.reused)
+	}
+	if err == nil {
+		metrics.RecordResponseSize(host, proto, responseSize(r))
+	}
+	if err == nil && r.Rcode == dns.RcodeServerFailure {
+		metrics.RecordServFail(host)
+	}
+	return r, rtt, err
+}
+
+// responseSize is the length of r in wire format. With --compress it is
+// compressed, which is about what CoreDNS sent, as it compresses every response;
+// without, the difference to a UDP limit shows how much an answer relies on
+// compression to fit.
+func responseSize(r *dns.Msg) int {
+	r.Compress = queryFlags.compress
+	return r.Len()
+}
+
+// exchangeOnce sends m to hostPort over proto on a new connection, or with
+// reuseConns on an idle one from connPool, and also returns its phases, without
+// the dial if dialing failed. A connection is only kept after an exchange that
+// worked. An idle connection the server has closed in the meantime is replaced
+// by a new one within the same exchange, as clients with long-lived connections
+// do, unless the query timed out on it.
+func exchangeOnce(ctx context.Context, m *dns.Msg, hostPort, proto string) (*dns.Msg, time.Duration, phases, error) {
+	if proto == "doh" {
+		return exchangeDoH(ctx, m, hostPort)
+	}
+	key, pooled := connKey{proto, hostPort}, reuseConns && proto != "udp"
+	if pooled {
+		if conn := connPool.get(key); conn != nil {
+			p := phases{reused: true}
+			r, rtt, err := exchangeConn(ctx, m, conn, proto, &p)
+			if err == nil {
+				connPool.put(key, conn)
+				return r, rtt, p, nil
+			}
+			conn.Close()
+			if netErr, ok := err.(net.Error); ctx.Err() != nil || ok && netErr.Timeout() {
+				return r, rtt, p, err
+			}
+		}
+	}
+	dialStart := time.Now()
+	conn, err := dnsClients[proto].DialContext(ctx, hostPort)
+	if err != nil {
+		return nil, 0, phases{}, err
+	}
+	p := phases{dial: time.Since(dialStart)}
+	r, rtt, err := exchangeConn(ctx, m, conn, proto, &p)
+	if pooled && err == nil {
+		connPool.put(key, conn)
+	} else {
+		conn.Close()
+	}
+	return r, rtt, p, err
+}
+
+// exchangeConn sends m over conn with the client for proto, or with phaseLatency
+// through exchangePhases.
+func exchangeConn(ctx context.Context, m *dns.Msg, conn *dns.Conn, proto string, p *phases) (*dns.Msg, time.Duration, error) {
+	if !phaseLatency {
+		return dnsClients[proto].ExchangeWithConnContext(ctx, m, conn)
+	}
+	r, err := exchangePhases(ctx, m, conn, p)
+	return r, p.write + p.read, err
+}
+
+// exchangePhases is dns.Client.ExchangeWithConnContext timing the write of m and
+// the read of the response into p. Like the client, it skips UDP responses with
+// another ID, which may answer an earlier query that timed out.
+func exchangePhases(ctx context.Context, m *dns.Msg, conn *dns.Conn, p *phases) (*dns.Msg, error) {
+	if opt := m.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		conn.UDPSize = opt.UDPSize()
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	start := time.Now()
+	err := conn.WriteMsg(m)
+	p.write = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	_, packet := conn.Conn.(net.PacketConn)
+	for {
+		r, err := conn.ReadMsg()
+		p.read = time.Since(start) - p.write
+		if err == nil && r.Id != m.Id {
+			if packet {
+				continue
+			}
+			err = dns.ErrId
+		}
+		return r, err
+	}
+}
+
+// exchangeDoH is exchangeOnce for DNS-over-HTTPS: it POSTs m in wire format to
+// dohPath on hostPort, as in RFC 8484. The dial, from connecting until the TLS
+// handshake is done, is left out of the RTT like for the other protocols, and the
+// write phase ends once the request is written. With reuseConns, the client's
+// transport keeps the connections instead of connPool. A response other than
+// 200 OK is an error without a DNS response.
+func exchangeDoH(ctx context.Context, m *dns.Msg, hostPort string) (*dns.Msg, time.Duration, phases, error) {
+	body, err := m.Pack()
+	if err != nil {
+		return nil, 0, phases{}, err
+	}
+	var (
+		dialStart, dialDone, wrote time.Time
+		reused                     bool
+	)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart:     func(string, string) { dialStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) { dialDone = time.Now() },
+		GotConn:          func(info httptrace.GotConnInfo) { reused = info.Reused },
+		WroteRequest:     func(httptrace.WroteRequestInfo) { wrote = time.Now() },
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+hostPort+dohPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, phases{}, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	start := time.Now()
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return nil, 0, phases{}, err
+	}
+	defer resp.Body.Close()
+	wire, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	done := time.Now()
+	rtt := done.Sub(start)
+	p := phases{reused: reused}
+	if !dialDone.IsZero() {
+		p.dial = dialDone.Sub(dialStart)
+		rtt -= p.dial
+		start = dialDone
+	}
+	if phaseLatency && !wrote.IsZero() {
+		p.write, p.read = wrote.Sub(start), done.Sub(wrote)
+	}
+	if err != nil {
+		return nil, rtt, p, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, rtt, p, fmt.Errorf("DNS-over-HTTPS server answered %s", resp.Status)
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(wire); err != nil {
+		return nil, rtt, p, fmt.Errorf("%w: %w", criteria.ErrMalformed, err)
+	}
+	return r, rtt, p, nil
+}
+
+// answerStrings renders the answers of type qtype, skipping e.g. the CNAMEs that
+// lead to them, so they can be counted and compared against a golden file.
+func answerStrings(r *dns.Msg, qtype uint16) []string {
+	var answers []string
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype != qtype {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			answers = append(answers, rr.A.String())
+		case *dns.AAAA:
+			answers = append(answers, rr.AAAA.String())
+		case *dns.TXT:
+			answers = append(answers, strings.Join(rr.Txt, ""))
+		case *dns.MX:
+			answers = append(answers, fmt.Sprintf("%d %s", rr.Preference, rr.Mx))
+		case *dns.SRV:
+			answers = append(answers, fmt.Sprintf("%d %d %d %s", rr.Priority, rr.Weight, rr.Port, rr.Target))
+		case *dns.NS:
+			answers = append(answers, rr.Ns)
+		case *dns.CNAME:
+			answers = append(answers, rr.Target)
+		case *dns.PTR:
+			answers = append(answers, rr.Ptr)
+		}
+	}
+	return answers
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSearchNames(t *testing.T) {
+	defer func() { searchList, ndots = nil, 0 }()
+	pod := []string{"default.svc.cluster.local", "svc.cluster.local", "cluster.local"}
+	testCases := []struct {
+		name     string
+		search   []string
+		ndots    int
+		expected []string
+	}{
+		{name: "bing.com", expected: []string{"bing.com."}},
+		{name: "bing.com", search: pod, ndots: 5, expected: []string{
+			"bing.com.default.svc.cluster.local.", "bing.com.svc.cluster.local.", "bing.com.cluster.local.", "bing.com.",
+		}},
+		{name: "kubernetes.default", search: pod, ndots: 1, expected: []string{
+			"kubernetes.default.", "kubernetes.default.default.svc.cluster.local.", "kubernetes.default.svc.cluster.local.", "kubernetes.default.cluster.local.",
+		}},
+		{name: "bing.com.", search: pod, ndots: 5, expected: []string{"bing.com."}},
+	}
+	for _, tc := range testCases {
+		searchList, ndots = tc.search, tc.ndots
+		if got := searchNames(tc.name); !slices.Equal(got, tc.expected) {
+			t.Errorf("%s with ndots %d: expected %v, got %v", tc.name, tc.ndots, tc.expected, got)
+		}
+	}
+}
+
+func TestLoadSearchDomains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	conf := "search kube-system.svc.cluster.local svc.cluster.local cluster.local\nnameserver 10.96.0.10\noptions ndots:5\n"
+	if err := os.WriteFile(path, []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	search, n, err := loadSearchDomains(path)
+	if err != nil {
+		t.Fatalf("loadSearchDomains: %v", err)
+	}
+	if expected := []string{"kube-system.svc.cluster.local", "svc.cluster.local", "cluster.local"}; !slices.Equal(search, expected) || n != 5 {
+		t.Errorf("expected search %v with ndots 5, got %v with ndots %d", expected, search, n)
+	}
+	if _, _, err := loadSearchDomains(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -2,20 +2,38 @@
 package main
 
 import (
+	"cmp"
 	"context"
-	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"maps"
 	"net"
 	"os"
 	"os/signal"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/alexflint/go-arg"
+	"github.com/miekg/dns"
+	"github.com/paulgmiller/corednsprobe/pkg/alert"
+	"github.com/paulgmiller/corednsprobe/pkg/corednsmetrics"
+	"github.com/paulgmiller/corednsprobe/pkg/criteria"
+	"github.com/paulgmiller/corednsprobe/pkg/health"
+	"github.com/paulgmiller/corednsprobe/pkg/lease"
 	"github.com/paulgmiller/corednsprobe/pkg/metrics"
+	"github.com/paulgmiller/corednsprobe/pkg/quantile"
+	"github.com/paulgmiller/corednsprobe/pkg/remotewrite"
+	"github.com/paulgmiller/corednsprobe/pkg/tracing"
+	"golang.org/x/time/rate"
 	v1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -27,153 +45,1139 @@ const sliceLabel = v1.LabelServiceName
 
 // Config holds CLI and env settings
 type Config struct {
-	Namespace       string        `arg:"--namespace,env:NAMESPACE" default:"kube-system" help:"Kubernetes namespace"`
-	ServiceName     string        `arg:"--service-name,env:SERVICE_NAME" default:"kube-dns" help:"Service name"`
-	QueryDomain     string        `arg:"--query-domain,env:QUERY_DOMAIN" default:"bing.com" help:"Domain to query"`
-	QueryTimeout    time.Duration `arg:"--query-timeout,env:QUERY_TIMEOUT" default:"100ms" help:"DNS query timeout"`
-	LoopInterval    time.Duration `arg:"--loop-interval,env:LOOP_INTERVAL" default:"100ms" help:"Probe loop interval"`
-	SummaryInterval time.Duration `arg:"--summary-interval,env:SUMMARY_INTERVAL" default:"10s" help:"Summary interval"`
-	MetricsAddr     string        `arg:"--metrics-addr,env:METRICS_ADDR" default:":9091" help:"Address to expose Prometheus metrics"`
+	ConfigFile       string        `arg:"--config,env:CONFIG" help:"YAML file with settings keyed by flag name in camelCase, e.g. queryDomain; the environment and flags override it"`
+	Servers          []string      `arg:"--servers,env:SERVERS" help:"Probe these DNS server IPs, optionally with :port, instead of discovering CoreDNS in Kubernetes (comma-separated in env)"`
+	DiscoveryEvery   time.Duration `arg:"--discovery-interval,env:DISCOVERY_INTERVAL" help:"List EndpointSlices at this interval instead of watching them (0 to watch)"`
+	ReconcileEvery   time.Duration `arg:"--reconcile-interval,env:RECONCILE_INTERVAL" default:"5m" help:"When watching EndpointSlices, compare the probed endpoints with a fresh list at this interval and correct drift, e.g. after a missed watch event (0 to disable)"`
+	DiscoveryMode    string        `arg:"--discovery-mode,env:DISCOVERY_MODE" default:"auto" help:"Discover CoreDNS pods from endpointslices, the older endpoints API, or auto to fall back to endpoints when EndpointSlices are unavailable"`
+	DiscoveryTimeout time.Duration `arg:"--discovery-timeout,env:DISCOVERY_TIMEOUT" default:"5m" help:"Keep retrying the initial EndpointSlice list this long before exiting (0 to retry forever)"`
+	ProbeClusterIP   bool          `arg:"--probe-clusterip,env:PROBE_CLUSTERIP" help:"Also probe the Service ClusterIP through kube-proxy, to compare with the pods"`
+	NodeLocal        string        `arg:"--node-local,env:NODE_LOCAL" help:"Also probe the NodeLocal DNSCache at this address, e.g. 169.254.20.10, which pods on the probe's node query first (disabled when empty)"`
+	NodeLocalOnly    bool          `arg:"--node-local-only,env:NODE_LOCAL_ONLY" help:"Probe only --node-local and --baseline-resolver instead of discovering CoreDNS"`
+	BaselineResolver string        `arg:"--baseline-resolver,env:BASELINE_RESOLVER" help:"Also probe this resolver outside CoreDNS, e.g. 8.8.8.8 or 168.63.129.16:53, to tell CoreDNS problems from network or upstream ones"`
+	SameZoneOnly     bool          `arg:"--same-zone-only,env:SAME_ZONE_ONLY" help:"Only probe CoreDNS pods in the probe's own zone, as topology-aware routing would"`
+	Zone             string        `arg:"--zone,env:ZONE" help:"Zone of the probe for --same-zone-only (default the topology.kubernetes.io/zone label of --node-name)"`
+	NodeName         string        `arg:"--node-name,env:NODE_NAME" help:"Node the probe runs on, usually set from spec.nodeName with the Downward API"`
+	Namespace        string        `arg:"--namespace,env:NAMESPACE" default:"kube-system" help:"Kubernetes namespace"`
+	ServiceName      string        `arg:"--service-name,env:SERVICE_NAME" default:"kube-dns" help:"Service name"`
+	QueryDomain      string        `arg:"--query-domain,env:QUERY_DOMAIN" default:"bing.com" help:"Domain to query, or a comma-separated list to rotate through like --shard-names"`
+	RandomizeQuery   bool          `arg:"--randomize-query,env:RANDOMIZE_QUERY" help:"Prepend a random label to every query name so answers are not served from the CoreDNS cache"`
+	UseSearchDomains bool          `arg:"--use-search-domains,env:USE_SEARCH_DOMAINS" help:"Resolve query names through the search list and ndots of /etc/resolv.conf like a pod does, recording how many queries each lookup took"`
+	QueryType        string        `arg:"--query-type,env:QUERY_TYPE" default:"A" help:"Record type to query: A, AAAA, TXT, MX, SRV, NS, CNAME or PTR (PTR needs an IP address as --query-domain)"`
+	Protocol         string        `arg:"--protocol,env:PROTOCOL" default:"udp" help:"Transport for DNS queries: udp, tcp, both to send one query over each per probe, dot for DNS-over-TLS or doh for DNS-over-HTTPS"`
+	DoTPort          int           `arg:"--dot-port,env:DOT_PORT" default:"853" help:"Port of the DNS-over-TLS listener with --protocol dot"`
+	DoHPort          int           `arg:"--doh-port,env:DOH_PORT" default:"443" help:"Port of the DNS-over-HTTPS listener with --protocol doh"`
+	DoHPath          string        `arg:"--doh-path,env:DOH_PATH" default:"/dns-query" help:"URL path DNS-over-HTTPS queries are sent to with --protocol doh"`
+	TLSServerName    string        `arg:"--tls-servername,env:TLS_SERVERNAME" help:"Server name to verify the DNS-over-TLS or DNS-over-HTTPS certificate against (default the endpoint IP)"`
+	TLSInsecure      bool          `arg:"--tls-insecure,env:TLS_INSECURE" help:"Skip verifying the DNS-over-TLS or DNS-over-HTTPS certificate, e.g. for self-signed ones"`
+	ReuseConnections bool          `arg:"--reuse-connections,env:REUSE_CONNECTIONS" help:"Keep tcp, dot and doh connections open for the next query to the same endpoint instead of dialing one per query"`
+	EDNSBufSize      int           `arg:"--edns-bufsize,env:EDNS_BUFSIZE" help:"Advertise this UDP payload size in an EDNS0 OPT record on every query, e.g. 1232 or 4096 (0 to send no OPT record, limiting UDP answers to 512 bytes)"`
+	Compress         bool          `arg:"--compress,env:COMPRESS" help:"Compress names in queries and measure response sizes compressed, as CoreDNS sends them, rather than uncompressed"`
+	DNSCookies       bool          `arg:"--dns-cookies,env:DNS_COOKIES" help:"Send a DNS cookie (RFC 7873) with every query and check the one in the response, recording mismatches as cookie_mismatch"`
+	DNSFlags         string        `arg:"--dns-flags,env:DNS_FLAGS" help:"dig-style query options applied on top of the other flags, e.g. \"+dnssec +norecurse +tcp\": +[no]recurse, +[no]cd, +[no]ad, +[no]dnssec, +[no]cookie, +[no]edns, +bufsize=N, +[no]tcp"`
+	QueryTimeout     time.Duration `arg:"--query-timeout,env:QUERY_TIMEOUT" default:"100ms" help:"DNS query timeout"`
+	QueryRetries     int           `arg:"--query-retries,env:QUERY_RETRIES" help:"Retry a query that got no response up to this many times within --query-timeout"`
+	RetryOn          []string      `arg:"--retry-on,env:RETRY_ON" help:"Which attempts --query-retries retries: no-response, servfail (default no-response; comma-separated in env)"`
+	PhaseLatency     bool          `arg:"--phase-latency,env:PHASE_LATENCY" help:"Record how long sending each query and waiting for its response took in coredns_probe_phase_duration_seconds"`
+	LoopInterval     time.Duration `arg:"--loop-interval,env:LOOP_INTERVAL" default:"100ms" help:"Probe loop interval"`
+	SummaryInterval  time.Duration `arg:"--summary-interval,env:SUMMARY_INTERVAL" default:"10s" help:"Summary interval"`
+	MetricsAddr      string        `arg:"--metrics-addr,env:METRICS_ADDR" default:":9091" help:"Address to expose Prometheus metrics"`
+	MetricsPath      string        `arg:"--metrics-path,env:METRICS_PATH" default:"/metrics" help:"HTTP path to expose Prometheus metrics on"`
+	MetricsTLSCert   string        `arg:"--metrics-tls-cert,env:METRICS_TLS_CERT" help:"PEM certificate file to serve the metrics endpoint over HTTPS with, together with --metrics-tls-key"`
+	MetricsTLSKey    string        `arg:"--metrics-tls-key,env:METRICS_TLS_KEY" help:"PEM private key file for --metrics-tls-cert"`
+	MetricsUsername  string        `arg:"--metrics-username,env:METRICS_USERNAME" help:"Require basic auth with this username for the metrics (disabled when empty)"`
+	MetricsPassword  string        `arg:"--metrics-password,env:METRICS_PASSWORD" help:"Basic auth password for the metrics; prefer the env var"`
+	LeaseName        string        `arg:"--lease-name,env:LEASE_NAME" help:"Publish a Lease with this name in the namespace, renewed every summary interval (disabled when empty)"`
+	LeaderElect      bool          `arg:"--leader-elect,env:LEADER_ELECT" help:"Elect a leader among the replicas through a Lease; only the leader probes"`
+	LeaderElectLease string        `arg:"--leader-elect-lease,env:LEADER_ELECT_LEASE" default:"coredns-probe-leader" help:"Name of the Lease in the namespace used for --leader-elect"`
+	HealthPort       int           `arg:"--health-port,env:HEALTH_PORT" help:"Also HTTP-check each CoreDNS endpoint on this port every summary interval, e.g. 8080 or 8181 (disabled when 0)"`
+	CoreDNSMetrics   int           `arg:"--coredns-metrics-port,env:COREDNS_METRICS_PORT" help:"Also scrape the CoreDNS metrics of each endpoint on this port every summary interval, e.g. 9153 (disabled when 0)"`
+	HealthPath       string        `arg:"--health-path,env:HEALTH_PATH" default:"/health" help:"Path for the CoreDNS HTTP health check, e.g. /health or /ready"`
+	Once             bool          `arg:"--once,env:ONCE" help:"Query every endpoint once, print the results and exit non-zero on failure"`
+	GoldenFile       string        `arg:"--golden-file,env:GOLDEN_FILE" help:"With --once, write answers to this JSON file if it does not exist, otherwise fail if they differ from it"`
+	NegativeDomain   string        `arg:"--negative-domain,env:NEGATIVE_DOMAIN" help:"Also query this nonexistent name on every tick and count NXDOMAIN as success (disabled when empty)"`
+	TruncationDomain string        `arg:"--truncation-domain,env:TRUNCATION_DOMAIN" help:"Also query this name, whose answer exceeds 512 bytes, over UDP on every tick and check that the truncated response is retried over TCP (disabled when empty)"`
+	TruncationType   string        `arg:"--truncation-type,env:TRUNCATION_TYPE" default:"A" help:"Record type to query for --truncation-domain"`
+	ShardNames       []string      `arg:"--shard-names,env:SHARD_NAMES" help:"Rotate through these names per endpoint instead of --query-domain and report per-name results (comma-separated in env)"`
+	ProbeNotReady    bool          `arg:"--probe-not-ready,env:PROBE_NOT_READY" help:"Also probe endpoints that are not ready, e.g. starting or terminating CoreDNS pods"`
+	SuccessRcodes    []string      `arg:"--success-rcodes,env:SUCCESS_RCODES" help:"Response codes that count as success: NOERROR, NXDOMAIN, SERVFAIL (default NOERROR; comma-separated in env)"`
+	MinAnswers       int           `arg:"--min-answers,env:MIN_ANSWERS" help:"Minimum number of answers for a successful query"`
+	MaxAnswers       int           `arg:"--max-answers,env:MAX_ANSWERS" help:"Maximum number of answers for a successful query (0 for no limit)"`
+	ExpectAnswer     string        `arg:"--expect-answer,env:EXPECT_ANSWER" help:"IP address or regular expression one of the answers must match for a successful query"`
+	AnswerRegex      []string      `arg:"--answer-regex,env:ANSWER_REGEX" help:"name=regex: every answer for the query name must match the regular expression, e.g. bing.com=^13\\. (mismatches are recorded as bad_answer; comma-separated in env)"`
+	MaxLatency       time.Duration `arg:"--max-latency,env:MAX_LATENCY" help:"Maximum RTT for a successful query (default --query-timeout)"`
+	ResourceAttrs    string        `arg:"--resource-attributes,env:OTEL_RESOURCE_ATTRIBUTES" help:"Comma-separated key=value resource attributes exported on target_info, e.g. k8s.cluster.name=prod"`
+	Concurrency      int           `arg:"--concurrency,env:CONCURRENCY" help:"Run at most this many queries at once on a fixed pool of workers (0 for one goroutine per query)"`
+	MaxQPS           float64       `arg:"--max-qps,env:MAX_QPS" help:"Send at most this many queries per second across all endpoints, delaying the rest and skipping those that would outlast the probe cycle (0 for no limit)"`
+	TargetWorkers    []string      `arg:"--target-concurrency,env:TARGET_CONCURRENCY" help:"kind=n: run the queries to endpoints of a target kind, pod, service, static, baseline or nodelocal, on their own pool of n workers instead of --concurrency, e.g. baseline=1 (comma-separated in env)"`
+	TargetMaxQPS     []string      `arg:"--target-max-qps,env:TARGET_MAX_QPS" help:"kind=qps: limit the queries to endpoints of a target kind separately from --max-qps, e.g. service=5 (comma-separated in env)"`
+	MaxCycleDuration time.Duration `arg:"--max-cycle-duration,env:MAX_CYCLE_DURATION" help:"Cancel queries still outstanding this long after a probe cycle started (0 for no bound)"`
+	Warmup           time.Duration `arg:"--warmup,env:WARMUP" help:"Probe for this long after starting without recording the results, while CoreDNS caches and connections warm up (disabled when 0)"`
+	ColdStartWindow  time.Duration `arg:"--coldstart-window,env:COLDSTART_WINDOW" help:"Also probe CoreDNS endpoints that appear after startup, e.g. restarted pods, every --coldstart-interval for this long, recording coredns_probe_coldstart_rtt_milliseconds (disabled when 0)"`
+	ColdStartEvery   time.Duration `arg:"--coldstart-interval,env:COLDSTART_INTERVAL" default:"20ms" help:"How often to probe new endpoints during --coldstart-window"`
+	Jitter           float64       `arg:"--jitter,env:JITTER" help:"Randomize each probe interval by up to this fraction of --loop-interval, e.g. 0.25 for ±25%, and spread the queries of a cycle over that fraction"`
+	OutlierThreshold float64       `arg:"--outlier-threshold,env:OUTLIER_THRESHOLD" help:"Flag endpoints whose success rate or average RTT is this many standard deviations worse than the median of all endpoints in the summary, e.g. 3 (disabled when 0)"`
+	LogFormat        string        `arg:"--log-format,env:LOG_FORMAT" default:"text" help:"Log and summary format: text, or json for one structured record per endpoint and summary"`
+	ProblemsOnly     bool          `arg:"--summary-problems-only,env:SUMMARY_PROBLEMS_ONLY" help:"List only the endpoints with failures or outlier marks in the summaries, most severe by --endpoint-weight first"`
+	EndpointWeight   []string      `arg:"--endpoint-weight,env:ENDPOINT_WEIGHT" help:"label=value=weight: weigh the endpoints whose endpoint, pod, node, zone or target label has the value in the cluster success ratio and the problems-only summary, e.g. zone=eastus-1=3 (default 1, the last match wins; comma-separated in env)"`
+	SummaryOutput    string        `arg:"--summary-output,env:SUMMARY_OUTPUT" default:"stdout" help:"Where to write the summaries: stdout, stderr, a file path to append to, or none for metrics only"`
+	SelfTest         *SelfTestCmd  `arg:"subcommand:selftest" help:"Check Kubernetes access and endpoint reachability, then exit"`
+	NativeHistograms bool          `arg:"--native-histograms,env:NATIVE_HISTOGRAMS" help:"Also export the RTT histograms as Prometheus native histograms, for scrapers that support them"`
+	RTTBuckets       []float64     `arg:"--rtt-buckets,env:RTT_BUCKETS" help:"Upper bounds in milliseconds of the RTT histogram buckets, e.g. 10,100,1000,3000 (default 0.5 to 1000; comma-separated in env)"`
+	ClusterName      string        `arg:"--cluster-name,env:CLUSTER_NAME" help:"Add a cluster label with this value to all metrics (default k8s.cluster.name from --resource-attributes)"`
+	AlertWebhook     string        `arg:"--alert-webhook,env:ALERT_WEBHOOK" help:"POST a JSON alert to this URL when an endpoint's success rate stays below --alert-threshold (disabled when empty)"`
+	AlertThreshold   float64       `arg:"--alert-threshold,env:ALERT_THRESHOLD" default:"90" help:"Success rate in percent below which an endpoint is failing"`
+	AlertFor         time.Duration `arg:"--alert-for,env:ALERT_FOR" default:"1m" help:"How long an endpoint must be failing before the alert fires"`
+	RemoteWriteURL   string        `arg:"--remote-write-url,env:REMOTE_WRITE_URL" help:"Also push metrics to this Prometheus remote-write endpoint (disabled when empty)"`
+	RemoteWriteUser  string        `arg:"--remote-write-username,env:REMOTE_WRITE_USERNAME" help:"Basic auth username for remote write"`
+	RemoteWritePass  string        `arg:"--remote-write-password,env:REMOTE_WRITE_PASSWORD" help:"Basic auth password for remote write; prefer the env var"`
+	RemoteWriteEvery time.Duration `arg:"--remote-write-interval,env:REMOTE_WRITE_INTERVAL" default:"30s" help:"Interval between remote writes"`
+	PushgatewayURL   string        `arg:"--pushgateway-url,env:PUSHGATEWAY_URL" help:"Also push metrics to this Prometheus Pushgateway after every summary and on exit, e.g. for Jobs (disabled when empty)"`
+	OTLPEndpoint     string        `arg:"--otlp-endpoint,env:OTLP_ENDPOINT" help:"Export a trace span per query to this OTLP/HTTP collector, e.g. http://otel-collector:4318 (disabled when empty)"`
 }
 
+// maxShardNames bounds the name label cardinality of the per-name metrics.
+const maxShardNames = 20
+
 // global settings populated in main()
 var (
-	namespace       string
-	serviceName     string
-	queryDomain     string
-	queryTimeout    time.Duration
-	loopInterval    time.Duration
-	summaryInterval time.Duration
-	metricsAddr     string
+	namespace        string
+	serviceName      string
+	queryDomain      string
+	randomizeQuery   bool
+	queryType        string
+	protocols        []string
+	dotPort          int
+	dohPort          int
+	dohPath          string
+	queryTimeout     time.Duration
+	queryRetries     int
+	loopInterval     time.Duration
+	summaryInterval  time.Duration
+	metricsAddr      string
+	metricsPath      string
+	leaseName        string
+	healthPort       int
+	healthPath       string
+	goldenFile       string
+	shardNames       []string
+	probeNotReady    bool
+	onlyZone         string
+	discoveryTimeout time.Duration
+	reconcileEvery   time.Duration
+	successCriteria  criteria.Criteria
+	answerRegexes    map[string]*regexp.Regexp // by query name, see criteriaFor
+	negativeDomain   string
+	negativeCriteria criteria.Criteria
+	maxCycleDuration time.Duration
+	coldStartWindow  time.Duration
+	coldStartEvery   time.Duration
+	jitter           float64
+	outlierThreshold float64
+	logFormat        string
+	problemsOnly     bool
+)
+
+// summaryOut receives the summaries, nil with --summary-output none; populated in
+// main().
+var summaryOut io.Writer
+
+// settings of the truncation test, populated in main()
+var (
+	truncationDomain   string
+	truncationType     string
+	truncationCriteria criteria.Criteria
+)
+
+// Set at build time, e.g. with
+// -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD)".
+var (
+	version = "dev"
+	commit  = ""
 )
 
+// buildCommit returns commit, falling back to the revision the go tool records
+// when building from a git checkout.
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				return s.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
 func main() {
 	var cfg Config
-	arg.MustParse(&cfg)
+	p := arg.MustParse(&cfg)
+	if cfg.ConfigFile != "" {
+		var err error
+		if cfg, err = loadConfig(cfg.ConfigFile, os.Args[1:]); err != nil {
+			p.Fail(err.Error())
+		}
+	}
 	namespace, serviceName = cfg.Namespace, cfg.ServiceName
 	queryDomain, queryTimeout = cfg.QueryDomain, cfg.QueryTimeout
+	queryRetries, phaseLatency, reuseConns = cfg.QueryRetries, cfg.PhaseLatency, cfg.ReuseConnections
+	if queryRetries < 0 {
+		log.Fatalf("--query-retries must not be negative, got %d", queryRetries)
+	}
+	if len(cfg.RetryOn) > 0 {
+		retryNoResponse = false
+		for _, on := range cfg.RetryOn {
+			switch strings.ToLower(on) {
+			case "no-response":
+				retryNoResponse = true
+			case "servfail":
+				retryServFail = true
+			default:
+				log.Fatalf("unsupported --retry-on %q, want no-response or servfail", on)
+			}
+		}
+	}
+	if strings.Contains(queryDomain, ",") {
+		// A list of domains is rotated through like --shard-names, with the name
+		// reported as domain.
+		if len(cfg.ShardNames) > 0 {
+			log.Fatalf("--query-domain lists several domains, which cannot be combined with --shard-names")
+		}
+		for _, d := range strings.Split(queryDomain, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				cfg.ShardNames = append(cfg.ShardNames, d)
+			}
+		}
+		if len(cfg.ShardNames) == 0 {
+			log.Fatalf("--query-domain has no domain in %q", cfg.QueryDomain)
+		}
+		queryDomain = cfg.ShardNames[0]
+		metrics.UseDomainLabel()
+	}
+	randomizeQuery = cfg.RandomizeQuery
+	if cfg.UseSearchDomains {
+		var err error
+		if searchList, ndots, err = loadSearchDomains(resolvConf); err != nil {
+			log.Fatalf("--use-search-domains: %v", err)
+		}
+		log.Printf("Resolving query names through search list %v with ndots %d", searchList, ndots)
+	}
+	queryType = strings.ToUpper(cfg.QueryType)
+	if !slices.Contains(queryTypes, queryType) {
+		log.Fatalf("unsupported --query-type %q, want one of %s", cfg.QueryType, strings.Join(queryTypes, ", "))
+	}
+	if queryType == "PTR" && net.ParseIP(queryDomain) == nil {
+		log.Fatalf("--query-type PTR needs an IP address as --query-domain, got %q", queryDomain)
+	}
+	if cfg.EDNSBufSize != 0 && (cfg.EDNSBufSize < dns.MinMsgSize || cfg.EDNSBufSize > dns.MaxMsgSize) {
+		log.Fatalf("--edns-bufsize must be 0 or between %d and %d, got %d", dns.MinMsgSize, dns.MaxMsgSize, cfg.EDNSBufSize)
+	}
+	queryFlags.bufSize, queryFlags.cookie, queryFlags.compress = cfg.EDNSBufSize, cfg.DNSCookies, cfg.Compress
+	if queryFlags.cookie && queryFlags.bufSize == 0 {
+		queryFlags.bufSize = defaultEDNSBufSize
+	}
+	protocol := strings.ToLower(cfg.Protocol)
+	if cfg.DNSFlags != "" {
+		var err error
+		if queryFlags, err = parseDNSFlags(cfg.DNSFlags, queryFlags); err != nil {
+			log.Fatalf("parsing --dns-flags: %v", err)
+		}
+		if queryFlags.transport != "" {
+			// Like dig, +tcp picks one transport, which would silently drop the
+			// other half of both.
+			if protocol == "dot" || protocol == "doh" || protocol == "both" {
+				log.Fatalf("--dns-flags +[no]tcp cannot be combined with --protocol %s", protocol)
+			}
+			protocol = queryFlags.transport
+		}
+	}
+	switch protocol {
+	case "udp":
+		protocols = []string{"udp"}
+	case "tcp":
+		protocols = []string{"tcp"}
+	case "both":
+		protocols = []string{"udp", "tcp"}
+	case "dot":
+		protocols = []string{"dot"}
+		dotPort = cfg.DoTPort
+		dnsClients["dot"] = newDoTClient(cfg.TLSServerName, cfg.TLSInsecure)
+	case "doh":
+		if !strings.HasPrefix(cfg.DoHPath, "/") {
+			log.Fatalf("--doh-path must start with /, got %q", cfg.DoHPath)
+		}
+		protocols = []string{"doh"}
+		dohPort, dohPath = cfg.DoHPort, cfg.DoHPath
+		dohClient = newDoHClient(cfg.TLSServerName, cfg.TLSInsecure, reuseConns)
+	default:
+		log.Fatalf("unsupported --protocol %q, want udp, tcp, both, dot or doh", cfg.Protocol)
+	}
 	loopInterval, summaryInterval = cfg.LoopInterval, cfg.SummaryInterval
-	metricsAddr = cfg.MetricsAddr
+	metricsAddr, metricsPath = cfg.MetricsAddr, cfg.MetricsPath
+	if !strings.HasPrefix(metricsPath, "/") || metricsPath == "/healthz" || metricsPath == "/readyz" {
+		log.Fatalf("--metrics-path must start with / and not be /healthz or /readyz, got %q", metricsPath)
+	}
+	leaseName = cfg.LeaseName
+	healthPort, healthPath = cfg.HealthPort, cfg.HealthPath
+	goldenFile = cfg.GoldenFile
+	if goldenFile != "" && !cfg.Once {
+		log.Fatalf("--golden-file requires --once")
+	}
+	if cfg.LeaderElect && cfg.Once {
+		log.Fatalf("--leader-elect cannot be combined with --once")
+	}
+	if cfg.Warmup != 0 && cfg.Once {
+		log.Fatalf("--warmup cannot be combined with --once")
+	}
+	coldStartWindow, coldStartEvery = cfg.ColdStartWindow, cfg.ColdStartEvery
+	if coldStartWindow > 0 {
+		if cfg.Once || len(cfg.Servers) > 0 || cfg.NodeLocalOnly {
+			log.Fatalf("--coldstart-window needs endpoint discovery and cannot be combined with --once, --servers or --node-local-only")
+		}
+		if coldStartEvery <= 0 {
+			log.Fatalf("--coldstart-interval must be positive, got %v", coldStartEvery)
+		}
+	}
+	shardNames = cfg.ShardNames
+	probeNotReady = cfg.ProbeNotReady
+	discoveryTimeout, reconcileEvery = cfg.DiscoveryTimeout, cfg.ReconcileEvery
+	switch strings.ToLower(cfg.DiscoveryMode) {
+	case discoveryAuto, discoveryEndpointSlices, discoveryEndpoints:
+	default:
+		log.Fatalf("unsupported --discovery-mode %q, want auto, endpointslices or endpoints", cfg.DiscoveryMode)
+	}
+	maxCycleDuration = cfg.MaxCycleDuration
+	jitter = cfg.Jitter
+	if jitter < 0 || jitter >= 1 {
+		log.Fatalf("--jitter must be at least 0 and less than 1, got %v", jitter)
+	}
+	outlierThreshold = cfg.OutlierThreshold
+	if outlierThreshold < 0 {
+		log.Fatalf("--outlier-threshold must not be negative, got %v", outlierThreshold)
+	}
+	problemsOnly = cfg.ProblemsOnly
+	successCriteria = criteria.Default(queryTimeout)
+	if len(cfg.SuccessRcodes) > 0 {
+		successCriteria.Rcodes = nil
+		for _, rc := range cfg.SuccessRcodes {
+			rc = strings.ToUpper(rc)
+			switch rc {
+			case criteria.RcodeNoError, criteria.RcodeNXDomain, criteria.RcodeServFail:
+				successCriteria.Rcodes = append(successCriteria.Rcodes, rc)
+			default:
+				log.Fatalf("unsupported rcode %q in --success-rcodes", rc)
+			}
+		}
+	}
+	successCriteria.MinAnswers, successCriteria.MaxAnswers = cfg.MinAnswers, cfg.MaxAnswers
+	if cfg.MaxLatency > 0 {
+		successCriteria.MaxLatency = cfg.MaxLatency
+	}
+	if cfg.ExpectAnswer != "" {
+		re, err := criteria.ParseExpectAnswer(cfg.ExpectAnswer)
+		if err != nil {
+			log.Fatalf("parsing --expect-answer: %v", err)
+		}
+		successCriteria.ExpectAnswer = re
+	}
+	var err error
+	if answerRegexes, err = parseAnswerRegexes(cfg.AnswerRegex); err != nil {
+		log.Fatalf("parsing --answer-regex: %v", err)
+	}
+	for name := range answerRegexes {
+		probed := name == answerRegexKey(queryDomain) || slices.ContainsFunc(shardNames, func(n string) bool { return answerRegexKey(n) == name })
+		if !probed {
+			log.Fatalf("--answer-regex for %q, which is neither --query-domain nor one of --shard-names", name)
+		}
+	}
+	if endpointWeights, err = parseEndpointWeights(cfg.EndpointWeight); err != nil {
+		log.Fatalf("parsing --endpoint-weight: %v", err)
+	}
+	negativeDomain = cfg.NegativeDomain
+	negativeCriteria = criteria.Criteria{Rcodes: []string{criteria.RcodeNXDomain}, MaxLatency: successCriteria.MaxLatency}
+	truncationDomain, truncationType = cfg.TruncationDomain, strings.ToUpper(cfg.TruncationType)
+	if !slices.Contains(queryTypes, truncationType) || truncationType == "PTR" {
+		log.Fatalf("unsupported --truncation-type %q", cfg.TruncationType)
+	}
+	// The truncation test takes a UDP and a TCP round trip.
+	truncationCriteria = criteria.Criteria{Rcodes: []string{criteria.RcodeNoError}, MaxLatency: 2 * successCriteria.MaxLatency}
+	if len(shardNames) > maxShardNames {
+		log.Fatalf("--shard-names accepts at most %d names, got %d", maxShardNames, len(shardNames))
+	}
+
+	switch logFormat = strings.ToLower(cfg.LogFormat); logFormat {
+	case "text":
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+	default:
+		log.Fatalf("unsupported --log-format %q, want text or json", cfg.LogFormat)
+	}
+	switch cfg.SummaryOutput {
+	case "stdout":
+		summaryOut = os.Stdout
+	case "stderr":
+		summaryOut = os.Stderr
+	case "none":
+	default:
+		f, err := os.OpenFile(cfg.SummaryOutput, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Fatalf("opening --summary-output: %v", err)
+		}
+		defer f.Close()
+		summaryOut = f
+	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	if cfg.SelfTest != nil {
+		if !runSelfTest(ctx, os.Stdout, cfg.Servers, cfg.DiscoveryMode) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Initialize metrics
-	metrics.StartServer(ctx, metricsAddr)
-	log.Printf("Metrics server started on %s/metrics", metricsAddr)
+	attrs, err := metrics.ParseResourceAttributes(cfg.ResourceAttrs)
+	if err != nil {
+		log.Fatalf("parsing --resource-attributes: %v", err)
+	}
+	if _, ok := attrs["k8s.namespace.name"]; !ok {
+		attrs["k8s.namespace.name"] = namespace
+	}
+	clusterName := cfg.ClusterName
+	if clusterName == "" {
+		clusterName = attrs["k8s.cluster.name"]
+	}
+	metrics.SetClusterName(clusterName)
+	if cfg.NativeHistograms {
+		metrics.EnableNativeHistograms()
+	}
+	if len(cfg.RTTBuckets) > 0 {
+		if err := metrics.SetRTTBuckets(cfg.RTTBuckets); err != nil {
+			log.Fatalf("parsing --rtt-buckets: %v", err)
+		}
+	}
+	if (cfg.MetricsTLSCert == "") != (cfg.MetricsTLSKey == "") {
+		log.Fatalf("--metrics-tls-cert and --metrics-tls-key must be set together")
+	}
+	if cfg.MetricsTLSCert != "" {
+		if err := metrics.SetServerTLS(cfg.MetricsTLSCert, cfg.MetricsTLSKey); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if (cfg.MetricsUsername == "") != (cfg.MetricsPassword == "") {
+		log.Fatalf("--metrics-username and --metrics-password must be set together")
+	}
+	metrics.SetBasicAuth(cfg.MetricsUsername, cfg.MetricsPassword)
+	if err := metrics.SetTargetInfo(attrs); err != nil {
+		log.Fatalf("setting target_info: %v", err)
+	}
+	metrics.SetBuildInfo(version, buildCommit())
+	if err := initLookup(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	var probed atomic.Pointer[targets]
+	metrics.Handle("/config", configHandler(cfg, &probed))
+	metrics.Handle("/summary.json", summaryHandler())
+	if err := metrics.StartServer(ctx, metricsAddr, metricsPath); err != nil {
+		log.Fatalf("starting metrics server: %v", err)
+	}
+	defer func() {
+		// Let in-flight scrapes finish, also when main returns without a signal.
+		cancel()
+		metrics.Wait()
+	}()
+	log.Printf("Metrics server started on %s%s", metricsAddr, metricsPath)
 
-	client := mustClient()
+	if cfg.RemoteWriteURL != "" {
+		rw := remotewrite.NewClient(cfg.RemoteWriteURL, pushJob, pushInstance(), cfg.RemoteWriteUser, cfg.RemoteWritePass, metrics.Gatherer())
+		rwDone := make(chan struct{})
+		go func() {
+			defer close(rwDone)
+			rw.Run(ctx, cfg.RemoteWriteEvery)
+		}()
+		// Wait for the final push, before the metrics server is shut down.
+		defer func() {
+			cancel()
+			<-rwDone
+		}()
+		log.Printf("Remote writing metrics to %s every %v", cfg.RemoteWriteURL, cfg.RemoteWriteEvery)
+	}
 
-	slices, err := client.DiscoveryV1().EndpointSlices(namespace).
-		List(ctx, metav1.ListOptions{LabelSelector: sliceLabel + "=" + serviceName})
-	if err != nil {
-		log.Fatalf("listing EndpointSlices failed: %v", err)
+	if cfg.PushgatewayURL != "" {
+		pusher = newPusher(cfg.PushgatewayURL)
+		// Runs before the metrics server is shut down, also on SIGTERM.
+		defer pushMetrics(context.Background())
+		log.Printf("Pushing metrics to %s after every summary", cfg.PushgatewayURL)
 	}
 
-	var servers []string
-	for _, es := range slices.Items {
-		for _, ep := range es.Endpoints {
-			servers = append(servers, ep.Addresses...)
+	if cfg.OTLPEndpoint != "" {
+		shutdown, err := tracing.Start(ctx, cfg.OTLPEndpoint, attrs)
+		if err != nil {
+			log.Fatalf("parsing --otlp-endpoint: %v", err)
 		}
+		defer func() {
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(flushCtx); err != nil {
+				log.Printf("flushing trace spans: %v", err)
+			}
+		}()
+		log.Printf("Exporting query spans to %s", cfg.OTLPEndpoint)
 	}
+
+	// NodeLocal DNSCache and the baseline resolver are probed next to the CoreDNS
+	// endpoints, whichever way they are found.
+	var baseline []endpoint
+	if cfg.NodeLocal != "" {
+		ep, err := nodeLocalEndpoint(cfg.NodeLocal, cfg.NodeName)
+		if err != nil {
+			log.Fatalf("parsing --node-local: %v", err)
+		}
+		baseline = append(baseline, ep)
+	}
+	if cfg.BaselineResolver != "" {
+		ep, err := baselineEndpoint(cfg.BaselineResolver)
+		if err != nil {
+			log.Fatalf("parsing --baseline-resolver: %v", err)
+		}
+		baseline = append(baseline, ep)
+	}
+
+	var tg *targets
+	var client *kubernetes.Clientset
+	if cfg.NodeLocalOnly {
+		if cfg.NodeLocal == "" {
+			log.Fatalf("--node-local-only needs --node-local")
+		}
+		if len(cfg.Servers) > 0 || cfg.ProbeClusterIP || cfg.SameZoneOnly {
+			log.Fatalf("--node-local-only cannot be combined with --servers, --probe-clusterip or --same-zone-only")
+		}
+		tg = newTargets(len(shardNames), baseline...)
+		tg.update(nil)
+	} else if len(cfg.Servers) > 0 {
+		if cfg.ProbeClusterIP {
+			log.Fatalf("--probe-clusterip cannot be combined with --servers")
+		}
+		if cfg.SameZoneOnly {
+			log.Fatalf("--same-zone-only cannot be combined with --servers")
+		}
+		tg = newTargets(len(shardNames), baseline...)
+		eps, err := staticEndpoints(cfg.Servers)
+		if err != nil {
+			log.Fatalf("parsing --servers: %v", err)
+		}
+		tg.update(eps)
+	} else {
+		client = mustClient()
+
+		if cfg.SameZoneOnly {
+			onlyZone = cfg.Zone
+			if onlyZone == "" {
+				if cfg.NodeName == "" {
+					log.Fatalf("--same-zone-only needs --zone or --node-name")
+				}
+				zone, err := nodeZone(ctx, client, cfg.NodeName)
+				if err != nil {
+					log.Fatalf("--same-zone-only: %v", err)
+				}
+				onlyZone = zone
+			}
+			log.Printf("Probing only CoreDNS pods in zone %s", onlyZone)
+		}
+
+		// The Service is used to pick the DNS port name and, with --probe-clusterip,
+		// for its ClusterIPs; without it (e.g. no RBAC for services) the
+		// conventional "dns" name is assumed.
+		svc, err := client.CoreV1().Services(namespace).Get(ctx, serviceName, metav1.GetOptions{})
+		if err != nil {
+			log.Printf("getting Service %s/%s, assuming DNS port name %q: %v", namespace, serviceName, dnsPortPreferredName, err)
+			svc = nil
+		}
+
+		var pinned []endpoint
+		if cfg.ProbeClusterIP {
+			if svc == nil {
+				log.Fatalf("--probe-clusterip needs the Service %s/%s", namespace, serviceName)
+			}
+			if pinned, err = serviceEndpoints(svc); err != nil {
+				log.Fatalf("--probe-clusterip: %v", err)
+			}
+		}
+		tg = newTargets(len(shardNames), append(pinned, baseline...)...)
+
+		mode := strings.ToLower(cfg.DiscoveryMode)
+		if mode == discoveryAuto {
+			mode = detectDiscoveryMode(ctx, client)
+		}
+		switch {
+		case mode == discoveryEndpoints:
+			if onlyZone != "" {
+				log.Fatalf("--same-zone-only needs EndpointSlices, the Endpoints API has no zones")
+			}
+			interval := cmp.Or(cfg.DiscoveryEvery, legacyPollInterval)
+			log.Printf("Polling Endpoints %s/%s every %v", namespace, serviceName, interval)
+			_, err = pollLegacyEndpoints(ctx, client, svc, tg, interval)
+		case cfg.DiscoveryEvery > 0:
+			_, err = pollEndpoints(ctx, client, svc, tg, cfg.DiscoveryEvery)
+		default:
+			err = watchEndpoints(ctx, client, svc, tg)
+		}
+		if err != nil {
+			log.Fatalf("discovering endpoints failed: %v", err)
+		}
+	}
+	probed.Store(tg)
+	servers, discovered, stats := tg.snapshot()
 	if len(servers) == 0 {
-		log.Fatalf("no CoreDNS pod IPs found in EndpointSlices for %s/%s", namespace, serviceName)
+		if cfg.Once {
+			log.Fatalf("no CoreDNS pod IPs found in EndpointSlices for %s/%s", namespace, serviceName)
+		}
+		log.Printf("no CoreDNS pod IPs found in EndpointSlices for %s/%s yet, waiting for some to appear", namespace, serviceName)
+	} else {
+		log.Printf("found %d CoreDNS endpoints %v", len(servers), servers)
+	}
+
+	if cfg.Once {
+		if err := runOnce(ctx, servers, discovered); err != nil {
+			// log.Fatalf skips deferred calls, so push the results first.
+			pushMetrics(context.Background())
+			log.Fatalf("probe failed: %v", err)
+		}
+		return
+	}
+
+	if cfg.LeaderElect {
+		if cfg.LeaderElectLease == leaseName {
+			log.Fatalf("--leader-elect-lease and --lease-name must differ, got %q", leaseName)
+		}
+		if client == nil {
+			client = mustClient()
+		}
+		identity, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("getting hostname for leader election identity: %v", err)
+		}
+		log.Printf("Waiting to lead Lease %s/%s as %s", namespace, cfg.LeaderElectLease, identity)
+		// A standby is ready once discovery ran, or rollouts would wait for
+		// it to lead.
+		metrics.SetReady(true)
+		// Once the leadership is lost, ctx is done and main returns, so that
+		// the replica restarts as a standby.
+		if ctx, err = electLeader(ctx, client, cfg.LeaderElectLease, identity); err != nil {
+			return
+		}
+		log.Printf("Leading Lease %s/%s, starting to probe", namespace, cfg.LeaderElectLease)
 	}
-	log.Printf("found %d CoreDNS endpoints %v", len(servers), servers)
 
-	stats := make([]*epStats, len(servers))
-	for i := range stats {
-		stats[i] = &epStats{}
+	var heartbeat *lease.Heartbeat
+	if leaseName != "" {
+		if client == nil {
+			client = mustClient()
+		}
+		identity, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("getting hostname for lease identity: %v", err)
+		}
+		heartbeat = lease.NewHeartbeat(client.CoordinationV1(), namespace, leaseName, identity, 3*summaryInterval)
+		if err := heartbeat.Renew(ctx); err != nil {
+			log.Printf("renewing lease: %v", err)
+		}
+		defer func() {
+			releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := heartbeat.Release(releaseCtx); err != nil {
+				log.Printf("releasing lease: %v", err)
+			}
+		}()
+	}
+
+	var checker *health.Checker
+	if healthPort != 0 {
+		checker = health.NewChecker(healthPort, healthPath, time.Second)
+		checkHealth(ctx, checker, servers, discovered, stats)
+	}
+
+	var scraper *corednsmetrics.Scraper
+	if cfg.CoreDNSMetrics != 0 {
+		scraper = corednsmetrics.NewScraper(cfg.CoreDNSMetrics, time.Second)
+		scrapeCoreDNS(ctx, scraper, servers, discovered, stats)
 	}
 
-	probeTicker := time.NewTicker(loopInterval)
+	var notifier *alert.Notifier
+	if cfg.AlertWebhook != "" {
+		notifier = alert.NewNotifier(cfg.AlertWebhook, cfg.AlertThreshold, cfg.AlertFor)
+	}
+
+	if cfg.Concurrency > 0 {
+		workers = newPool(ctx, cfg.Concurrency)
+	}
+	if cfg.MaxQPS > 0 {
+		// A burst of one spaces the queries evenly instead of sending a second's
+		// worth at the start of each cycle.
+		limiter = rate.NewLimiter(rate.Limit(cfg.MaxQPS), 1)
+	}
+	targetConcurrency, err := parseTargetLimits(cfg.TargetWorkers, strconv.Atoi)
+	if err != nil {
+		log.Fatalf("parsing --target-concurrency: %v", err)
+	}
+	targetWorkers = make(map[string]*pool, len(targetConcurrency))
+	for kind, n := range targetConcurrency {
+		targetWorkers[kind] = newPool(ctx, n)
+	}
+	targetMaxQPS, err := parseTargetLimits(cfg.TargetMaxQPS, func(s string) (float64, error) { return strconv.ParseFloat(s, 64) })
+	if err != nil {
+		log.Fatalf("parsing --target-max-qps: %v", err)
+	}
+	targetLimiters = make(map[string]*rate.Limiter, len(targetMaxQPS))
+	for kind, qps := range targetMaxQPS {
+		targetLimiters[kind] = rate.NewLimiter(rate.Limit(qps), 1)
+	}
+
+	if cfg.Warmup > 0 {
+		// Starts with the probing, e.g. once this replica leads.
+		warmupUntil = time.Now().Add(cfg.Warmup)
+		log.Printf("Warming up for %v, results are recorded from %s", cfg.Warmup, warmupUntil.Format(time.TimeOnly))
+	}
+
+	// Held by cold-start probing, so that the probe loop deletes the metrics of
+	// removed endpoints only once none of its queries can record to them.
+	var coldStart sync.RWMutex
+	if coldStartWindow > 0 {
+		go func() {
+			ticker := time.NewTicker(coldStartEvery)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					coldStart.RLock()
+					servers, discovered, stats := tg.snapshot()
+					runColdStart(ctx, servers, stats, lookupIn(discovered))
+					coldStart.RUnlock()
+				}
+			}
+		}()
+	}
+
+	var lastSent int64
+	lastSummary := time.Now()
+
+	probeTicker := time.NewTicker(jittered(loopInterval))
 	defer probeTicker.Stop()
 	summaryTicker := time.NewTicker(summaryInterval)
 	defer summaryTicker.Stop()
+	// SIGUSR1 prints the summary of the current window right away, without
+	// starting a new summary, percentile or alerting window.
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, syscall.SIGUSR1)
+	defer signal.Stop(dump)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-probeTicker.C:
-			var wg sync.WaitGroup
-			for idx, ip := range servers {
-				wg.Add(1)
-				go func(i int, addr string) {
-					defer wg.Done()
-					st := stats[i]
-					st.total.Add(1)
-
-					rtt, err := lookupThrough(addr)
-					if err != nil || rtt > queryTimeout {
-						st.fail.Add(1)
-						if errors.Is(err, context.DeadlineExceeded) {
-							metrics.RecordQuery(addr, metrics.QueryTimeout, rtt)
-							return
-						}
-
-						metrics.RecordQuery(addr, metrics.QueryError, rtt)
-						return
+			if jitter > 0 {
+				probeTicker.Reset(jittered(loopInterval))
+			}
+			servers, discovered, stats := tg.snapshot()
+			cycleStart := time.Now()
+			runCycle(ctx, servers, stats, lookupIn(discovered))
+			metrics.RecordLoopDuration(time.Since(cycleStart))
+			metrics.SetReady(true)
+			// runCycle has waited for all queries of the snapshot, and the lock
+			// waits for those of cold-start probing, so none can record to a
+			// removed endpoint after its series are deleted.
+			if removed := tg.takeRemoved(); len(removed) > 0 {
+				coldStart.Lock()
+				for _, addr := range removed {
+					metrics.DeleteEndpoint(addr)
+					connPool.forget(addr)
+					if notifier != nil {
+						sendAlert(ctx, notifier, notifier.Forget(time.Now(), addr))
 					}
-
-					metrics.RecordQuery(addr, metrics.QuerySuccess, rtt)
-					st.rttNanos.Add(rtt.Nanoseconds())
-				}(idx, ip)
+				}
+				coldStart.Unlock()
 			}
-			wg.Wait()
 
-		case <-summaryTicker.C:
-			fmt.Println("[summary] last 10 s:")
+		case <-dump:
+			servers, discovered, stats := tg.snapshot()
+			writeSummary(servers, discovered, stats, time.Since(lastSummary), false)
+
+		case now := <-summaryTicker.C:
+			servers, discovered, stats := tg.snapshot()
+			elapsed := now.Sub(lastSummary)
+			sent := queriesSent.Load()
+			metrics.SetQueriesSentPerSecond(float64(sent-lastSent) / elapsed.Seconds())
+			lastSent, lastSummary = sent, now
+
+			writeSummary(servers, discovered, stats, elapsed, true)
 			for i, ip := range servers {
-				st := stats[i]
-				total := st.total.Load()
-				fail := st.fail.Load()
-				sumRTT := st.rttNanos.Load()
-
-				if total == 0 {
-					fmt.Printf("  %s → no queries\n", ip)
-					continue
+				if p50, p90, p95, p99, ok := stats[i].takePercentiles(); ok {
+					metrics.SetRTTPercentiles(ip, p50, p90, p95, p99)
+				} else {
+					metrics.DeleteRTTPercentiles(ip)
 				}
-				ok := total - fail
-				successPct := float64(ok) / float64(total) * 100
-				avgRTTms := "n/a"
-				if ok > 0 {
-					avgRTTms = fmt.Sprintf("%.2f ms", float64(sumRTT)/float64(ok)/1e6)
+			}
+
+			if checker != nil {
+				checkHealth(ctx, checker, servers, discovered, stats)
+			}
+			if scraper != nil {
+				scrapeCoreDNS(ctx, scraper, servers, discovered, stats)
+			}
+
+			if notifier != nil {
+				for i, ip := range servers {
+					w := stats[i].takeWindow()
+					w.Endpoint, w.Pod = ip, discovered[ip].Pod
+					sendAlert(ctx, notifier, notifier.Evaluate(now, w))
 				}
-				fmt.Printf("  %s → success %.1f %% (%d/%d)  avgRTT %s\n",
-					ip, successPct, ok, total, avgRTTms)
 			}
-			fmt.Println()
+
+			pushMetrics(ctx)
+
+			if heartbeat != nil {
+				if err := heartbeat.Renew(ctx); err != nil {
+					log.Printf("renewing lease: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// sendAlert posts p, if any, in the background so a slow webhook does not hold up
+// the probe loop.
+func sendAlert(ctx context.Context, notifier *alert.Notifier, p *alert.Payload) {
+	if p == nil {
+		return
+	}
+	go func() {
+		if err := notifier.Send(ctx, p); err != nil {
+			log.Printf("sending %s alert for %s: %v", p.Status, p.Endpoint, err)
+		}
+	}()
+}
+
+// lookupIn returns the lookupFunc of the probe loop for the endpoints of
+// discovered, which sends each query to the port of its protocol.
+func lookupIn(discovered map[string]endpoint) lookupFunc {
+	return func(ctx context.Context, addr, proto, name string) ([]string, time.Duration, error) {
+		if proto == protoTruncation {
+			ep := discovered[addr]
+			return lookupTruncated(ctx, ep.hostPort(), ep.hostPortFor("tcp"), name)
 		}
+		return lookupQuery(ctx, discovered[addr].hostPortFor(proto), proto, name)
 	}
 }
 
 type epStats struct {
-	total    atomic.Int64 // total queries
-	fail     atomic.Int64 // failures
-	rttNanos atomic.Int64 // sum of RTT for successes
+	nameStats // all queries to the endpoint
+
+	healthUp atomic.Int32 // last HTTP health check: 1 up, 0 down, -1 not checked
+
+	corednsCounters corednsmetrics.Counters // last scrape of the CoreDNS metrics, guarded by mu
+
+	target    string    // endpoint.Target, which selects the --target-concurrency and --target-max-qps
+	coldUntil time.Time // end of the --coldstart-window of an endpoint that appeared after startup
+
+	next  atomic.Int64 // rotation counter into shardNames
+	names []*nameStats // per shard name, parallel to shardNames
+
+	negative   nameStats // queries for negativeDomain
+	truncation nameStats // queries for truncationDomain
+
+	mu                 sync.Mutex
+	p50, p90, p95, p99 *quantile.P2 // successful RTT in ms for the current summary window
+	reasons            map[criteria.Reason]int64
+
+	// counts at the end of the previous alerting window, guarded by mu
+	lastTotal, lastFail int64
+	lastReasons         map[criteria.Reason]int64
+
+	summaryBase summaryWindow // cumulative counts at the end of the previous summary, guarded by mu
+}
+
+// nameStats counts the queries for one shard name, or the negative name, on one
+// endpoint. The counts are cumulative; summaries report the difference to the
+// previous one. A query is counted once it finished, updating all counts under
+// one lock, so that a copy never has more failures than queries even while
+// probes are running.
+type nameStats struct {
+	mu sync.Mutex
+	c  counts
+}
+
+// counts is a copy of a nameStats, or the difference between two copies.
+type counts struct {
+	total    int64 // total queries
+	fail     int64 // failures
+	slow     int64 // successes slower than the maximum latency
+	rttNanos int64 // sum of RTT for successes
+}
+
+// add counts a finished query with the given status and reason, as returned by
+// criteria.Classify.
+func (n *nameStats) add(status metrics.QueryStatus, reason criteria.Reason, rtt time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.c.total++
+	if status != metrics.QuerySuccess {
+		n.c.fail++
+		return
+	}
+	n.c.rttNanos += rtt.Nanoseconds()
+	if reason == criteria.ReasonSlow {
+		n.c.slow++
+	}
+}
+
+func (n *nameStats) load() counts {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.c
+}
+
+func (c counts) sub(o counts) counts {
+	return counts{total: c.total - o.total, fail: c.fail - o.fail, slow: c.slow - o.slow, rttNanos: c.rttNanos - o.rttNanos}
+}
+
+// summaryWindow holds the counts of an endpoint over one summary window.
+type summaryWindow struct {
+	counts
+	names      []counts // parallel to shardNames
+	negative   counts
+	truncation counts
+	reasons    map[criteria.Reason]int64
+
+	// percentiles of the successful RTT in ms, NaN without successes
+	rttP50, rttP90, rttP99 float64
+}
+
+func newEpStats(shards int) *epStats {
+	s := &epStats{
+		p50:         quantile.NewP2(0.5),
+		p90:         quantile.NewP2(0.9),
+		p95:         quantile.NewP2(0.95),
+		p99:         quantile.NewP2(0.99),
+		names:       make([]*nameStats, shards),
+		reasons:     make(map[criteria.Reason]int64),
+		lastReasons: make(map[criteria.Reason]int64),
+		summaryBase: summaryWindow{names: make([]counts, shards)},
+	}
+	for i := range s.names {
+		s.names[i] = &nameStats{}
+	}
+	s.healthUp.Store(-1)
+	return s
 }
 
-func lookupThrough(addr string) (time.Duration, error) {
-	resolver := &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
-			d := net.Dialer{Timeout: queryTimeout}
-			return d.DialContext(ctx, network, net.JoinHostPort(addr, "53"))
-		},
+// healthSuffix annotates a summary line with the last health check result so
+// DNS failures can be read side by side with CoreDNS's own view of its health.
+func (s *epStats) healthSuffix() string {
+	switch s.healthUp.Load() {
+	case 1:
+		return "  health up"
+	case 0:
+		return "  health down"
+	default:
+		return ""
 	}
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
-	defer cancel()
-	start := time.Now()
-	_, err := resolver.LookupHost(ctx, queryDomain)
-	return time.Since(start), err
+func (s *epStats) recordFailure(reason criteria.Reason) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reasons[reason]++
+}
+
+// failureReasons renders the failure counts by reason since the start, see
+// formatReasons.
+func (s *epStats) failureReasons() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return formatReasons(s.reasons)
+}
+
+// formatReasons renders failure counts by reason, most frequent first, e.g.
+// "timeout: 3, servfail: 1".
+func formatReasons(counts map[criteria.Reason]int64) string {
+	reasons := slices.Collect(maps.Keys(counts))
+	slices.SortFunc(reasons, func(a, b criteria.Reason) int {
+		return cmp.Or(cmp.Compare(counts[b], counts[a]), cmp.Compare(a, b))
+	})
+	parts := make([]string, len(reasons))
+	for i, r := range reasons {
+		parts[i] = fmt.Sprintf("%s: %d", r, counts[r])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// summaryWindow returns the counts since the previous summary. With advance set
+// the next window starts now; on-demand summaries leave it in place.
+func (s *epStats) summaryWindow(advance bool) summaryWindow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := summaryWindow{
+		counts:     s.load(),
+		names:      make([]counts, len(s.names)),
+		negative:   s.negative.load(),
+		truncation: s.truncation.load(),
+		reasons:    maps.Clone(s.reasons),
+	}
+	for i, ns := range s.names {
+		now.names[i] = ns.load()
+	}
+
+	base := s.summaryBase
+	w := summaryWindow{
+		counts:     now.counts.sub(base.counts),
+		names:      make([]counts, len(now.names)),
+		negative:   now.negative.sub(base.negative),
+		truncation: now.truncation.sub(base.truncation),
+		reasons:    make(map[criteria.Reason]int64),
+		// The estimators are reset with the summary too, see takePercentiles.
+		rttP50: s.p50.Value(),
+		rttP90: s.p90.Value(),
+		rttP99: s.p99.Value(),
+	}
+	for i := range now.names {
+		w.names[i] = now.names[i].sub(base.names[i])
+	}
+	for r, n := range now.reasons {
+		if d := n - base.reasons[r]; d > 0 {
+			w.reasons[r] = d
+		}
+	}
+	if advance {
+		s.summaryBase = now
+	}
+	return w
+}
+
+// takeWindow returns the queries, failures and failure reasons since the previous
+// call, for alerting on recent rather than cumulative results.
+func (s *epStats) takeWindow() alert.Window {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.load()
+	total, fail := c.total, c.fail
+	w := alert.Window{Total: total - s.lastTotal, Failed: fail - s.lastFail}
+	for r, n := range s.reasons {
+		if d := n - s.lastReasons[r]; d > 0 {
+			if w.Failures == nil {
+				w.Failures = make(map[string]int64)
+			}
+			w.Failures[string(r)] = d
+		}
+		s.lastReasons[r] = n
+	}
+	s.lastTotal, s.lastFail = total, fail
+	return w
+}
+
+func (s *epStats) observeRTT(rtt time.Duration) {
+	ms := float64(rtt.Nanoseconds()) / 1e6
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.p50.Add(ms)
+	s.p90.Add(ms)
+	s.p95.Add(ms)
+	s.p99.Add(ms)
+}
+
+// takePercentiles returns the RTT percentile estimates for the current window and
+// starts a new one. ok is false if there were no successful queries.
+func (s *epStats) takePercentiles() (p50, p90, p95, p99 float64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.p50.Count() == 0 {
+		return 0, 0, 0, 0, false
+	}
+	p50, p90, p95, p99 = s.p50.Value(), s.p90.Value(), s.p95.Value(), s.p99.Value()
+	s.p50.Reset()
+	s.p90.Reset()
+	s.p95.Reset()
+	s.p99.Reset()
+	return p50, p90, p95, p99, true
+}
+
+// checkHealth HTTP-checks every CoreDNS pod and --servers in the background;
+// results land in stats and the health metric without blocking the probe loop.
+// The ClusterIP is skipped, since the Service does not expose the health port.
+func checkHealth(ctx context.Context, checker *health.Checker, servers []string, discovered map[string]endpoint, stats []*epStats) {
+	for i, ip := range servers {
+		if !discovered[ip].isCoreDNS() {
+			continue
+		}
+		go func(st *epStats, addr string) {
+			err := checker.Check(ctx, addr)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("CoreDNS health check failed: %v", err)
+			}
+			up := err == nil
+			if up {
+				st.healthUp.Store(1)
+			} else {
+				st.healthUp.Store(0)
+			}
+			metrics.SetHealthEndpointUp(addr, up)
+		}(stats[i], ip)
+	}
+}
+
+// scrapeCoreDNS fetches the CoreDNS metrics of every CoreDNS pod and --servers
+// in the background and publishes their rates since the previous scrape, so
+// probe failures can be told apart from CoreDNS load or a slow upstream. The
+// ClusterIP is skipped, since each scrape through it may reach another pod.
+func scrapeCoreDNS(ctx context.Context, scraper *corednsmetrics.Scraper, servers []string, discovered map[string]endpoint, stats []*epStats) {
+	for i, ip := range servers {
+		if !discovered[ip].isCoreDNS() {
+			continue
+		}
+		go func(st *epStats, addr string) {
+			c, err := scraper.Scrape(ctx, addr)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("CoreDNS metrics scrape failed: %v", err)
+					metrics.SetCoreDNSMetricsUp(addr, false)
+				}
+				return
+			}
+			metrics.SetCoreDNSMetricsUp(addr, true)
+			st.mu.Lock()
+			prev := st.corednsCounters
+			st.corednsCounters = c
+			st.mu.Unlock()
+			if prev.Time.IsZero() {
+				return
+			}
+			if r, ok := c.Since(prev); ok {
+				metrics.SetCoreDNSRates(addr, r.RequestsPerSecond, r.CacheHitRatio, r.ForwardSeconds)
+			}
+		}(stats[i], ip)
+	}
 }
 
 func mustClient() *kubernetes.Clientset {
+	cs, err := newClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cs
+}
+
+// newClient uses the in-cluster config when available and KUBECONFIG (or
+// ~/.kube/config) otherwise.
+func newClient() (*kubernetes.Clientset, error) {
 	if cfg, err := rest.InClusterConfig(); err == nil {
-		cs, _ := kubernetes.NewForConfig(cfg)
-		return cs
+		return kubernetes.NewForConfig(cfg)
 	}
 	kubeCfg := os.Getenv("KUBECONFIG")
 	if kubeCfg == "" {
@@ -181,11 +1185,11 @@ func mustClient() *kubernetes.Clientset {
 	}
 	cfg, err := clientcmd.BuildConfigFromFlags("", kubeCfg)
 	if err != nil {
-		log.Fatalf("loading kubeconfig: %v", err)
+		return nil, fmt.Errorf("loading kubeconfig: %w", err)
 	}
 	cs, err := kubernetes.NewForConfig(cfg)
 	if err != nil {
-		log.Fatalf("building clientset: %v", err)
+		return nil, fmt.Errorf("building clientset: %w", err)
 	}
-	return cs
+	return cs, nil
 }
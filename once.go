@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/paulgmiller/corednsprobe/pkg/criteria"
+	"github.com/paulgmiller/corednsprobe/pkg/golden"
+	"github.com/paulgmiller/corednsprobe/pkg/metrics"
+)
+
+// runOnce queries every endpoint a single time for each name, queryDomain or
+// every one of shardNames, and returns an error if any query failed or, with a
+// golden file, if the answers drifted from the snapshot. The queries are recorded
+// in the metrics as well, e.g. for --pushgateway-url.
+func runOnce(ctx context.Context, servers []string, discovered map[string]endpoint) error {
+	names := []string{queryDomain}
+	if len(shardNames) > 0 {
+		names = shardNames
+	}
+	type result struct {
+		answers *golden.Snapshot
+		err     error
+	}
+	results := make([]result, len(servers))
+
+	var wg sync.WaitGroup
+	for i, ip := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].answers = golden.NewSnapshot()
+			// With several names or protocols the endpoint fails on the first
+			// failing query.
+			for _, name := range names {
+				for _, proto := range protocols {
+					label := ip
+					if len(names) > 1 {
+						label += " " + name
+					}
+					if len(protocols) > 1 {
+						label += " " + proto
+					}
+					answers, rtt, err := lookupQuery(ctx, discovered[ip].hostPortFor(proto), proto, name)
+					status, reason := criteriaFor(name).Classify(criteria.Result{Answers: len(answers), Values: answers, RTT: rtt, Err: err})
+					metrics.RecordQuery(ip, metrics.TestPositive, queryType, proto, status, string(reason), rtt)
+					if len(shardNames) > 0 {
+						metrics.RecordNameQuery(ip, name, status, rtt)
+					}
+					switch {
+					case status == metrics.QuerySuccess:
+						// e.g. an allowed NXDOMAIN
+						err = nil
+					case err == nil:
+						err = fmt.Errorf("%s: %s %v after %v", status, reason, answers, rtt)
+					default:
+						err = fmt.Errorf("%s: %w", status, err)
+					}
+					if err != nil {
+						results[i].err = err
+						fmt.Printf("  %s → FAIL %v\n", label, err)
+						return
+					}
+					results[i].answers.Set(name, answers)
+					fmt.Printf("  %s → ok %.2f ms %v\n", label, float64(rtt.Nanoseconds())/1e6, answers)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, r := range results {
+		if r.err != nil {
+			failed = append(failed, servers[i])
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d/%d endpoints failed: %v", len(failed), len(servers), failed)
+	}
+
+	if goldenFile == "" {
+		return nil
+	}
+
+	// Every endpoint must agree before the answers are compared against, or
+	// recorded as, the golden snapshot.
+	got := results[0].answers
+	for i, r := range results[1:] {
+		if diffs := golden.Diff(got, r.answers); len(diffs) > 0 {
+			return fmt.Errorf("endpoints %s and %s disagree: %s", servers[0], servers[i+1], strings.Join(diffs, "; "))
+		}
+	}
+
+	want, err := golden.Read(goldenFile)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := golden.Write(goldenFile, got); err != nil {
+			return err
+		}
+		log.Printf("wrote golden file %s", goldenFile)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if diffs := golden.Diff(want, got); len(diffs) > 0 {
+		return fmt.Errorf("answers differ from golden file %s:\n  %s", goldenFile, strings.Join(diffs, "\n  "))
+	}
+	log.Printf("answers match golden file %s", goldenFile)
+	return nil
+}
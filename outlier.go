@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strings"
+)
+
+// minOutlierEndpoints is the smallest fleet with a meaningful median.
+const minOutlierEndpoints = 3
+
+// Floors of the spread outliers are measured in, so that a fleet of identical
+// endpoints does not flag every small difference: 1 point of success rate and
+// 10% of the median average RTT.
+const (
+	minSuccessSpread = 0.01
+	minRTTSpread     = 0.1
+)
+
+// findOutliers returns, parallel to servers, why each endpoint did worse than the
+// rest of the fleet in its summary window, e.g. "success rate" or "avg RTT", or ""
+// if it did not. An endpoint is an outlier when its success rate is lower, or its
+// average RTT higher, than the fleet median by more than threshold times the
+// spread: the median absolute deviation, scaled to match a standard deviation for
+// normally distributed values, but at least the floors above. Only CoreDNS pods
+// and --servers are compared; the ClusterIP, the baseline resolver and NodeLocal
+// DNSCache are not part of the fleet.
+func findOutliers(servers []string, discovered map[string]endpoint, windows []summaryWindow, threshold float64) []string {
+	reasons := make([]string, len(servers))
+	var fleet []int
+	for i, ip := range servers {
+		if t := discovered[ip].Target; (t == targetPod || t == targetStatic) && windows[i].total > 0 {
+			fleet = append(fleet, i)
+		}
+	}
+	if len(fleet) < minOutlierEndpoints {
+		return reasons
+	}
+
+	success := make([]float64, len(servers))
+	rtt := make([]float64, len(servers))
+	var rtts []float64
+	for _, i := range fleet {
+		w := windows[i]
+		ok := w.total - w.fail
+		success[i] = float64(ok) / float64(w.total)
+		rtt[i] = math.NaN()
+		if ok > 0 {
+			rtt[i] = float64(w.rttNanos) / float64(ok)
+			rtts = append(rtts, rtt[i])
+		}
+	}
+	successes := make([]float64, 0, len(fleet))
+	for _, i := range fleet {
+		successes = append(successes, success[i])
+	}
+	successMedian, successSpread := medianSpread(successes, minSuccessSpread)
+	rttMedian, rttSpread := math.NaN(), math.NaN()
+	if len(rtts) >= minOutlierEndpoints {
+		rttMedian, rttSpread = medianSpread(rtts, 0)
+		rttSpread = max(rttSpread, minRTTSpread*rttMedian)
+	}
+
+	for _, i := range fleet {
+		var why []string
+		if successMedian-success[i] > threshold*successSpread {
+			why = append(why, "success rate")
+		}
+		// Comparisons with NaN are false, so endpoints without successes are
+		// only judged by their success rate.
+		if rtt[i]-rttMedian > threshold*rttSpread {
+			why = append(why, "avg RTT")
+		}
+		reasons[i] = strings.Join(why, ", ")
+	}
+	return reasons
+}
+
+// medianSpread returns the median of values and their median absolute deviation,
+// scaled by 1.4826 to estimate the standard deviation, but at least floor.
+func medianSpread(values []float64, floor float64) (float64, float64) {
+	m := median(values)
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - m)
+	}
+	return m, max(1.4826*median(deviations), floor)
+}
+
+// median returns the median of values, which must not be empty.
+func median(values []float64) float64 {
+	sorted := slices.Sorted(slices.Values(values))
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
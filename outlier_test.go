@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestFindOutliers(t *testing.T) {
+	// window has total queries of which fail failed and an average RTT of avgMs.
+	window := func(total, fail int64, avgMs float64) summaryWindow {
+		return summaryWindow{counts: counts{total: total, fail: fail, rttNanos: int64(avgMs * 1e6 * float64(total-fail))}}
+	}
+	testCases := []struct {
+		name     string
+		windows  []summaryWindow
+		targets  []string // defaults to targetPod
+		expected []string
+	}{
+		{
+			name:     "healthy",
+			windows:  []summaryWindow{window(100, 0, 1.0), window(100, 0, 1.05), window(100, 1, 0.95), window(100, 0, 1.02)},
+			expected: []string{"", "", "", ""},
+		},
+		{
+			name:     "slow",
+			windows:  []summaryWindow{window(100, 0, 1.0), window(100, 0, 1.1), window(100, 0, 9.0), window(100, 0, 0.9)},
+			expected: []string{"", "", "avg RTT", ""},
+		},
+		{
+			name:     "failing",
+			windows:  []summaryWindow{window(100, 40, 1.0), window(100, 0, 1.0), window(100, 0, 1.0)},
+			expected: []string{"success rate", "", ""},
+		},
+		{
+			name:     "failing_and_slow",
+			windows:  []summaryWindow{window(100, 0, 1.0), window(100, 0, 1.0), window(100, 50, 5.0)},
+			expected: []string{"", "", "success rate, avg RTT"},
+		},
+		{
+			name:     "all_failing",
+			windows:  []summaryWindow{window(100, 100, 0), window(100, 0, 1.0), window(100, 0, 1.0)},
+			expected: []string{"success rate", "", ""},
+		},
+		{
+			name:     "better_is_not_flagged",
+			windows:  []summaryWindow{window(100, 0, 0.1), window(100, 0, 1.0), window(100, 0, 1.0)},
+			expected: []string{"", "", ""},
+		},
+		{
+			name:     "too_few",
+			windows:  []summaryWindow{window(100, 50, 9.0), window(100, 0, 1.0)},
+			expected: []string{"", ""},
+		},
+		{
+			name:     "baseline_not_in_fleet",
+			windows:  []summaryWindow{window(100, 0, 1.0), window(100, 0, 1.0), window(100, 0, 1.0), window(100, 0, 20.0)},
+			targets:  []string{targetPod, targetPod, targetPod, targetBaseline},
+			expected: []string{"", "", "", ""},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			servers := make([]string, len(tc.windows))
+			discovered := make(map[string]endpoint)
+			for i := range servers {
+				servers[i] = fmt.Sprintf("10.0.0.%d", i+1)
+				target := targetPod
+				if tc.targets != nil {
+					target = tc.targets[i]
+				}
+				discovered[servers[i]] = endpoint{Addr: servers[i], Target: target}
+			}
+			if got := findOutliers(servers, discovered, tc.windows, 3); !slices.Equal(got, tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
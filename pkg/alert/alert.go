@@ -0,0 +1,160 @@
+// Package alert posts a JSON notification to a webhook when an endpoint's success
+// rate stays below a threshold, and a resolve notification once it recovers.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Notification statuses.
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+)
+
+// Payload is the JSON body posted to the webhook.
+type Payload struct {
+	Status      string           `json:"status"`
+	Endpoint    string           `json:"endpoint"`
+	Pod         string           `json:"pod,omitempty"`
+	SuccessRate float64          `json:"successRate"` // percent over the last window
+	Threshold   float64          `json:"threshold"`   // percent
+	Since       time.Time        `json:"since"`       // when the success rate first dropped below the threshold
+	Duration    string           `json:"duration"`    // how long it has been (or was) below the threshold
+	Failures    map[string]int64 `json:"failures,omitempty"`
+}
+
+// Window is an endpoint's probe results over one evaluation window.
+type Window struct {
+	Endpoint string
+	Pod      string
+	Total    int64
+	Failed   int64
+	Failures map[string]int64 // failure counts by reason
+}
+
+// Notifier tracks per-endpoint failure state and decides when to notify. Each
+// incident produces at most one firing and one resolved notification.
+type Notifier struct {
+	url       string
+	client    *http.Client
+	threshold float64
+	after     time.Duration
+
+	mu     sync.Mutex
+	states map[string]*state
+}
+
+type state struct {
+	badSince time.Time
+	firing   bool
+	window   Window  // the last window with queries, for Forget
+	rate     float64 // its success rate
+}
+
+// NewNotifier returns a Notifier that fires once an endpoint's success rate has been
+// below threshold percent for at least after.
+func NewNotifier(url string, threshold float64, after time.Duration) *Notifier {
+	return &Notifier{
+		url:       url,
+		client:    &http.Client{Timeout: 5 * time.Second},
+		threshold: threshold,
+		after:     after,
+		states:    make(map[string]*state),
+	}
+}
+
+// Evaluate records a window of results and returns the notification to send, if
+// any. Windows without queries leave the state unchanged.
+func (n *Notifier) Evaluate(now time.Time, w Window) *Payload {
+	if w.Total == 0 {
+		return nil
+	}
+	rate := float64(w.Total-w.Failed) / float64(w.Total) * 100
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	st, ok := n.states[w.Endpoint]
+	if !ok {
+		st = &state{}
+		n.states[w.Endpoint] = st
+	}
+	st.window, st.rate = w, rate
+
+	if rate >= n.threshold {
+		if !st.firing {
+			st.badSince = time.Time{}
+			return nil
+		}
+		p := n.payload(StatusResolved, now, st.badSince, rate, w)
+		*st = state{window: w, rate: rate}
+		return p
+	}
+
+	if st.badSince.IsZero() {
+		st.badSince = now
+	}
+	if st.firing || now.Sub(st.badSince) < n.after {
+		return nil
+	}
+	st.firing = true
+	return n.payload(StatusFiring, now, st.badSince, rate, w)
+}
+
+// Forget drops the state of an endpoint that is no longer probed and returns the
+// resolved notification to send if it was firing, since no later window will
+// resolve it. The notification carries the endpoint's last window.
+func (n *Notifier) Forget(now time.Time, endpoint string) *Payload {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	st, ok := n.states[endpoint]
+	if !ok {
+		return nil
+	}
+	delete(n.states, endpoint)
+	if !st.firing {
+		return nil
+	}
+	return n.payload(StatusResolved, now, st.badSince, st.rate, st.window)
+}
+
+func (n *Notifier) payload(status string, now, since time.Time, rate float64, w Window) *Payload {
+	return &Payload{
+		Status:      status,
+		Endpoint:    w.Endpoint,
+		Pod:         w.Pod,
+		SuccessRate: rate,
+		Threshold:   n.threshold,
+		Since:       since,
+		Duration:    now.Sub(since).Round(time.Second).String(),
+		Failures:    w.Failures,
+	}
+}
+
+// Send posts p to the webhook.
+func (n *Notifier) Send(ctx context.Context, p *Payload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("encoding alert: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building alert request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting alert: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("posting alert: unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEvaluate(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	good := Window{Endpoint: "10.0.0.1", Total: 100, Failed: 1}
+	bad := Window{Endpoint: "10.0.0.1", Pod: "coredns-a", Total: 100, Failed: 50, Failures: map[string]int64{"timeout": 50}}
+	idle := Window{Endpoint: "10.0.0.1"}
+
+	steps := []struct {
+		offset   time.Duration
+		window   Window
+		expected string // "" for no notification
+	}{
+		{0, good, ""},
+		{10 * time.Second, bad, ""},  // below threshold, not for long enough
+		{20 * time.Second, idle, ""}, // no queries: state unchanged
+		{30 * time.Second, bad, ""},  // 20s bad
+		{40 * time.Second, bad, StatusFiring},
+		{50 * time.Second, bad, ""}, // already firing: deduplicated
+		{60 * time.Second, good, StatusResolved},
+		{70 * time.Second, good, ""},
+		{80 * time.Second, bad, ""},  // a new incident starts over
+		{90 * time.Second, good, ""}, // recovered before firing: nothing to resolve
+	}
+
+	n := NewNotifier("http://unused", 90, 30*time.Second)
+	for i, step := range steps {
+		p := n.Evaluate(start.Add(step.offset), step.window)
+		got := ""
+		if p != nil {
+			got = p.Status
+		}
+		if got != step.expected {
+			t.Fatalf("step %d at +%v: expected %q, got %q", i, step.offset, step.expected, got)
+		}
+		if p != nil && p.Since != start.Add(10*time.Second) {
+			t.Errorf("step %d: expected incident start %v, got %v", i, start.Add(10*time.Second), p.Since)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	var got Payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected JSON content type, got %s", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decoding payload: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	want := &Payload{Status: StatusFiring, Endpoint: "10.0.0.1", SuccessRate: 50, Threshold: 90, Failures: map[string]int64{"timeout": 5}}
+	if err := NewNotifier(server.URL, 90, time.Minute).Send(context.Background(), want); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got.Endpoint != want.Endpoint || got.Status != want.Status || got.Failures["timeout"] != 5 {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestForget(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	bad := Window{Endpoint: "10.0.0.1", Pod: "coredns-a", Total: 100, Failed: 50}
+
+	n := NewNotifier("http://unused", 90, 0)
+	if p := n.Evaluate(start, bad); p == nil || p.Status != StatusFiring {
+		t.Fatalf("expected a firing notification, got %+v", p)
+	}
+	p := n.Forget(start.Add(time.Minute), bad.Endpoint)
+	if p == nil || p.Status != StatusResolved {
+		t.Fatalf("expected a resolved notification for a removed firing endpoint, got %+v", p)
+	}
+	if p.Pod != "coredns-a" || p.Since != start || p.SuccessRate != 50 {
+		t.Errorf("expected the last window in the resolved notification, got %+v", p)
+	}
+	if p := n.Forget(start.Add(2*time.Minute), bad.Endpoint); p != nil {
+		t.Errorf("expected nothing for a forgotten endpoint, got %+v", p)
+	}
+	if len(n.states) != 0 {
+		t.Errorf("expected no state left, got %d", len(n.states))
+	}
+
+	// An endpoint that comes back starts a new incident.
+	n.Evaluate(start.Add(3*time.Minute), Window{Endpoint: bad.Endpoint, Total: 100, Failed: 1})
+	if p := n.Forget(start.Add(4*time.Minute), bad.Endpoint); p != nil {
+		t.Errorf("expected nothing for an endpoint that was not firing, got %+v", p)
+	}
+}
@@ -0,0 +1,117 @@
+// Package corednsmetrics scrapes the Prometheus metrics CoreDNS exposes via its
+// prometheus plugin (port 9153, /metrics) and condenses them into the few figures
+// that tell an overloaded CoreDNS from a slow upstream.
+package corednsmetrics
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Counters are the totals of a few CoreDNS metrics at one scrape, summed over
+// their labels.
+type Counters struct {
+	Time           time.Time
+	Requests       float64 // coredns_dns_requests_total
+	CacheHits      float64 // coredns_cache_hits_total
+	CacheMisses    float64 // coredns_cache_misses_total
+	ForwardSeconds float64 // sum of coredns_forward_request_duration_seconds
+	Forwards       float64 // count of coredns_forward_request_duration_seconds
+}
+
+// Rates are the activity of CoreDNS between two scrapes. Figures without data,
+// e.g. the cache hit ratio when nothing was looked up, are NaN.
+type Rates struct {
+	RequestsPerSecond float64
+	CacheHitRatio     float64 // hits per cache lookup
+	ForwardSeconds    float64 // mean duration of forwarded requests
+}
+
+// Since returns the rates from prev to c. It reports false if no time passed or
+// a counter went down, e.g. because CoreDNS restarted in between.
+func (c Counters) Since(prev Counters) (Rates, bool) {
+	elapsed := c.Time.Sub(prev.Time).Seconds()
+	requests, hits, misses := c.Requests-prev.Requests, c.CacheHits-prev.CacheHits, c.CacheMisses-prev.CacheMisses
+	forwardSeconds, forwards := c.ForwardSeconds-prev.ForwardSeconds, c.Forwards-prev.Forwards
+	if elapsed <= 0 || requests < 0 || hits < 0 || misses < 0 || forwardSeconds < 0 || forwards < 0 {
+		return Rates{}, false
+	}
+	return Rates{
+		RequestsPerSecond: requests / elapsed,
+		CacheHitRatio:     ratio(hits, hits+misses),
+		ForwardSeconds:    ratio(forwardSeconds, forwards),
+	}, true
+}
+
+func ratio(a, b float64) float64 {
+	if b == 0 {
+		return math.NaN()
+	}
+	return a / b
+}
+
+// Scraper fetches the metrics of CoreDNS pods from a fixed port.
+type Scraper struct {
+	client *http.Client
+	port   int
+}
+
+// NewScraper returns a Scraper for http://<endpoint>:port/metrics with the given
+// per-request timeout.
+func NewScraper(port int, timeout time.Duration) *Scraper {
+	return &Scraper{client: &http.Client{Timeout: timeout}, port: port}
+}
+
+// Scrape fetches the metrics of the CoreDNS at endpoint. Metrics of plugins that
+// are not enabled, such as cache or forward, count as zero.
+func (s *Scraper) Scrape(ctx context.Context, endpoint string) (Counters, error) {
+	url := "http://" + net.JoinHostPort(endpoint, strconv.Itoa(s.port)) + "/metrics"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return Counters{}, fmt.Errorf("building metrics request for %s: %w", endpoint, err)
+	}
+	now := time.Now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return Counters{}, fmt.Errorf("scraping %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Counters{}, fmt.Errorf("scraping %s: unexpected status %s", url, resp.Status)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return Counters{}, fmt.Errorf("parsing metrics from %s: %w", url, err)
+	}
+	c := Counters{
+		Time:        now,
+		Requests:    sum(families["coredns_dns_requests_total"]),
+		CacheHits:   sum(families["coredns_cache_hits_total"]),
+		CacheMisses: sum(families["coredns_cache_misses_total"]),
+	}
+	if f := families["coredns_forward_request_duration_seconds"]; f != nil {
+		for _, m := range f.Metric {
+			c.ForwardSeconds += m.GetHistogram().GetSampleSum()
+			c.Forwards += float64(m.GetHistogram().GetSampleCount())
+		}
+	}
+	return c, nil
+}
+
+// sum adds up the counter values of all series of f, which may be nil.
+func sum(f *dto.MetricFamily) float64 {
+	var total float64
+	for _, m := range f.GetMetric() {
+		total += m.GetCounter().GetValue()
+	}
+	return total
+}
@@ -0,0 +1,96 @@
+package corednsmetrics
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const exposition = `# TYPE coredns_dns_requests_total counter
+coredns_dns_requests_total{server="dns://:53",zone=".",proto="udp",family="1",type="A"} 90
+coredns_dns_requests_total{server="dns://:53",zone=".",proto="udp",family="1",type="AAAA"} 10
+# TYPE coredns_cache_hits_total counter
+coredns_cache_hits_total{server="dns://:53",type="success",zones=".",view=""} 60
+coredns_cache_hits_total{server="dns://:53",type="denial",zones=".",view=""} 15
+# TYPE coredns_cache_misses_total counter
+coredns_cache_misses_total{server="dns://:53",zones=".",view=""} 25
+# TYPE coredns_forward_request_duration_seconds histogram
+coredns_forward_request_duration_seconds_bucket{to="10.0.0.1:53",rcode="NOERROR",le="0.1"} 20
+coredns_forward_request_duration_seconds_bucket{to="10.0.0.1:53",rcode="NOERROR",le="+Inf"} 25
+coredns_forward_request_duration_seconds_sum{to="10.0.0.1:53",rcode="NOERROR"} 1.25
+coredns_forward_request_duration_seconds_count{to="10.0.0.1:53",rcode="NOERROR"} 25
+`
+
+func TestScrape(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			t.Errorf("expected path /metrics, got %s", r.URL.Path)
+		}
+		w.Write([]byte(exposition))
+	}))
+	defer server.Close()
+
+	host, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	c, err := NewScraper(port, time.Second).Scrape(context.Background(), host)
+	if err != nil {
+		t.Fatalf("Scrape: %v", err)
+	}
+	if c.Requests != 100 || c.CacheHits != 75 || c.CacheMisses != 25 || c.ForwardSeconds != 1.25 || c.Forwards != 25 {
+		t.Errorf("unexpected counters %+v", c)
+	}
+}
+
+func TestSince(t *testing.T) {
+	start := time.Now()
+	prev := Counters{Time: start, Requests: 100, CacheHits: 75, CacheMisses: 25, ForwardSeconds: 1.25, Forwards: 25}
+
+	testCases := []struct {
+		name     string
+		cur      Counters
+		expected Rates
+		ok       bool
+	}{
+		{
+			name:     "activity",
+			cur:      Counters{Time: start.Add(10 * time.Second), Requests: 200, CacheHits: 165, CacheMisses: 35, ForwardSeconds: 2.25, Forwards: 35},
+			expected: Rates{RequestsPerSecond: 10, CacheHitRatio: 0.9, ForwardSeconds: 0.1},
+			ok:       true,
+		},
+		{
+			name:     "idle",
+			cur:      Counters{Time: start.Add(10 * time.Second), Requests: 100, CacheHits: 75, CacheMisses: 25, ForwardSeconds: 1.25, Forwards: 25},
+			expected: Rates{RequestsPerSecond: 0, CacheHitRatio: math.NaN(), ForwardSeconds: math.NaN()},
+			ok:       true,
+		},
+		{
+			name: "restarted",
+			cur:  Counters{Time: start.Add(10 * time.Second), Requests: 5},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := tc.cur.Since(prev)
+			if ok != tc.ok {
+				t.Fatalf("expected ok %v, got %v", tc.ok, ok)
+			}
+			if !ok {
+				return
+			}
+			if !equal(got.RequestsPerSecond, tc.expected.RequestsPerSecond) || !equal(got.CacheHitRatio, tc.expected.CacheHitRatio) ||
+				!equal(got.ForwardSeconds, tc.expected.ForwardSeconds) {
+				t.Errorf("expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+// equal compares floats, treating NaN as equal to itself.
+func equal(a, b float64) bool {
+	return a == b || math.IsNaN(a) && math.IsNaN(b) || math.Abs(a-b) < 1e-9
+}
@@ -0,0 +1,194 @@
+// Package criteria decides whether a probe query counts as a success.
+package criteria
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/paulgmiller/corednsprobe/pkg/metrics"
+)
+
+// Response codes as reported by Rcode.
+const (
+	RcodeNoError  = "NOERROR"
+	RcodeNXDomain = "NXDOMAIN"
+	RcodeServFail = "SERVFAIL"
+)
+
+// Result is the observable outcome of a single probe query.
+type Result struct {
+	Answers int
+	Values  []string // the answers as text, checked against ExpectAnswer and AnswerRegex
+	RTT     time.Duration
+	Err     error
+}
+
+// Criteria is the policy a Result must satisfy to be a success: its rcode is one of
+// Rcodes, it has between MinAnswers and MaxAnswers answers, with ExpectAnswer set,
+// one of its values matches it and, with AnswerRegex set, a NOERROR response has
+// values that all match it. A success that arrived after MaxLatency is slow. A
+// zero MaxAnswers or MaxLatency means unbounded.
+type Criteria struct {
+	Rcodes       []string
+	MinAnswers   int
+	MaxAnswers   int
+	ExpectAnswer *regexp.Regexp
+	AnswerRegex  *regexp.Regexp
+	MaxLatency   time.Duration
+}
+
+// Default accepts any NOERROR response that arrives within timeout.
+func Default(timeout time.Duration) Criteria {
+	return Criteria{Rcodes: []string{RcodeNoError}, MaxLatency: timeout}
+}
+
+// ParseExpectAnswer compiles the --expect-answer value: an IP address matches only
+// that exact address, anything else is a regular expression.
+func ParseExpectAnswer(s string) (*regexp.Regexp, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return regexp.MustCompile("^" + regexp.QuoteMeta(addr.String()) + "$"), nil
+	}
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, fmt.Errorf("expected answer %q is neither an IP address nor a regular expression: %w", s, err)
+	}
+	return re, nil
+}
+
+// Reason explains why a query was not a success.
+type Reason string
+
+const (
+	ReasonNone         Reason = ""
+	ReasonTimeout      Reason = "timeout"
+	ReasonConnRefused  Reason = "connection-refused" // nothing listens, e.g. the pod is down
+	ReasonUnreachable  Reason = "unreachable"        // no route to the endpoint
+	ReasonIO           Reason = "io"                 // the response was cut off or malformed
+	ReasonNotTruncated Reason = "not-truncated"      // a truncation test answer fit into UDP
+	ReasonNetwork      Reason = "network"            // any other error without a response
+	ReasonNoData       Reason = "nodata"             // NOERROR without answers, below MinAnswers
+	ReasonAnswerCount  Reason = "answer-count"
+	ReasonWrongAnswer  Reason = "wrong-answer"
+	ReasonBadAnswer    Reason = "bad-answer" // an answer does not match AnswerRegex
+	ReasonCookie       Reason = "cookie-mismatch"
+	ReasonSlow         Reason = "slow"
+)
+
+// ErrMalformed marks a response that could not be parsed.
+var ErrMalformed = errors.New("malformed response")
+
+// ErrCookieMismatch marks a response whose DNS cookie, RFC 7873, does not echo
+// the client cookie of the query or is malformed, so it may be spoofed.
+var ErrCookieMismatch = errors.New("DNS cookie mismatch")
+
+// ErrNotTruncated marks an answer of the truncation test that fit into UDP, so
+// the fallback to TCP could not be checked.
+var ErrNotTruncated = errors.New("UDP response not truncated")
+
+// Evaluate maps a Result to the status recorded in metrics. Timeouts are always
+// QueryTimeout, responses failing the DNS cookie check QueryCookieMismatch and
+// answers not matching AnswerRegex QueryBadAnswer; any other unmet criterion is
+// QueryError. Answers slower than MaxLatency are still a QuerySuccess.
+func (c Criteria) Evaluate(r Result) metrics.QueryStatus {
+	status, _ := c.Classify(r)
+	return status
+}
+
+// Classify is Evaluate that also reports why a query failed. A disallowed rcode is
+// reported as its lower-case name, e.g. "servfail" or "nxdomain", and a query
+// without a response by what went wrong, e.g. ReasonConnRefused. A successful
+// query slower than MaxLatency has ReasonSlow, so it can be counted apart from
+// both failures and fast successes.
+func (c Criteria) Classify(r Result) (metrics.QueryStatus, Reason) {
+	if isTimeout(r.Err) {
+		return metrics.QueryTimeout, ReasonTimeout
+	}
+	if errors.Is(r.Err, ErrCookieMismatch) {
+		return metrics.QueryCookieMismatch, ReasonCookie
+	}
+	if rcode := Rcode(r.Err); !slices.Contains(c.Rcodes, rcode) {
+		if rcode == "" {
+			return metrics.QueryError, transportReason(r.Err)
+		}
+		return metrics.QueryError, Reason(strings.ToLower(rcode))
+	}
+	if r.Answers == 0 && c.MinAnswers > 0 {
+		return metrics.QueryError, ReasonNoData
+	}
+	if r.Answers < c.MinAnswers || (c.MaxAnswers > 0 && r.Answers > c.MaxAnswers) {
+		return metrics.QueryError, ReasonAnswerCount
+	}
+	if c.ExpectAnswer != nil && !slices.ContainsFunc(r.Values, c.ExpectAnswer.MatchString) {
+		return metrics.QueryError, ReasonWrongAnswer
+	}
+	if c.AnswerRegex != nil && r.Err == nil && (len(r.Values) == 0 || !allMatch(c.AnswerRegex, r.Values)) {
+		return metrics.QueryBadAnswer, ReasonBadAnswer
+	}
+	if c.MaxLatency > 0 && r.RTT > c.MaxLatency {
+		return metrics.QuerySuccess, ReasonSlow
+	}
+	return metrics.QuerySuccess, ReasonNone
+}
+
+func allMatch(re *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if !re.MatchString(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// RcodeError reports a response whose code is not NOERROR, e.g. SERVFAIL.
+type RcodeError struct {
+	Rcode string
+}
+
+func (e *RcodeError) Error() string {
+	return "response code " + e.Rcode
+}
+
+// Rcode returns the DNS response code of a query from its error: NOERROR without
+// one, the code of an RcodeError, and "" for timeouts and network errors.
+func Rcode(err error) string {
+	if err == nil {
+		return RcodeNoError
+	}
+	var rcodeErr *RcodeError
+	if errors.As(err, &rcodeErr) {
+		return rcodeErr.Rcode
+	}
+	return ""
+}
+
+// transportReason tells apart why a query that did not time out got no response.
+func transportReason(err error) Reason {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReasonConnRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return ReasonUnreachable
+	case errors.Is(err, ErrMalformed), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ReasonIO
+	case errors.Is(err, ErrNotTruncated):
+		return ReasonNotTruncated
+	}
+	return ReasonNetwork
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
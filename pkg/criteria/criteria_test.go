@@ -0,0 +1,188 @@
+package criteria
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/paulgmiller/corednsprobe/pkg/metrics"
+)
+
+var (
+	nxdomain = &RcodeError{Rcode: RcodeNXDomain}
+	servfail = fmt.Errorf("lookup a.example.: %w", &RcodeError{Rcode: RcodeServFail})
+)
+
+func TestClassify(t *testing.T) {
+	testCases := []struct {
+		name     string
+		criteria Criteria
+		result   Result
+		expected Reason
+	}{
+		{name: "success", criteria: Default(time.Second), result: Result{Answers: 1}, expected: ReasonNone},
+		{name: "timeout", criteria: Default(time.Second), result: Result{Err: context.DeadlineExceeded}, expected: ReasonTimeout},
+		{name: "servfail", criteria: Default(time.Second), result: Result{Err: servfail}, expected: "servfail"},
+		{name: "nxdomain", criteria: Default(time.Second), result: Result{Err: nxdomain}, expected: "nxdomain"},
+		{name: "unexpected_noerror", criteria: Criteria{Rcodes: []string{RcodeNXDomain}}, result: Result{Answers: 1}, expected: "noerror"},
+		{name: "refused", criteria: Default(time.Second), result: Result{Err: &RcodeError{Rcode: "REFUSED"}}, expected: "refused"},
+		{name: "network", criteria: Default(time.Second), result: Result{Err: errors.New("connection refused")}, expected: ReasonNetwork},
+		{name: "connection_refused", criteria: Default(time.Second), result: Result{Err: opError(syscall.ECONNREFUSED)}, expected: ReasonConnRefused},
+		{name: "unreachable", criteria: Default(time.Second), result: Result{Err: opError(syscall.EHOSTUNREACH)}, expected: ReasonUnreachable},
+		{name: "malformed", criteria: Default(time.Second), result: Result{Err: fmt.Errorf("%w: dns: overflow unpacking uint16", ErrMalformed)}, expected: ReasonIO},
+		{name: "cookie_mismatch", criteria: Default(time.Second), result: Result{Err: fmt.Errorf("%w: client cookie %q", ErrCookieMismatch, "00")}, expected: ReasonCookie},
+		{name: "closed", criteria: Default(time.Second), result: Result{Err: io.ErrUnexpectedEOF}, expected: ReasonIO},
+		{name: "answer_count", criteria: Criteria{Rcodes: []string{RcodeNoError}, MinAnswers: 2}, result: Result{Answers: 1}, expected: ReasonAnswerCount},
+		{name: "nodata", criteria: Criteria{Rcodes: []string{RcodeNoError}, MinAnswers: 1}, result: Result{}, expected: ReasonNoData},
+		{name: "nodata_allowed", criteria: Criteria{Rcodes: []string{RcodeNoError}}, result: Result{}, expected: ReasonNone},
+		{name: "slow", criteria: Default(time.Second), result: Result{Answers: 1, RTT: 2 * time.Second}, expected: ReasonSlow},
+		{name: "expected_answer", criteria: Criteria{Rcodes: []string{RcodeNoError}, ExpectAnswer: mustExpect("10.96.0.10")}, result: Result{Answers: 2, Values: []string{"10.96.0.1", "10.96.0.10"}}, expected: ReasonNone},
+		{name: "wrong_answer", criteria: Criteria{Rcodes: []string{RcodeNoError}, ExpectAnswer: mustExpect("10.96.0.10")}, result: Result{Answers: 1, Values: []string{"10.96.0.100"}}, expected: ReasonWrongAnswer},
+		{name: "no_answer", criteria: Criteria{Rcodes: []string{RcodeNoError}, ExpectAnswer: mustExpect(`^10\.96\.`)}, result: Result{}, expected: ReasonWrongAnswer},
+		{name: "answer_regex", criteria: Criteria{Rcodes: []string{RcodeNoError}, AnswerRegex: regexp.MustCompile(`^v=spf1 `)}, result: Result{Answers: 2, Values: []string{"v=spf1 -all", "v=spf1 include:a.example -all"}}, expected: ReasonNone},
+		{name: "bad_answer", criteria: Criteria{Rcodes: []string{RcodeNoError}, AnswerRegex: regexp.MustCompile(`^v=spf1 `)}, result: Result{Answers: 2, Values: []string{"v=spf1 -all", "google-site-verification=abc"}}, expected: ReasonBadAnswer},
+		{name: "bad_answer_nodata", criteria: Criteria{Rcodes: []string{RcodeNoError}, AnswerRegex: regexp.MustCompile(`.`)}, result: Result{}, expected: ReasonBadAnswer},
+		{name: "answer_regex_nxdomain_allowed", criteria: Criteria{Rcodes: []string{RcodeNXDomain}, AnswerRegex: regexp.MustCompile(`.`)}, result: Result{Err: nxdomain}, expected: ReasonNone},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, got := tc.criteria.Classify(tc.result); got != tc.expected {
+				t.Errorf("expected reason %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+// opError is the error a socket read returns for errno.
+func opError(errno syscall.Errno) error {
+	return &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", errno)}
+}
+
+func mustExpect(s string) *regexp.Regexp {
+	re, err := ParseExpectAnswer(s)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+func TestParseExpectAnswer(t *testing.T) {
+	testCases := []struct {
+		expect  string
+		answer  string
+		matches bool
+	}{
+		{expect: "10.0.0.1", answer: "10.0.0.1", matches: true},
+		{expect: "10.0.0.1", answer: "10.0.0.11", matches: false},
+		{expect: "10.0.0.1", answer: "10a0b0c1", matches: false},
+		{expect: "fd00:0::10", answer: "fd00::10", matches: true},
+		{expect: `^10\.96\.\d+\.\d+$`, answer: "10.96.3.4", matches: true},
+		{expect: `^10\.96\.\d+\.\d+$`, answer: "192.0.2.1", matches: false},
+	}
+	for _, tc := range testCases {
+		if got := mustExpect(tc.expect).MatchString(tc.answer); got != tc.matches {
+			t.Errorf("%q matching %q: expected %v, got %v", tc.expect, tc.answer, tc.matches, got)
+		}
+	}
+	if _, err := ParseExpectAnswer("10.0.[0"); err == nil {
+		t.Errorf("expected an error for an invalid regular expression")
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		criteria Criteria
+		result   Result
+		expected metrics.QueryStatus
+	}{
+		{
+			name:     "default_success",
+			criteria: Default(100 * time.Millisecond),
+			result:   Result{Answers: 1, RTT: 5 * time.Millisecond},
+			expected: metrics.QuerySuccess,
+		},
+		{
+			name:     "default_slow_answer",
+			criteria: Default(100 * time.Millisecond),
+			result:   Result{Answers: 1, RTT: 150 * time.Millisecond},
+			expected: metrics.QuerySuccess,
+		},
+		{
+			name:     "deadline_exceeded",
+			criteria: Default(100 * time.Millisecond),
+			result:   Result{RTT: 100 * time.Millisecond, Err: fmt.Errorf("lookup: %w", context.DeadlineExceeded)},
+			expected: metrics.QueryTimeout,
+		},
+		{
+			name:     "dns_timeout",
+			criteria: Default(100 * time.Millisecond),
+			result:   Result{RTT: 100 * time.Millisecond, Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}},
+			expected: metrics.QueryTimeout,
+		},
+		{
+			name:     "default_rejects_nxdomain",
+			criteria: Default(100 * time.Millisecond),
+			result:   Result{RTT: time.Millisecond, Err: nxdomain},
+			expected: metrics.QueryError,
+		},
+		{
+			name:     "nxdomain_allowed",
+			criteria: Criteria{Rcodes: []string{RcodeNXDomain}},
+			result:   Result{RTT: time.Millisecond, Err: nxdomain},
+			expected: metrics.QuerySuccess,
+		},
+		{
+			name:     "servfail",
+			criteria: Criteria{Rcodes: []string{RcodeNoError, RcodeNXDomain}},
+			result:   Result{RTT: time.Millisecond, Err: servfail},
+			expected: metrics.QueryError,
+		},
+		{
+			name:     "too_few_answers",
+			criteria: Criteria{Rcodes: []string{RcodeNoError}, MinAnswers: 2},
+			result:   Result{Answers: 1, RTT: time.Millisecond},
+			expected: metrics.QueryError,
+		},
+		{
+			name:     "too_many_answers",
+			criteria: Criteria{Rcodes: []string{RcodeNoError}, MaxAnswers: 2},
+			result:   Result{Answers: 3, RTT: time.Millisecond},
+			expected: metrics.QueryError,
+		},
+		{
+			name:     "answers_in_range",
+			criteria: Criteria{Rcodes: []string{RcodeNoError}, MinAnswers: 1, MaxAnswers: 3},
+			result:   Result{Answers: 3, RTT: time.Millisecond},
+			expected: metrics.QuerySuccess,
+		},
+		{
+			name:     "bad_answer",
+			criteria: Criteria{Rcodes: []string{RcodeNoError}, AnswerRegex: regexp.MustCompile(`^target\.example\.$`)},
+			result:   Result{Answers: 1, Values: []string{"other.example."}, RTT: time.Millisecond},
+			expected: metrics.QueryBadAnswer,
+		},
+		{
+			name:     "network_error",
+			criteria: Default(100 * time.Millisecond),
+			result:   Result{RTT: time.Millisecond, Err: errors.New("connection refused")},
+			expected: metrics.QueryError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.criteria.Evaluate(tc.result); got != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
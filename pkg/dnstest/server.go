@@ -0,0 +1,178 @@
+// Package dnstest provides an in-process DNS server for tests, so the probe can be
+// exercised end to end without Kubernetes, Docker or a real CoreDNS.
+package dnstest
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Response describes how the server answers queries for a name.
+type Response struct {
+	Rcode   int           // e.g. dns.RcodeSuccess or dns.RcodeServerFailure
+	Answers []string      // IPv4 or IPv6 addresses, returned for A or AAAA queries respectively
+	Delay   time.Duration // how long to wait before answering
+	NoTCP   bool          // leave queries over TCP unanswered, like a firewall blocking TCP DNS
+
+	// ServerCookie is the hex server cookie returned after the client cookie of
+	// queries with a COOKIE option, RFC 7873; "" to return no COOKIE option, like
+	// a server without cookie support.
+	ServerCookie string
+	// ClientCookie is the hex client cookie returned instead of the one of the
+	// query, e.g. to answer like an off-path spoofer that does not know it.
+	ClientCookie string
+}
+
+// Server is a DNS server on the loopback interface, answering over UDP and TCP
+// on the same port. Names without a configured Response get NXDOMAIN. Like CoreDNS,
+// it truncates UDP responses larger than the client accepts and sets the TC bit.
+type Server struct {
+	// Addr is the host:port the server listens on.
+	Addr string
+
+	servers   []*dns.Server
+	mu        sync.Mutex
+	responses map[string]Response
+	queries   atomic.Int64
+	cookie    atomic.Value // string, the COOKIE option of the last query
+}
+
+// Start starts a Server on a random loopback port and stops it when the test ends.
+func Start(t testing.TB) *Server {
+	t.Helper()
+
+	pc, l, err := listen()
+	if err != nil {
+		t.Fatalf("dnstest: listen: %v", err)
+	}
+	s := &Server{
+		Addr:      pc.LocalAddr().String(),
+		responses: make(map[string]Response),
+	}
+	for _, srv := range []*dns.Server{{PacketConn: pc}, {Listener: l}} {
+		started := make(chan struct{})
+		srv.Handler = dns.HandlerFunc(s.serveDNS)
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+		s.servers = append(s.servers, srv)
+	}
+	t.Cleanup(func() {
+		for _, srv := range s.servers {
+			srv.Shutdown()
+		}
+	})
+	return s
+}
+
+// listen binds UDP and TCP to the same random loopback port, retrying if the
+// port picked for UDP is already taken for TCP.
+func listen() (net.PacketConn, net.Listener, error) {
+	var err error
+	for range 10 {
+		var pc net.PacketConn
+		pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return nil, nil, err
+		}
+		var l net.Listener
+		l, err = net.Listen("tcp", pc.LocalAddr().String())
+		if err == nil {
+			return pc, l, nil
+		}
+		pc.Close()
+	}
+	return nil, nil, err
+}
+
+// Handle configures the response for name, which may be given with or without the trailing dot.
+func (s *Server) Handle(name string, r Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[dns.Fqdn(name)] = r
+}
+
+// Queries returns the number of queries received so far.
+func (s *Server) Queries() int64 {
+	return s.queries.Load()
+}
+
+// LastCookie returns the hex COOKIE option of the last query, "" without one.
+func (s *Server) LastCookie() string {
+	cookie, _ := s.cookie.Load().(string)
+	return cookie
+}
+
+func (s *Server) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.queries.Add(1)
+	clientCookie := ""
+	if opt := req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+				clientCookie = c.Cookie
+			}
+		}
+	}
+	s.cookie.Store(clientCookie)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if len(req.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		w.WriteMsg(m)
+		return
+	}
+	q := req.Question[0]
+
+	s.mu.Lock()
+	r, ok := s.responses[q.Name]
+	s.mu.Unlock()
+	if !ok {
+		m.Rcode = dns.RcodeNameError
+		w.WriteMsg(m)
+		return
+	}
+
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	if r.NoTCP && !udp {
+		return
+	}
+	time.Sleep(r.Delay)
+	m.Rcode = r.Rcode
+	if r.ServerCookie != "" && clientCookie != "" {
+		// The client cookie is the first 8 bytes of the option, 16 hex digits.
+		client := clientCookie[:min(16, len(clientCookie))]
+		if r.ClientCookie != "" {
+			client = r.ClientCookie
+		}
+		m.SetEdns0(req.IsEdns0().UDPSize(), false)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: client + r.ServerCookie})
+	}
+	for _, a := range r.Answers {
+		ip := net.ParseIP(a)
+		hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: 30}
+		switch {
+		case ip == nil:
+			continue
+		case ip.To4() != nil && q.Qtype == dns.TypeA:
+			hdr.Rrtype = dns.TypeA
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip})
+		case ip.To4() == nil && q.Qtype == dns.TypeAAAA:
+			hdr.Rrtype = dns.TypeAAAA
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	if udp {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		m.Truncate(size)
+	}
+	w.WriteMsg(m)
+}
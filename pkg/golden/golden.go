@@ -0,0 +1,99 @@
+// Package golden stores CoreDNS answers in a JSON snapshot and compares later
+// runs against it, so the probe can act as a CoreDNS regression harness.
+//
+// The file format is:
+//
+//	{
+//	  "answers": {
+//	    "kubernetes.default.svc.cluster.local": ["10.96.0.1"]
+//	  }
+//	}
+//
+// where each query name maps to its answers sorted lexically. Answers are
+// compared as sets, so neither their order nor repeated records count as a change.
+package golden
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+)
+
+// Snapshot holds the answers for a set of query names.
+type Snapshot struct {
+	Answers map[string][]string `json:"answers"`
+}
+
+// NewSnapshot returns an empty Snapshot.
+func NewSnapshot() *Snapshot {
+	return &Snapshot{Answers: make(map[string][]string)}
+}
+
+// Set records the answers for name as a sorted set.
+func (s *Snapshot) Set(name string, answers []string) {
+	s.Answers[name] = answerSet(answers)
+}
+
+// answerSet returns answers sorted and without duplicates.
+func answerSet(answers []string) []string {
+	sorted := slices.Clone(answers)
+	sort.Strings(sorted)
+	return slices.Compact(sorted)
+}
+
+// Read loads a Snapshot from path. The returned error wraps os.ErrNotExist if the
+// file does not exist yet.
+func Read(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading golden file: %w", err)
+	}
+	s := NewSnapshot()
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("parsing golden file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Write stores s at path as indented JSON.
+func Write(path string, s *Snapshot) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding golden file: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing golden file: %w", err)
+	}
+	return nil
+}
+
+// Diff returns one human-readable line per query name whose answer sets differ
+// between want and got, sorted by name, also for hand-edited files that are not
+// sorted. An empty result means the snapshots match.
+func Diff(want, got *Snapshot) []string {
+	names := make(map[string]struct{})
+	for name := range want.Answers {
+		names[name] = struct{}{}
+	}
+	for name := range got.Answers {
+		names[name] = struct{}{}
+	}
+
+	var diffs []string
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		w, inWant := want.Answers[name]
+		g, inGot := got.Answers[name]
+		switch {
+		case !inWant:
+			diffs = append(diffs, fmt.Sprintf("%s: unexpected query, got %v", name, g))
+		case !inGot:
+			diffs = append(diffs, fmt.Sprintf("%s: missing, want %v", name, w))
+		case !slices.Equal(answerSet(w), answerSet(g)):
+			diffs = append(diffs, fmt.Sprintf("%s: want %v, got %v", name, w, g))
+		}
+	}
+	return diffs
+}
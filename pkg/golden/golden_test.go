@@ -0,0 +1,92 @@
+package golden
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	testCases := []struct {
+		name     string
+		want     map[string][]string
+		got      map[string][]string
+		expected []string
+	}{
+		{
+			name:     "match_ignores_order",
+			want:     map[string][]string{"a.example.": {"10.0.0.1", "10.0.0.2"}},
+			got:      map[string][]string{"a.example.": {"10.0.0.2", "10.0.0.1"}},
+			expected: nil,
+		},
+		{
+			name:     "match_ignores_duplicates",
+			want:     map[string][]string{"a.example.": {"10.0.0.1", "10.0.0.2"}},
+			got:      map[string][]string{"a.example.": {"10.0.0.2", "10.0.0.1", "10.0.0.2"}},
+			expected: nil,
+		},
+		{
+			name:     "changed_answer",
+			want:     map[string][]string{"a.example.": {"10.0.0.1"}},
+			got:      map[string][]string{"a.example.": {"10.0.0.9"}},
+			expected: []string{"a.example.: want [10.0.0.1], got [10.0.0.9]"},
+		},
+		{
+			name: "missing_and_unexpected",
+			want: map[string][]string{"a.example.": {"10.0.0.1"}},
+			got:  map[string][]string{"b.example.": {"10.0.0.2"}},
+			expected: []string{
+				"a.example.: missing, want [10.0.0.1]",
+				"b.example.: unexpected query, got [10.0.0.2]",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Diff(snapshot(tc.want), snapshot(tc.got))
+			if !slices.Equal(got, tc.expected) {
+				t.Errorf("expected diffs %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDiffUnsortedFile(t *testing.T) {
+	// As read from a hand-edited file, without Set.
+	want := &Snapshot{Answers: map[string][]string{"a.example.": {"10.0.0.2", "10.0.0.1"}}}
+	got := snapshot(map[string][]string{"a.example.": {"10.0.0.1", "10.0.0.2"}})
+	if diffs := Diff(want, got); len(diffs) != 0 {
+		t.Errorf("expected unsorted answers in the file to match, got %q", diffs)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "golden.json")
+
+	if _, err := Read(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist for missing file, got %v", err)
+	}
+
+	want := snapshot(map[string][]string{"a.example.": {"10.0.0.2", "10.0.0.1"}})
+	if err := Write(path, want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	got, err := Read(path)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if diffs := Diff(want, got); len(diffs) != 0 {
+		t.Errorf("round trip changed snapshot: %q", diffs)
+	}
+}
+
+func snapshot(answers map[string][]string) *Snapshot {
+	s := NewSnapshot()
+	for name, a := range answers {
+		s.Set(name, a)
+	}
+	return s
+}
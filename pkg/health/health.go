@@ -0,0 +1,47 @@
+// Package health checks the HTTP health endpoints CoreDNS exposes via its
+// health (port 8080, /health) and ready (port 8181, /ready) plugins.
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Checker issues HTTP GETs against a fixed port and path on each endpoint.
+type Checker struct {
+	client *http.Client
+	port   int
+	path   string
+}
+
+// NewChecker returns a Checker for http://<endpoint>:port/path with the given per-request timeout.
+func NewChecker(port int, path string, timeout time.Duration) *Checker {
+	return &Checker{
+		client: &http.Client{Timeout: timeout},
+		port:   port,
+		path:   path,
+	}
+}
+
+// Check returns nil if the endpoint answered with a 2xx status. Endpoints that do not
+// listen on the health port surface as a connection error rather than a panic or hang.
+func (c *Checker) Check(ctx context.Context, endpoint string) error {
+	url := "http://" + net.JoinHostPort(endpoint, strconv.Itoa(c.port)) + c.path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("building health request for %s: %w", endpoint, err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("health check %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("health check %s: unexpected status %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package health
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	testCases := []struct {
+		name      string
+		path      string
+		status    int
+		expectErr bool
+	}{
+		{name: "healthy", path: "/health", status: http.StatusOK},
+		{name: "not_ready", path: "/ready", status: http.StatusServiceUnavailable, expectErr: true},
+		{name: "wrong_path", path: "/missing", status: http.StatusNotFound, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != tc.path {
+					t.Errorf("expected path %s, got %s", tc.path, r.URL.Path)
+				}
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			host, port := splitAddr(t, server.Listener.Addr().String())
+			err := NewChecker(port, tc.path, time.Second).Check(context.Background(), host)
+			if tc.expectErr && err == nil {
+				t.Errorf("expected error, got nil")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckClosedPort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	host, port := splitAddr(t, l.Addr().String())
+	l.Close()
+
+	if err := NewChecker(port, "/health", time.Second).Check(context.Background(), host); err == nil {
+		t.Errorf("expected error for endpoint without health port, got nil")
+	}
+}
+
+func splitAddr(t *testing.T, addr string) (string, int) {
+	t.Helper()
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("splitting %s: %v", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatalf("parsing port %s: %v", portStr, err)
+	}
+	return host, port
+}
@@ -0,0 +1,125 @@
+// Package lease publishes a coordination.k8s.io Lease so running probes can be
+// observed with `kubectl get leases`.
+package lease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+// ErrHeld is returned by Renew while another identity holds the Lease.
+var ErrHeld = errors.New("held by another probe")
+
+// Heartbeat maintains a single Lease holding the probe's identity and last renew time.
+type Heartbeat struct {
+	client    coordinationclient.LeasesGetter
+	namespace string
+	name      string
+	identity  string
+	duration  time.Duration
+}
+
+// NewHeartbeat returns a Heartbeat for the Lease namespace/name. The duration is
+// published as the Lease's leaseDurationSeconds so observers can tell when a
+// probe has stopped renewing.
+func NewHeartbeat(client coordinationclient.LeasesGetter, namespace, name, identity string, duration time.Duration) *Heartbeat {
+	return &Heartbeat{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		identity:  identity,
+		duration:  duration,
+	}
+}
+
+// Renew creates the Lease if it does not exist and otherwise bumps its renew time.
+// A Lease held by another identity is only taken over once its holder stopped
+// renewing it for its duration; until then Renew returns ErrHeld. Updates carry
+// the resource version that was read, so two probes cannot both take it over.
+func (h *Heartbeat) Renew(ctx context.Context) error {
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(h.duration.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	leases := h.client.Leases(h.namespace)
+	lease, err := leases.Get(ctx, h.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: h.name, Namespace: h.namespace},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &h.identity,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		if _, err := leases.Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("creating lease %s/%s: %w", h.namespace, h.name, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting lease %s/%s: %w", h.namespace, h.name, err)
+	}
+
+	if !h.holds(lease) {
+		if !expired(lease, now.Time) {
+			return fmt.Errorf("renewing lease %s/%s: %w: %s", h.namespace, h.name, ErrHeld, *lease.Spec.HolderIdentity)
+		}
+		lease.Spec.AcquireTime = &now
+	}
+	lease.Spec.HolderIdentity = &h.identity
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.RenewTime = &now
+	if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("updating lease %s/%s: %w", h.namespace, h.name, err)
+	}
+	return nil
+}
+
+// Release deletes the Lease while h holds it. A Lease that is already gone, or
+// that another identity holds or took over meanwhile, is left alone.
+func (h *Heartbeat) Release(ctx context.Context) error {
+	leases := h.client.Leases(h.namespace)
+	lease, err := leases.Get(ctx, h.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting lease %s/%s: %w", h.namespace, h.name, err)
+	}
+	if !h.holds(lease) {
+		return nil
+	}
+	err = leases.Delete(ctx, h.name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &lease.UID, ResourceVersion: &lease.ResourceVersion},
+	})
+	if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+		return fmt.Errorf("deleting lease %s/%s: %w", h.namespace, h.name, err)
+	}
+	return nil
+}
+
+// holds reports whether h is the holder of lease.
+func (h *Heartbeat) holds(lease *coordinationv1.Lease) bool {
+	return lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == h.identity
+}
+
+// expired reports whether the holder of lease stopped renewing it for longer than
+// its duration by now. A Lease without a holder or renew time is free.
+func expired(lease *coordinationv1.Lease, now time.Time) bool {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return now.After(spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second))
+}
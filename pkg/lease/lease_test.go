@@ -0,0 +1,102 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHeartbeat(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	hb := NewHeartbeat(client.CoordinationV1(), "kube-system", "coredns-probe", "probe-a", 30*time.Second)
+
+	if err := hb.Renew(ctx); err != nil {
+		t.Fatalf("first Renew: %v", err)
+	}
+	lease, err := client.CoordinationV1().Leases("kube-system").Get(ctx, "coredns-probe", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("lease not created: %v", err)
+	}
+	if got := *lease.Spec.HolderIdentity; got != "probe-a" {
+		t.Errorf("holder identity: expected probe-a, got %s", got)
+	}
+	if got := *lease.Spec.LeaseDurationSeconds; got != 30 {
+		t.Errorf("lease duration: expected 30, got %d", got)
+	}
+	firstRenew := lease.Spec.RenewTime.Time
+
+	time.Sleep(time.Millisecond)
+	if err := hb.Renew(ctx); err != nil {
+		t.Fatalf("second Renew: %v", err)
+	}
+	lease, err = client.CoordinationV1().Leases("kube-system").Get(ctx, "coredns-probe", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting lease: %v", err)
+	}
+	if !lease.Spec.RenewTime.Time.After(firstRenew) {
+		t.Errorf("renew time was not bumped: %v <= %v", lease.Spec.RenewTime.Time, firstRenew)
+	}
+
+	if err := hb.Release(ctx); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	_, err = client.CoordinationV1().Leases("kube-system").Get(ctx, "coredns-probe", metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected lease to be deleted, got err=%v", err)
+	}
+
+	if err := hb.Release(ctx); err != nil {
+		t.Errorf("Release of missing lease should succeed, got %v", err)
+	}
+}
+
+func TestHeartbeatTwoIdentities(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	leases := client.CoordinationV1().Leases("kube-system")
+	a := NewHeartbeat(client.CoordinationV1(), "kube-system", "coredns-probe", "probe-a", 30*time.Second)
+	b := NewHeartbeat(client.CoordinationV1(), "kube-system", "coredns-probe", "probe-b", 30*time.Second)
+
+	if err := a.Renew(ctx); err != nil {
+		t.Fatalf("Renew probe-a: %v", err)
+	}
+	if err := b.Renew(ctx); !errors.Is(err, ErrHeld) {
+		t.Errorf("expected probe-b not to take over a renewed lease, got err=%v", err)
+	}
+	if err := b.Release(ctx); err != nil {
+		t.Fatalf("Release probe-b: %v", err)
+	}
+	lease, err := leases.Get(ctx, "coredns-probe", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the lease of probe-a to survive the release of probe-b: %v", err)
+	}
+	if got := *lease.Spec.HolderIdentity; got != "probe-a" {
+		t.Errorf("holder identity: expected probe-a, got %s", got)
+	}
+
+	// probe-a stops renewing, so probe-b takes over once the duration elapsed.
+	stale := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	lease.Spec.RenewTime = &stale
+	if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("updating lease: %v", err)
+	}
+	if err := b.Renew(ctx); err != nil {
+		t.Fatalf("expected probe-b to take over an expired lease, got %v", err)
+	}
+	if err := a.Release(ctx); err != nil {
+		t.Fatalf("Release probe-a: %v", err)
+	}
+	lease, err = leases.Get(ctx, "coredns-probe", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the lease of probe-b to survive the release of probe-a: %v", err)
+	}
+	if got := *lease.Spec.HolderIdentity; got != "probe-b" {
+		t.Errorf("holder identity: expected probe-b, got %s", got)
+	}
+}
@@ -3,11 +3,22 @@ package metrics
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -18,28 +29,878 @@ const (
 	QuerySuccess QueryStatus = "success"
 	QueryTimeout QueryStatus = "timeout"
 	QueryError   QueryStatus = "error"
+	// QueryCycleTimeout marks queries cancelled because the probe cycle as a whole ran too long.
+	QueryCycleTimeout QueryStatus = "cycle_timeout"
+	// QueryBadAnswer marks responses whose answers do not match --answer-regex.
+	QueryBadAnswer QueryStatus = "bad_answer"
+	// QueryCookieMismatch marks responses failing the DNS cookie check of --dns-cookies.
+	QueryCookieMismatch QueryStatus = "cookie_mismatch"
 )
 
-var rttHistogram = prometheus.NewHistogramVec(
+// Kinds of probe queries, reported in the test label of the query metrics.
+const (
+	TestPositive   = "positive"   // the configured name, expected to resolve
+	TestNegative   = "negative"   // a nonexistent name, expected to return NXDOMAIN
+	TestTruncation = "truncation" // a name with a large answer, retried over TCP after a truncated UDP response
+)
+
+// DefaultRTTBuckets are the upper bounds in milliseconds of the RTT histograms
+// unless SetRTTBuckets changes them.
+var DefaultRTTBuckets = []float64{0.5, 1, 1.5, 2, 2.5, 3, 3.5, 4, 4.5, 5, 10, 20, 50, 100, 200, 500, 1000}
+
+// rttOpts holds the bucket settings of the RTT histograms, changed by
+// SetRTTBuckets and EnableNativeHistograms.
+var rttOpts = prometheus.HistogramOpts{Buckets: DefaultRTTBuckets}
+
+var (
+	rttHistogram       = newRTTHistogram(rttOpts)
+	nameRTTHistogram   = newNameRTTHistogram(rttOpts)
+	coldStartHistogram = newColdStartHistogram(rttOpts)
+)
+
+func newRTTHistogram(opts prometheus.HistogramOpts) *prometheus.HistogramVec {
+	opts.Name = "coredns_probe_rtt_milliseconds"
+	opts.Help = "Histogram of round-trip time for DNS queries in milliseconds"
+	return prometheus.NewHistogramVec(opts, []string{"endpoint", "test", "type", "proto", "status"})
+}
+
+// nameLabel is the label of the query name in nameRTTHistogram, changed by
+// UseDomainLabel.
+var nameLabel = "name"
+
+func newNameRTTHistogram(opts prometheus.HistogramOpts) *prometheus.HistogramVec {
+	opts.Name = "coredns_probe_name_rtt_milliseconds"
+	opts.Help = "Histogram of round-trip time for DNS queries in milliseconds by query name, when rotating through shard names"
+	return prometheus.NewHistogramVec(opts, []string{"endpoint", nameLabel, "status"})
+}
+
+// UseDomainLabel labels the query name of coredns_probe_name_rtt_milliseconds
+// domain rather than name, for names given as a --query-domain list. Like
+// SetClusterName it must be called before Register.
+func UseDomainLabel() {
+	nameLabel = "domain"
+	nameRTTHistogram = newNameRTTHistogram(rttOpts)
+}
+
+func newColdStartHistogram(opts prometheus.HistogramOpts) *prometheus.HistogramVec {
+	opts.Name = "coredns_probe_coldstart_rtt_milliseconds"
+	opts.Help = "Histogram of round-trip time in milliseconds of the DNS queries to CoreDNS endpoints during their --coldstart-window after they appeared"
+	return prometheus.NewHistogramVec(opts, []string{"proto", "status"})
+}
+
+// SetRTTBuckets replaces the bucket upper bounds, in milliseconds, of the RTT
+// histograms. Like SetClusterName it must be called before Register.
+func SetRTTBuckets(buckets []float64) error {
+	if len(buckets) == 0 {
+		return errors.New("no RTT buckets")
+	}
+	for i, b := range buckets {
+		if b <= 0 || i > 0 && b <= buckets[i-1] {
+			return fmt.Errorf("RTT buckets must be positive and increasing, got %v", buckets)
+		}
+	}
+	rttOpts.Buckets = buckets
+	rttHistogram, nameRTTHistogram, coldStartHistogram = newRTTHistogram(rttOpts), newNameRTTHistogram(rttOpts), newColdStartHistogram(rttOpts)
+	return nil
+}
+
+// EnableNativeHistograms makes the RTT histograms also keep native histograms,
+// whose exponential buckets grow by at most 10% each, next to the classic buckets.
+// Scrapers that negotiate the protobuf format get both; the text formats carry
+// the classic buckets only. Like SetClusterName it must be called before Register.
+func EnableNativeHistograms() {
+	rttOpts.NativeHistogramBucketFactor = 1.1
+	// Bounds the memory of a series; when exceeded, the resolution is reduced, or
+	// the histogram reset if the last reset was at least an hour ago.
+	rttOpts.NativeHistogramMaxBucketNumber = 160
+	rttOpts.NativeHistogramMinResetDuration = time.Hour
+	rttHistogram, nameRTTHistogram, coldStartHistogram = newRTTHistogram(rttOpts), newNameRTTHistogram(rttOpts), newColdStartHistogram(rttOpts)
+}
+
+var dialDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "coredns_probe_dial_duration_seconds",
+		Help:    "Histogram of the time to open the connection for a DNS probe query, including the TCP and TLS handshakes, by endpoint and protocol",
+		Buckets: []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+	},
+	[]string{"endpoint", "proto"},
+)
+
+var connectionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "coredns_probe_connections_total",
+		Help: "Total number of connections opened for DNS probe queries over tcp, dot or doh with --reuse-connections, by endpoint and protocol",
+	},
+	[]string{"endpoint", "proto"},
+)
+
+var connectionReusesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "coredns_probe_connection_reuses_total",
+		Help: "Total number of DNS probe queries sent over a connection kept open from an earlier query with --reuse-connections, by endpoint and protocol",
+	},
+	[]string{"endpoint", "proto"},
+)
+
+var phaseDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "coredns_probe_phase_duration_seconds",
+		Help:    "Histogram of the time to send a DNS probe query (write) and then to receive its response (read), by endpoint, protocol and phase; only with --phase-latency",
+		Buckets: []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+	},
+	[]string{"endpoint", "proto", "phase"},
+)
+
+var answerCount = prometheus.NewHistogramVec(
 	prometheus.HistogramOpts{
-		Name:    "coredns_probe_rtt_milliseconds",
-		Help:    "Histogram of round-trip time for DNS queries in milliseconds",
-		Buckets: []float64{0.5, 1, 1.5, 2, 2.5, 3, 3.5, 4, 4.5, 5, 10, 20, 50, 100, 200, 500, 1000},
+		Name:    "coredns_probe_answer_count",
+		Help:    "Histogram of the number of answers in NOERROR responses to positive DNS probe queries, by endpoint and query name",
+		Buckets: []float64{0, 1, 2, 4, 8, 16, 32, 64},
+	},
+	[]string{"endpoint", "domain"},
+)
+
+var responseSize = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "coredns_probe_response_size_bytes",
+		Help:    "Histogram of the size of DNS probe responses in wire format, by endpoint and protocol",
+		Buckets: []float64{64, 128, 256, 512, 1024, 1232, 1452, 2048, 4096, 8192, 16384, 65535},
+	},
+	[]string{"endpoint", "proto"},
+)
+
+var searchQueries = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "coredns_probe_search_queries",
+		Help:    "Histogram of the number of queries a lookup took when resolving through the search list, by endpoint",
+		Buckets: []float64{1, 2, 3, 4, 5, 6, 7, 8},
+	},
+	[]string{"endpoint"},
+)
+
+var queriesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "coredns_probe_queries_total",
+		Help: "Total number of DNS probe queries by endpoint, test, status and, for failures, reason",
+	},
+	[]string{"endpoint", "test", "status", "reason"},
+)
+
+var slowQueriesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "coredns_probe_slow_queries_total",
+		Help: "Total number of successful DNS probe queries that took longer than the configured maximum latency",
+	},
+	[]string{"endpoint"},
+)
+
+var truncationTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "coredns_probe_truncation_total",
+		Help: "Total number of truncated UDP responses to the truncation test by endpoint and whether the retry over TCP got a response",
+	},
+	[]string{"endpoint", "fallback"},
+)
+
+var retriesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "coredns_probe_retries_total",
+		Help: "Total number of DNS probe query attempts that got no response, or SERVFAIL, and were retried",
 	},
-	[]string{"endpoint", "status"},
+	[]string{"endpoint"},
+)
+
+var servfailTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "coredns_probe_servfail_total",
+		Help: "Total number of SERVFAIL responses to DNS probe query attempts, including those that were retried",
+	},
+	[]string{"endpoint"},
+)
+
+var lastSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "coredns_probe_last_success_timestamp_seconds",
+		Help: "Time of the last successful DNS probe query to the endpoint since unix epoch in seconds",
+	},
+	[]string{"endpoint"},
+)
+
+var up = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "coredns_probe_up",
+		Help: "Whether the most recent positive DNS probe query to the endpoint succeeded (1) or not (0)",
+	},
+	[]string{"endpoint"},
+)
+
+var inflight = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "coredns_probe_inflight",
+		Help: "Number of DNS probe queries to the endpoint that were sent and have not completed yet",
+	},
+	[]string{"endpoint"},
+)
+
+var (
+	rttP50 = newRTTQuantileGauge("coredns_probe_rtt_p50_milliseconds", "50th")
+	rttP90 = newRTTQuantileGauge("coredns_probe_rtt_p90_milliseconds", "90th")
+	rttP95 = newRTTQuantileGauge("coredns_probe_rtt_p95_milliseconds", "95th")
+	rttP99 = newRTTQuantileGauge("coredns_probe_rtt_p99_milliseconds", "99th")
+)
+
+var healthEndpointUp = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "coredns_probe_health_endpoint_up",
+		Help: "Whether the CoreDNS HTTP health/ready endpoint answered with a 2xx status on the last check (1) or not (0)",
+	},
+	[]string{"endpoint"},
+)
+
+var corednsMetricsUp = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "coredns_probe_coredns_metrics_up",
+		Help: "Whether the CoreDNS metrics endpoint of the probed endpoint could be scraped on the last attempt (1) or not (0)",
+	},
+	[]string{"endpoint"},
+)
+
+var corednsRequestsPerSecond = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "coredns_probe_coredns_requests_per_second",
+		Help: "Requests per second CoreDNS reported handling between its last two scrapes, from coredns_dns_requests_total",
+	},
+	[]string{"endpoint"},
+)
+
+var corednsCacheHitRatio = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "coredns_probe_coredns_cache_hit_ratio",
+		Help: "Share of CoreDNS cache lookups that hit between its last two scrapes, from coredns_cache_hits_total and coredns_cache_misses_total",
+	},
+	[]string{"endpoint"},
+)
+
+var corednsForwardSeconds = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "coredns_probe_coredns_forward_duration_seconds",
+		Help: "Mean duration of the requests CoreDNS forwarded upstream between its last two scrapes, from coredns_forward_request_duration_seconds",
+	},
+	[]string{"endpoint"},
+)
+
+var outlier = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "coredns_probe_outlier",
+		Help: "Whether the endpoint's success rate or average RTT stood out from the other endpoints in the last summary window (1) or not (0)",
+	},
+	[]string{"endpoint"},
+)
+
+var endpointReady = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "coredns_probe_endpoint_ready",
+		Help: "Whether the probed endpoint was ready (1) or not ready (0) in its EndpointSlice when discovered",
+	},
+	[]string{"endpoint"},
+)
+
+var endpointInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "coredns_probe_endpoint_info",
+		Help: "Always 1; maps each probed endpoint to its backing pod, node and zone, address family and target kind (pod, service, static, baseline or nodelocal)",
+	},
+	[]string{"endpoint", "pod", "node", "zone", "family", "target"},
+)
+
+var loopDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "coredns_probe_loop_duration_seconds",
+	Help:    "Histogram of the time one probe cycle across all endpoints took, from sending the first query until the last one completed",
+	Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.15, 0.2, 0.3, 0.5, 1, 2.5, 5},
+})
+
+var discoveryErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "coredns_probe_discovery_errors_total",
+	Help: "Total number of failed discovery (EndpointSlice or Endpoints) calls to the Kubernetes API server",
+})
+
+var endpointDrift = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "coredns_probe_endpoint_drift_total",
+	Help: "Total number of probed endpoints found missing, changed or stale when reconciling them with a fresh EndpointSlice list, e.g. after a missed watch event",
+})
+
+var throttledQueries = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "coredns_probe_queries_throttled_total",
+	Help: "Total number of probe queries skipped because --max-qps would have delayed them past the end of the probe cycle, --max-cycle-duration or else --loop-interval",
+})
+
+var discoveryDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "coredns_probe_discovery_duration_seconds",
+	Help:    "Histogram of the duration of EndpointSlice list calls to the Kubernetes API server, successful or not",
+	Buckets: prometheus.DefBuckets,
+})
+
+var queriesSentPerSecond = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "coredns_probe_queries_sent_per_second",
+	Help: "DNS queries per second the probe sent to CoreDNS across all endpoints over the last summary window",
+})
+
+var clusterSuccessRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "coredns_probe_cluster_success_ratio",
+	Help: "Weighted mean of the success ratios of the positive queries to each endpoint over the last summary window, with the weights of --endpoint-weight",
+})
+
+var degraded = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "coredns_probe_degraded",
+	Help: "Whether the DNS client failed to initialize and queries fall back to the Go resolver without query options, retries, search domains or the truncation test (1) or not (0)",
+})
+
+var startTime = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "coredns_probe_start_time_seconds",
+	Help: "Start time of the probe process since unix epoch in seconds",
+})
+
+var buildInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "coredns_probe_build_info",
+		Help: "Always 1; carries the version and commit the probe was built from and the Go version it was built with",
+	},
+	[]string{"version", "commit", "go_version"},
+)
+
+func newRTTQuantileGauge(name, percentile string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: name,
+			Help: "Streaming estimate of the " + percentile + " percentile of successful DNS query RTT in milliseconds over the last summary window",
+		},
+		[]string{"endpoint"},
+	)
+}
+
+// RecordQuery records statistics for a single DNS probe query of record type qtype
+// sent over proto, "udp", "tcp", "dot", "doh" or, for TestTruncation, "udp-tcp".
+// test is TestPositive, TestNegative or TestTruncation; only positive queries set
+// the endpoint's up gauge and last success. reason explains a failure, e.g.
+// "connection-refused" or "servfail", and is dropped for successes.
+func RecordQuery(endpoint, test, qtype, proto string, status QueryStatus, reason string, rtt time.Duration) {
+	if status == QuerySuccess {
+		reason = ""
+	}
+	rttHistogram.WithLabelValues(endpoint, test, qtype, proto, string(status)).Observe(float64(rtt.Nanoseconds()) / 1e6)
+	queriesTotal.WithLabelValues(endpoint, test, string(status), reason).Inc()
+	if test != TestPositive {
+		return
+	}
+	if status == QuerySuccess {
+		up.WithLabelValues(endpoint).Set(1)
+		lastSuccess.WithLabelValues(endpoint).SetToCurrentTime()
+	} else {
+		up.WithLabelValues(endpoint).Set(0)
+	}
+}
+
+// RecordDial records how long opening the connection for a query to endpoint over
+// proto took; the query's RTT, recorded with RecordQuery, starts after it.
+func RecordDial(endpoint, proto string, d time.Duration) {
+	dialDuration.WithLabelValues(endpoint, proto).Observe(d.Seconds())
+}
+
+// RecordConnection counts a query to endpoint over proto that reused a connection
+// kept open from an earlier query or, if not reused, opened a new one.
+func RecordConnection(endpoint, proto string, reused bool) {
+	if reused {
+		connectionReusesTotal.WithLabelValues(endpoint, proto).Inc()
+	} else {
+		connectionsTotal.WithLabelValues(endpoint, proto).Inc()
+	}
+}
+
+// RecordPhases records how long writing a query to endpoint over proto and
+// reading its response took; together they make up the query's RTT.
+func RecordPhases(endpoint, proto string, write, read time.Duration) {
+	phaseDuration.WithLabelValues(endpoint, proto, "write").Observe(write.Seconds())
+	phaseDuration.WithLabelValues(endpoint, proto, "read").Observe(read.Seconds())
+}
+
+// RecordTruncation counts a truncated UDP response from endpoint and whether its
+// retry over TCP got a response.
+func RecordTruncation(endpoint string, fallbackOK bool) {
+	fallback := "failure"
+	if fallbackOK {
+		fallback = "success"
+	}
+	truncationTotal.WithLabelValues(endpoint, fallback).Inc()
+}
+
+// RecordAnswerCount records the number of answers in a NOERROR response from
+// endpoint for domain; zero is NODATA.
+func RecordAnswerCount(endpoint, domain string, n int) {
+	answerCount.WithLabelValues(endpoint, domain).Observe(float64(n))
+}
+
+// RecordResponseSize records the size in bytes of a response from endpoint over
+// proto.
+func RecordResponseSize(endpoint, proto string, size int) {
+	responseSize.WithLabelValues(endpoint, proto).Observe(float64(size))
+}
+
+// RecordSearchQueries records the number of queries a lookup through the search
+// list sent to endpoint before it got an answer or gave up.
+func RecordSearchQueries(endpoint string, n int) {
+	searchQueries.WithLabelValues(endpoint).Observe(float64(n))
+}
+
+// RecordRetry counts a query attempt to endpoint that got no response, or
+// SERVFAIL, and was retried.
+func RecordRetry(endpoint string) {
+	retriesTotal.WithLabelValues(endpoint).Inc()
+}
+
+// RecordServFail counts a SERVFAIL response from endpoint to any query attempt,
+// so that the rate CoreDNS returns them can be told apart from the rate left
+// after retries.
+func RecordServFail(endpoint string) {
+	servfailTotal.WithLabelValues(endpoint).Inc()
+}
+
+// QueryStarted counts a query to endpoint as in flight until QueryFinished.
+func QueryStarted(endpoint string) {
+	inflight.WithLabelValues(endpoint).Inc()
+}
+
+// QueryFinished ends a query counted by QueryStarted.
+func QueryFinished(endpoint string) {
+	inflight.WithLabelValues(endpoint).Dec()
+}
+
+// RecordSlowQuery counts a successful query that was slower than the maximum
+// latency; it is recorded with RecordQuery as a success as well.
+func RecordSlowQuery(endpoint string) {
+	slowQueriesTotal.WithLabelValues(endpoint).Inc()
+}
+
+// RecordNameQuery records a probe query for one of the rotated shard names.
+func RecordNameQuery(endpoint, name string, status QueryStatus, rtt time.Duration) {
+	nameRTTHistogram.WithLabelValues(endpoint, name, string(status)).Observe(float64(rtt.Nanoseconds()) / 1e6)
+}
+
+// RecordColdStartQuery records a query to a CoreDNS endpoint during its
+// cold-start window. It has no endpoint label, so that the histogram keeps
+// the startup latency of pods that have since been replaced.
+func RecordColdStartQuery(proto string, status QueryStatus, rtt time.Duration) {
+	coldStartHistogram.WithLabelValues(proto, string(status)).Observe(float64(rtt.Nanoseconds()) / 1e6)
+}
+
+// SetRTTPercentiles publishes the per-endpoint RTT percentile estimates, in milliseconds,
+// for the last summary window.
+func SetRTTPercentiles(endpoint string, p50, p90, p95, p99 float64) {
+	rttP50.WithLabelValues(endpoint).Set(p50)
+	rttP90.WithLabelValues(endpoint).Set(p90)
+	rttP95.WithLabelValues(endpoint).Set(p95)
+	rttP99.WithLabelValues(endpoint).Set(p99)
+}
+
+// DeleteRTTPercentiles removes the RTT percentile series for an endpoint, e.g. after a
+// window without successful queries.
+func DeleteRTTPercentiles(endpoint string) {
+	rttP50.DeleteLabelValues(endpoint)
+	rttP90.DeleteLabelValues(endpoint)
+	rttP95.DeleteLabelValues(endpoint)
+	rttP99.DeleteLabelValues(endpoint)
+}
+
+// SetHealthEndpointUp records the result of the latest HTTP health check for an endpoint.
+func SetHealthEndpointUp(endpoint string, up bool) {
+	v := 0.0
+	if up {
+		v = 1
+	}
+	healthEndpointUp.WithLabelValues(endpoint).Set(v)
+}
+
+// SetCoreDNSMetricsUp records whether the CoreDNS metrics of an endpoint could be
+// scraped.
+func SetCoreDNSMetricsUp(endpoint string, up bool) {
+	v := 0.0
+	if up {
+		v = 1
+	}
+	corednsMetricsUp.WithLabelValues(endpoint).Set(v)
+}
+
+// SetCoreDNSRates records the request rate, cache hit ratio and mean forward
+// duration CoreDNS reported for an endpoint. A NaN figure, e.g. a hit ratio
+// without cache lookups, removes its series instead.
+func SetCoreDNSRates(endpoint string, requestsPerSecond, cacheHitRatio, forwardSeconds float64) {
+	for _, g := range []struct {
+		vec *prometheus.GaugeVec
+		v   float64
+	}{
+		{corednsRequestsPerSecond, requestsPerSecond},
+		{corednsCacheHitRatio, cacheHitRatio},
+		{corednsForwardSeconds, forwardSeconds},
+	} {
+		if math.IsNaN(g.v) {
+			g.vec.DeleteLabelValues(endpoint)
+			continue
+		}
+		g.vec.WithLabelValues(endpoint).Set(g.v)
+	}
+}
+
+// SetEndpointReady records the EndpointSlice readiness of an endpoint so probe
+// results can be split by readiness state.
+func SetEndpointReady(endpoint string, ready bool) {
+	v := 0.0
+	if ready {
+		v = 1
+	}
+	endpointReady.WithLabelValues(endpoint).Set(v)
+}
+
+// SetEndpointInfo publishes the pod, node, zone, address family (IPv4 or IPv6) and
+// target kind of an endpoint, which lets failing endpoints be traced to a pod and
+// node, latencies be compared across zones, the results for both addresses of a
+// dual-stack pod be joined and pod results be compared with the Service's
+// ClusterIP. It replaces earlier info for the endpoint, e.g. when its IP moved to
+// another pod.
+func SetEndpointInfo(endpoint, pod, node, zone, family, target string) {
+	endpointInfo.DeletePartialMatch(prometheus.Labels{"endpoint": endpoint})
+	endpointInfo.WithLabelValues(endpoint, pod, node, zone, family, target).Set(1)
+}
+
+// DeleteEndpoint removes every series of an endpoint that is no longer probed, e.g.
+// after its pod was rescheduled to a new IP, so it stops showing stale values and
+// pod churn does not grow cardinality. Every vector with an endpoint label must be
+// listed here.
+func DeleteEndpoint(endpoint string) {
+	labels := prometheus.Labels{"endpoint": endpoint}
+	for _, v := range []interface{ DeletePartialMatch(prometheus.Labels) int }{
+		rttHistogram, dialDuration, connectionsTotal, connectionReusesTotal, phaseDuration, answerCount, responseSize, searchQueries, queriesTotal, slowQueriesTotal, truncationTotal, retriesTotal, servfailTotal, up, lastSuccess, inflight, nameRTTHistogram, rttP50, rttP90, rttP95, rttP99,
+		healthEndpointUp, corednsMetricsUp, corednsRequestsPerSecond, corednsCacheHitRatio, corednsForwardSeconds,
+		outlier, endpointReady, endpointInfo,
+	} {
+		v.DeletePartialMatch(labels)
+	}
+}
+
+// SetBuildInfo publishes the version and commit of the probe, with the Go
+// version of the running binary, as coredns_probe_build_info.
+func SetBuildInfo(version, commit string) {
+	buildInfo.Reset()
+	buildInfo.WithLabelValues(version, commit, runtime.Version()).Set(1)
+}
+
+// SetOutlier records whether endpoint stood out from the other endpoints in the
+// last summary window.
+func SetOutlier(endpoint string, isOutlier bool) {
+	v := 0.0
+	if isOutlier {
+		v = 1
+	}
+	outlier.WithLabelValues(endpoint).Set(v)
+}
+
+// RecordLoopDuration records how long one probe cycle took.
+func RecordLoopDuration(d time.Duration) {
+	loopDuration.Observe(d.Seconds())
+}
+
+// RecordDiscoveryError counts a failed EndpointSlice or Endpoints call.
+func RecordDiscoveryError() {
+	discoveryErrors.Inc()
+}
+
+// RecordEndpointDrift counts n endpoints that drifted from a fresh EndpointSlice list.
+func RecordEndpointDrift(n int) {
+	endpointDrift.Add(float64(n))
+}
+
+// RecordDiscoveryDuration records how long an EndpointSlice list call took.
+func RecordDiscoveryDuration(d time.Duration) {
+	discoveryDuration.Observe(d.Seconds())
+}
+
+// RecordThrottledQuery counts a query skipped by the --max-qps limiter.
+func RecordThrottledQuery() {
+	throttledQueries.Inc()
+}
+
+// SetQueriesSentPerSecond records the query rate the probe itself adds to CoreDNS.
+func SetQueriesSentPerSecond(qps float64) {
+	queriesSentPerSecond.Set(qps)
+}
+
+// SetClusterSuccessRatio records the weighted success ratio across all endpoints.
+func SetClusterSuccessRatio(r float64) {
+	clusterSuccessRatio.Set(r)
+}
+
+// SetDegraded records whether queries fell back to the Go resolver.
+func SetDegraded(d bool) {
+	v := 0.0
+	if d {
+		v = 1
+	}
+	degraded.Set(v)
+}
+
+// registry holds the probe's metrics instead of the global default registry, so
+// nothing else in the process ends up on /metrics by accident.
+var registry = newRegistry()
+
+func newRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return reg
+}
+
+// registerer is where Register and SetTargetInfo add collectors; SetClusterName
+// wraps it to label everything with the cluster.
+var registerer prometheus.Registerer = registry
+
+// Gatherer returns the registry the probe's metrics are served from, e.g. for
+// pushing them elsewhere.
+func Gatherer() prometheus.Gatherer {
+	return registry
+}
+
+// SetClusterName adds a cluster label with the given value to all probe metrics.
+// It must be called before Register; an empty name leaves metrics unlabeled.
+func SetClusterName(name string) {
+	if name == "" {
+		return
+	}
+	registerer = prometheus.WrapRegistererWith(prometheus.Labels{"cluster": name}, registry)
+}
+
+// Register adds the probe's collectors to the registry. Collectors that are
+// already registered are left in place rather than causing a panic, so it is safe
+// to call more than once in a process, e.g. from tests or several probers.
+func Register() error {
+	return register(registerer)
+}
+
+func register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		rttHistogram, dialDuration, connectionsTotal, connectionReusesTotal, phaseDuration, answerCount, responseSize, searchQueries, queriesTotal, slowQueriesTotal, truncationTotal, retriesTotal, servfailTotal, up, lastSuccess, inflight, nameRTTHistogram, rttP50, rttP90, rttP95, rttP99,
+		healthEndpointUp, corednsMetricsUp, corednsRequestsPerSecond, corednsCacheHitRatio, corednsForwardSeconds,
+		outlier, endpointReady, endpointInfo, loopDuration, discoveryErrors, discoveryDuration, endpointDrift,
+		queriesSentPerSecond, throttledQueries, coldStartHistogram, clusterSuccessRatio, degraded, startTime, buildInfo,
+	} {
+		if err := reg.Register(c); err != nil {
+			var already prometheus.AlreadyRegisteredError
+			if !errors.As(err, &already) {
+				return fmt.Errorf("registering metrics: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// ready is reported by /readyz, see SetReady.
+var ready atomic.Bool
+
+// SetReady sets whether /readyz reports the probe as ready, which main does once
+// endpoints were discovered and the first probe cycle ran.
+func SetReady(r bool) {
+	ready.Store(r)
+}
+
+func readyz(w http.ResponseWriter, _ *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serverTLS and basicAuth secure the server started by StartServer, see
+// SetServerTLS and SetBasicAuth.
+var (
+	serverTLS *tls.Config
+	basicAuth struct{ username, password string }
 )
 
-// RecordQuery records statistics for a single DNS probe query.
-func RecordQuery(endpoint string, status QueryStatus, rtt time.Duration) {
-	rttHistogram.WithLabelValues(endpoint, string(status)).Observe(float64(rtt.Nanoseconds()) / 1e6)
+// SetServerTLS makes StartServer serve HTTPS with the certificate and key in the
+// given PEM files, which are loaded once. It must be called before StartServer.
+func SetServerTLS(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("loading metrics TLS certificate: %w", err)
+	}
+	serverTLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	return nil
+}
+
+// SetBasicAuth makes StartServer require these credentials for the metrics, but
+// not for /healthz and /readyz, which kubelet probes without them. It must be
+// called before StartServer.
+func SetBasicAuth(username, password string) {
+	basicAuth.username, basicAuth.password = username, password
+}
+
+// requireBasicAuth answers 401 to requests without the credentials set by
+// SetBasicAuth, if any.
+func requireBasicAuth(h http.Handler) http.Handler {
+	if basicAuth.username == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(basicAuth.username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(password), []byte(basicAuth.password)) == 1
+		if !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
 }
 
-// this does not block so we will not shutdown gracefully
-func StartServer(ctx context.Context, addr string) {
-	prometheus.MustRegister(rttHistogram)
-	http.Handle("/metrics", promhttp.Handler()) // uses the default registry
+// handlers are served by StartServer next to the metrics, see Handle.
+var handlers = make(map[string]http.Handler)
 
+// Handle serves h on path next to the metrics, behind the same basic auth, e.g.
+// for debug endpoints. Like SetBasicAuth it must be called before StartServer.
+func Handle(path string, h http.Handler) {
+	handlers[path] = h
+}
+
+// shutdownTimeout bounds how long in-flight scrapes may take once the server
+// context is cancelled.
+const shutdownTimeout = 5 * time.Second
+
+// serverDone is closed once the server started by StartServer has shut down.
+var serverDone chan struct{}
+
+// StartServer registers the metrics and serves them on addr under path, e.g.
+// /metrics, next to /healthz, /readyz and the paths added with Handle, over HTTPS
+// after SetServerTLS and behind basic auth after SetBasicAuth. Listening happens
+// before it returns, so an address already in use is reported as an error; serving
+// then continues in the background until ctx is cancelled, when in-flight scrapes
+// get shutdownTimeout to complete. Use Wait to block until that is done.
+func StartServer(ctx context.Context, addr, path string) error {
+	startTime.Set(float64(time.Now().Unix()))
+	if err := Register(); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, requireBasicAuth(handler()))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", readyz)
+	for p, h := range handlers {
+		mux.Handle(p, requireBasicAuth(h))
+	}
+
+	l, err := listen(addr)
+	if err != nil {
+		return fmt.Errorf("listening for metrics on %s: %w", addr, err)
+	}
+	if serverTLS != nil {
+		l = tls.NewListener(l, serverTLS)
+	}
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	serverDone = make(chan struct{})
 	go func() {
-		log.Fatal(http.ListenAndServe(addr, nil))
+		defer close(serverDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutting down metrics server: %v", err)
+			return
+		}
+		log.Printf("metrics server shut down")
 	}()
+	return nil
+}
+
+// Wait blocks until the server started by StartServer has shut down. It returns
+// immediately if no server was started.
+func Wait() {
+	if serverDone != nil {
+		<-serverDone
+	}
+}
+
+// handler serves the registry, negotiating OpenMetrics with scrapers that
+// ask for it and falling back to the Prometheus text format otherwise. Responses
+// are gzip-compressed for scrapers that accept it.
+func handler() http.Handler {
+	return promhttp.InstrumentMetricHandler(registry,
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+}
+
+// SetTargetInfo registers a target_info metric carrying resource attributes such as
+// the cluster and namespace, following the OpenTelemetry convention for Prometheus.
+// Attribute names are converted to valid label names, e.g. k8s.cluster.name becomes
+// k8s_cluster_name. It must be called at most once.
+func SetTargetInfo(attrs map[string]string) error {
+	labels := make(prometheus.Labels, len(attrs))
+	for k, v := range attrs {
+		labels[labelName(k)] = v
+	}
+	info := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "target_info",
+		Help:        "Target metadata",
+		ConstLabels: labels,
+	})
+	info.Set(1)
+	if err := registerer.Register(info); err != nil {
+		return fmt.Errorf("registering target_info: %w", err)
+	}
+	return nil
+}
+
+// ParseResourceAttributes parses the OTEL_RESOURCE_ATTRIBUTES format, a comma-separated
+// list of key=value pairs.
+func ParseResourceAttributes(s string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid resource attribute %q, expected key=value", pair)
+		}
+		attrs[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return attrs, nil
+}
+
+// labelName replaces characters that are not valid in Prometheus label names with underscores.
+func labelName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		valid := c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || (i > 0 && '0' <= c && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// listen opens a Unix domain socket for addresses of the form unix:///path/to/sock
+// and a TCP listener otherwise. A stale socket file left by a previous run is removed.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix://")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("removing stale metrics socket %s: %w", path, err)
+	}
+	return net.Listen("unix", path)
 }
@@ -1,14 +1,31 @@
 package metrics
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"maps"
 	"math"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 )
@@ -96,7 +113,7 @@ func TestRecordQuery(t *testing.T) {
 
 	for _, tc := range testCases {
 		for _, q := range tc.queries {
-			RecordQuery(tc.endpoint, q.status, q.rtt)
+			RecordQuery(tc.endpoint, TestPositive, "A", "udp", q.status, "", q.rtt)
 		}
 	}
 
@@ -127,13 +144,515 @@ func TestRecordQuery(t *testing.T) {
 	}
 }
 
+func TestRegisterTwice(t *testing.T) {
+	if err := Register(); err != nil {
+		t.Fatalf("first Register: %v", err)
+	}
+	if err := Register(); err != nil {
+		t.Fatalf("second Register: %v", err)
+	}
+}
+
+func TestParseResourceAttributes(t *testing.T) {
+	testCases := []struct {
+		name      string
+		input     string
+		expected  map[string]string
+		expectErr bool
+	}{
+		{name: "empty", input: "", expected: map[string]string{}},
+		{
+			name:     "pairs",
+			input:    "k8s.cluster.name=prod-eu, k8s.namespace.name=kube-system",
+			expected: map[string]string{"k8s.cluster.name": "prod-eu", "k8s.namespace.name": "kube-system"},
+		},
+		{name: "missing_value_separator", input: "k8s.cluster.name", expectErr: true},
+		{name: "empty_key", input: "=prod", expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseResourceAttributes(tc.input)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !maps.Equal(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestOpenMetricsNegotiation(t *testing.T) {
+	if err := SetTargetInfo(map[string]string{"k8s.cluster.name": "prod-eu"}); err != nil {
+		t.Fatalf("SetTargetInfo: %v", err)
+	}
+	server := httptest.NewServer(handler())
+	defer server.Close()
+
+	testCases := []struct {
+		name        string
+		accept      string
+		contentType string
+	}{
+		{name: "default_text", contentType: "text/plain"},
+		{name: "openmetrics", accept: "application/openmetrics-text; version=1.0.0", contentType: "application/openmetrics-text"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatalf("building request: %v", err)
+			}
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("GET: %v", err)
+			}
+			defer resp.Body.Close()
+			if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, tc.contentType) {
+				t.Errorf("expected content type %s, got %s", tc.contentType, ct)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+			if !strings.Contains(string(body), `target_info{k8s_cluster_name="prod-eu"} 1`) {
+				t.Errorf("target_info with cluster attribute not found in:\n%s", body)
+			}
+		})
+	}
+}
+
+func TestGzip(t *testing.T) {
+	server := httptest.NewServer(handler())
+	defer server.Close()
+
+	for _, encoding := range []string{"gzip", ""} {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatalf("building request: %v", err)
+		}
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		// Keep the transport from asking for and decoding gzip itself.
+		client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Content-Encoding"); got != encoding {
+			t.Errorf("expected content encoding %q for Accept-Encoding %q, got %q", encoding, encoding, got)
+		}
+	}
+}
+
+func TestClusterLabel(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if err := register(prometheus.WrapRegistererWith(prometheus.Labels{"cluster": "prod-eu"}, reg)); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	RecordQuery("10.0.4.1", TestPositive, "A", "udp", QuerySuccess, "", time.Millisecond)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	if len(families) == 0 {
+		t.Fatal("no metrics gathered")
+	}
+	for _, family := range families {
+		for _, m := range family.Metric {
+			if !hasLabel(m, "cluster", "prod-eu") {
+				t.Errorf("%s is missing the cluster label", family.GetName())
+			}
+		}
+	}
+}
+
+func TestQueriesTotal(t *testing.T) {
+	RecordQuery("10.0.6.1", TestPositive, "A", "udp", QuerySuccess, "", time.Millisecond)
+	RecordQuery("10.0.6.1", TestPositive, "A", "tcp", QuerySuccess, "slow", time.Millisecond)
+	RecordQuery("10.0.6.1", TestPositive, "A", "udp", QueryTimeout, "timeout", 100*time.Millisecond)
+	RecordQuery("10.0.6.1", TestPositive, "A", "udp", QueryError, "connection-refused", time.Millisecond)
+
+	if got := testutil.ToFloat64(queriesTotal.WithLabelValues("10.0.6.1", TestPositive, string(QuerySuccess), "")); got != 2 {
+		t.Errorf("expected 2 successful queries without a reason, got %.0f", got)
+	}
+	if got := testutil.ToFloat64(queriesTotal.WithLabelValues("10.0.6.1", TestPositive, string(QueryTimeout), "timeout")); got != 1 {
+		t.Errorf("expected 1 timed out query, got %.0f", got)
+	}
+	if got := testutil.ToFloat64(queriesTotal.WithLabelValues("10.0.6.1", TestPositive, string(QueryError), "connection-refused")); got != 1 {
+		t.Errorf("expected 1 refused query, got %.0f", got)
+	}
+}
+
+func TestLastSuccessTimestamp(t *testing.T) {
+	RecordQuery("10.0.6.2", TestPositive, "A", "udp", QueryTimeout, "", 100*time.Millisecond)
+	RecordQuery("10.0.6.2", TestNegative, "A", "udp", QuerySuccess, "", time.Millisecond)
+	if got := seriesFor(t, lastSuccess, "10.0.6.2"); got != 0 {
+		t.Fatalf("expected no timestamp before the first success, got %d series", got)
+	}
+
+	before := time.Now()
+	RecordQuery("10.0.6.2", TestPositive, "A", "udp", QuerySuccess, "", time.Millisecond)
+	RecordQuery("10.0.6.2", TestPositive, "A", "udp", QueryError, "", time.Millisecond)
+	got := testutil.ToFloat64(lastSuccess.WithLabelValues("10.0.6.2"))
+	if got < float64(before.Unix()) || got > float64(time.Now().Unix()+1) {
+		t.Errorf("expected the time of the successful query around %d, got %.0f", before.Unix(), got)
+	}
+}
+
+func TestUp(t *testing.T) {
+	testCases := []struct {
+		name     string
+		test     string
+		status   QueryStatus
+		expected float64
+	}{
+		{name: "success", test: TestPositive, status: QuerySuccess, expected: 1},
+		{name: "timeout", test: TestPositive, status: QueryTimeout, expected: 0},
+		{name: "error", test: TestPositive, status: QueryError, expected: 0},
+		// Negative queries leave the last positive result in place.
+		{name: "negative_error", test: TestNegative, status: QueryError, expected: 0},
+		{name: "recovered", test: TestPositive, status: QuerySuccess, expected: 1},
+		{name: "negative_timeout", test: TestNegative, status: QueryTimeout, expected: 1},
+	}
+	for _, tc := range testCases {
+		RecordQuery("10.0.6.4", tc.test, "A", "udp", tc.status, "", time.Millisecond)
+		if got := testutil.ToFloat64(up.WithLabelValues("10.0.6.4")); got != tc.expected {
+			t.Errorf("%s: expected up %.0f, got %.0f", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestInflight(t *testing.T) {
+	QueryStarted("10.0.6.3")
+	QueryStarted("10.0.6.3")
+	QueryFinished("10.0.6.3")
+	if got := testutil.ToFloat64(inflight.WithLabelValues("10.0.6.3")); got != 1 {
+		t.Errorf("expected 1 query in flight, got %.0f", got)
+	}
+}
+
+func TestEnableNativeHistograms(t *testing.T) {
+	defer func() {
+		rttOpts = prometheus.HistogramOpts{Buckets: DefaultRTTBuckets}
+		rttHistogram, nameRTTHistogram = newRTTHistogram(rttOpts), newNameRTTHistogram(rttOpts)
+	}()
+
+	EnableNativeHistograms()
+	RecordQuery("10.0.8.1", TestPositive, "A", "udp", QuerySuccess, "", 3*time.Millisecond)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(rttHistogram)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	h := families[0].Metric[0].Histogram
+	if h.Schema == nil || len(h.PositiveSpan) == 0 {
+		t.Errorf("expected a native histogram, got %v", h)
+	}
+	if len(h.Bucket) != len(DefaultRTTBuckets) {
+		t.Errorf("expected the classic buckets to be kept, got %d", len(h.Bucket))
+	}
+}
+
+func TestSetRTTBuckets(t *testing.T) {
+	defer func() {
+		rttOpts = prometheus.HistogramOpts{Buckets: DefaultRTTBuckets}
+		rttHistogram, nameRTTHistogram = newRTTHistogram(rttOpts), newNameRTTHistogram(rttOpts)
+	}()
+
+	for name, buckets := range map[string][]float64{
+		"empty":        nil,
+		"unsorted":     {100, 10},
+		"duplicate":    {10, 10},
+		"not positive": {0, 10},
+	} {
+		if err := SetRTTBuckets(buckets); err == nil {
+			t.Errorf("%s: expected an error for buckets %v", name, buckets)
+		}
+	}
+
+	if err := SetRTTBuckets([]float64{500, 1000, 2000, 4000}); err != nil {
+		t.Fatalf("SetRTTBuckets: %v", err)
+	}
+	RecordQuery("10.0.7.1", TestPositive, "A", "udp", QuerySuccess, "", 1500*time.Millisecond)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(rttHistogram)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	buckets := families[0].Metric[0].Histogram.Bucket
+	if len(buckets) != 4 || buckets[2].GetUpperBound() != 2000 || buckets[2].GetCumulativeCount() != 1 || buckets[1].GetCumulativeCount() != 0 {
+		t.Errorf("expected the 1.5s query in the 2000ms bucket of 4, got %v", buckets)
+	}
+}
+
+func TestSetBuildInfo(t *testing.T) {
+	SetBuildInfo("dev", "unknown")
+	SetBuildInfo("v1.2.3", "abc123")
+	if got := testutil.CollectAndCount(buildInfo); got != 1 {
+		t.Fatalf("expected a single build info series, got %d", got)
+	}
+	if got := testutil.ToFloat64(buildInfo.WithLabelValues("v1.2.3", "abc123", runtime.Version())); got != 1 {
+		t.Errorf("expected build info 1 for v1.2.3, got %.0f", got)
+	}
+}
+
+func TestRecordLoopDuration(t *testing.T) {
+	RecordLoopDuration(30 * time.Millisecond)
+	RecordLoopDuration(2 * time.Second)
+
+	m := &dto.Metric{}
+	if err := loopDuration.Write(m); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got < 2 {
+		t.Errorf("expected at least 2 observations, got %d", got)
+	}
+	if got := m.GetHistogram().GetSampleSum(); got < 2.03 {
+		t.Errorf("expected a sum of at least 2.03s, got %v", got)
+	}
+}
+
+func TestRecordAnswerCount(t *testing.T) {
+	RecordAnswerCount("10.0.6.5", "bing.com", 0)
+	RecordAnswerCount("10.0.6.5", "bing.com", 3)
+	m := &dto.Metric{}
+	if err := answerCount.WithLabelValues("10.0.6.5", "bing.com").(prometheus.Histogram).Write(m); err != nil {
+		t.Fatalf("writing histogram: %v", err)
+	}
+	h := m.GetHistogram()
+	if h.GetSampleCount() != 2 || h.GetSampleSum() != 3 {
+		t.Errorf("expected 2 observations summing to 3, got %d summing to %v", h.GetSampleCount(), h.GetSampleSum())
+	}
+	if nodata := h.GetBucket()[0]; nodata.GetUpperBound() != 0 || nodata.GetCumulativeCount() != 1 {
+		t.Errorf("expected 1 empty answer in the 0 bucket, got %d in le=%v", nodata.GetCumulativeCount(), nodata.GetUpperBound())
+	}
+}
+
+func TestRecordNameQuery(t *testing.T) {
+	RecordNameQuery("10.0.3.1", "a.example.", QuerySuccess, 2*time.Millisecond)
+	RecordNameQuery("10.0.3.1", "a.example.", QuerySuccess, 3*time.Millisecond)
+	RecordNameQuery("10.0.3.1", "b.example.", QueryError, 40*time.Millisecond)
+
+	if got := testutil.CollectAndCount(nameRTTHistogram); got != 2 {
+		t.Errorf("expected 2 name series, got %d", got)
+	}
+}
+
+func TestUseDomainLabel(t *testing.T) {
+	defer func() {
+		nameLabel = "name"
+		nameRTTHistogram = newNameRTTHistogram(rttOpts)
+	}()
+
+	UseDomainLabel()
+	RecordNameQuery("10.0.3.2", "a.example.", QuerySuccess, 2*time.Millisecond)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(nameRTTHistogram)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	labels := map[string]string{}
+	for _, l := range families[0].Metric[0].Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if labels["domain"] != "a.example." || labels["name"] != "" {
+		t.Errorf("expected the name as domain label, got %v", labels)
+	}
+}
+
+func TestSetRTTPercentiles(t *testing.T) {
+	SetRTTPercentiles("10.0.1.1", 1.5, 3, 4, 9.25)
+
+	for name, tc := range map[string]struct {
+		gauge    *prometheus.GaugeVec
+		expected float64
+	}{
+		"p50": {rttP50, 1.5},
+		"p90": {rttP90, 3},
+		"p95": {rttP95, 4},
+		"p99": {rttP99, 9.25},
+	} {
+		if got := testutil.ToFloat64(tc.gauge.WithLabelValues("10.0.1.1")); got != tc.expected {
+			t.Errorf("%s: expected %.2f, got %.2f", name, tc.expected, got)
+		}
+	}
+
+	DeleteRTTPercentiles("10.0.1.1")
+	if got := testutil.CollectAndCount(rttP99); got != 0 {
+		t.Errorf("expected no p99 series after delete, got %d", got)
+	}
+}
+
+func TestSetHealthEndpointUp(t *testing.T) {
+	SetHealthEndpointUp("10.0.2.1", true)
+	SetHealthEndpointUp("10.0.2.2", false)
+
+	if got := testutil.ToFloat64(healthEndpointUp.WithLabelValues("10.0.2.1")); got != 1 {
+		t.Errorf("expected healthy endpoint to be 1, got %.0f", got)
+	}
+	if got := testutil.ToFloat64(healthEndpointUp.WithLabelValues("10.0.2.2")); got != 0 {
+		t.Errorf("expected unhealthy endpoint to be 0, got %.0f", got)
+	}
+}
+
+func TestDeleteEndpoint(t *testing.T) {
+	RecordQuery("10.0.5.1", TestPositive, "A", "udp", QuerySuccess, "", time.Millisecond)
+	SetEndpointInfo("10.0.5.1", "coredns-a", "node-1", "zone-1", "IPv4", "pod")
+	RecordQuery("10.0.5.2", TestPositive, "A", "udp", QuerySuccess, "", time.Millisecond)
+
+	DeleteEndpoint("10.0.5.1")
+
+	for _, c := range []prometheus.Collector{rttHistogram, up, endpointInfo} {
+		if got := seriesFor(t, c, "10.0.5.1"); got != 0 {
+			t.Errorf("expected no series for the deleted endpoint, got %d", got)
+		}
+	}
+	if got := seriesFor(t, rttHistogram, "10.0.5.2"); got != 1 {
+		t.Errorf("expected the other endpoint's series to remain, got %d", got)
+	}
+}
+
+// seriesFor counts the series of collector c labeled with endpoint.
+func seriesFor(t *testing.T, c prometheus.Collector, endpoint string) int {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	n := 0
+	for _, family := range families {
+		for _, m := range family.Metric {
+			if hasLabel(m, "endpoint", endpoint) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestStartServerAddrInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	if err := StartServer(context.Background(), l.Addr().String(), "/metrics"); err == nil {
+		t.Fatalf("expected an error for %s, which is already in use", l.Addr())
+	}
+}
+
+func TestStartServerShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := StartServer(ctx, "unix://"+path, "/internal/metrics"); err != nil {
+		t.Fatalf("StartServer: %v", err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://metrics/internal/metrics")
+	if err != nil {
+		t.Fatalf("GET before shutdown: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected metrics on the configured path, got %s", resp.Status)
+	}
+
+	cancel()
+	Wait()
+	if _, err := client.Get("http://metrics/internal/metrics"); err == nil {
+		t.Error("expected GET after shutdown to fail")
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	defer SetReady(false)
+	testCases := []struct {
+		name     string
+		ready    bool
+		expected int
+	}{
+		{name: "not_ready", ready: false, expected: http.StatusServiceUnavailable},
+		{name: "ready", ready: true, expected: http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			SetReady(tc.ready)
+			rec := httptest.NewRecorder()
+			readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tc.expected {
+				t.Errorf("expected status %d, got %d", tc.expected, rec.Code)
+			}
+		})
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+	// A leftover file from a previous run must not prevent listening.
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatalf("creating stale socket file: %v", err)
+	}
+
+	l, err := listen("unix://" + path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &http.Server{Handler: promhttp.HandlerFor(prometheus.NewRegistry(), promhttp.HandlerOpts{})}
+	go server.Serve(l)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/metrics")
+	if err != nil {
+		t.Fatalf("GET over unix socket: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 OK, got %v", resp.Status)
+	}
+}
+
 // setupAndFetchMetrics creates a test HTTP server with Prometheus metrics handler
 // and returns the parsed metrics from a GET /metrics request.
 func setupAndFetchMetrics(t *testing.T) map[string]*dto.MetricFamily {
 	t.Helper()
 
-	prometheus.MustRegister(rttHistogram)
-	server := httptest.NewServer(promhttp.Handler())
+	if err := Register(); err != nil {
+		t.Fatalf("Failed to register metrics: %v", err)
+	}
+	server := httptest.NewServer(handler())
 	defer server.Close()
 
 	resp, err := http.Get(server.URL)
@@ -237,3 +756,110 @@ func hasLabel(metric *dto.Metric, name, value string) bool {
 	}
 	return false
 }
+
+func TestBasicAuth(t *testing.T) {
+	SetBasicAuth("prom", "s3cret")
+	defer SetBasicAuth("", "")
+	server := httptest.NewServer(requireBasicAuth(handler()))
+	defer server.Close()
+
+	testCases := []struct {
+		name               string
+		username, password string
+		expected           int
+	}{
+		{name: "valid", username: "prom", password: "s3cret", expected: http.StatusOK},
+		{name: "wrong_password", username: "prom", password: "guess", expected: http.StatusUnauthorized},
+		{name: "missing", expected: http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatalf("building request: %v", err)
+			}
+			if tc.username != "" {
+				req.SetBasicAuth(tc.username, tc.password)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("GET: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.expected {
+				t.Errorf("expected status %d, got %d", tc.expected, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestStartServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeSelfSignedCert(t, certFile, keyFile)
+	if err := SetServerTLS(certFile, keyFile); err != nil {
+		t.Fatalf("SetServerTLS: %v", err)
+	}
+	defer func() { serverTLS = nil }()
+
+	path := filepath.Join(dir, "metrics.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		Wait()
+	}()
+	if err := StartServer(ctx, "unix://"+path, "/metrics"); err != nil {
+		t.Fatalf("StartServer: %v", err)
+	}
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext:     dial,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get("https://metrics/metrics")
+	if err != nil {
+		t.Fatalf("GET over TLS: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 OK over TLS, got %s", resp.Status)
+	}
+
+	plain := &http.Client{Transport: &http.Transport{DialContext: dial}}
+	if resp, err := plain.Get("http://metrics/metrics"); err == nil && resp.StatusCode == http.StatusOK {
+		resp.Body.Close()
+		t.Error("expected plain HTTP to be refused")
+	}
+}
+
+// writeSelfSignedCert writes a throwaway certificate and key in PEM.
+func writeSelfSignedCert(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "metrics"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshaling key: %v", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("writing certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("writing key: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+// Package quantile provides streaming quantile estimation.
+package quantile
+
+import (
+	"math"
+	"sort"
+)
+
+// P2 estimates a single quantile of a stream in constant memory using the P²
+// algorithm (Jain & Chlamtac, 1985). It tracks five markers whose heights are
+// adjusted with piecewise-parabolic interpolation as observations arrive, so
+// accuracy is best for smooth distributions and degrades for small or
+// strongly multi-modal samples. The zero value is not usable; use NewP2.
+type P2 struct {
+	p       float64
+	count   int
+	heights [5]float64
+	pos     [5]float64
+	desired [5]float64
+	incr    [5]float64
+}
+
+// NewP2 returns an estimator for quantile p, which must be in (0, 1).
+func NewP2(p float64) *P2 {
+	e := &P2{p: p}
+	e.Reset()
+	return e
+}
+
+// Reset discards all observations.
+func (e *P2) Reset() {
+	p := e.p
+	e.count = 0
+	e.pos = [5]float64{1, 2, 3, 4, 5}
+	e.desired = [5]float64{1, 1 + 2*p, 1 + 4*p, 3 + 2*p, 5}
+	e.incr = [5]float64{0, p / 2, p, (1 + p) / 2, 1}
+}
+
+// Count returns the number of observations since the last Reset.
+func (e *P2) Count() int {
+	return e.count
+}
+
+// Add records an observation.
+func (e *P2) Add(x float64) {
+	if e.count < 5 {
+		e.heights[e.count] = x
+		e.count++
+		if e.count == 5 {
+			sort.Float64s(e.heights[:])
+		}
+		return
+	}
+	e.count++
+
+	var k int
+	switch {
+	case x < e.heights[0]:
+		e.heights[0] = x
+		k = 0
+	case x >= e.heights[4]:
+		e.heights[4] = x
+		k = 3
+	default:
+		for k = 0; k < 3; k++ {
+			if x < e.heights[k+1] {
+				break
+			}
+		}
+	}
+
+	for i := k + 1; i < 5; i++ {
+		e.pos[i]++
+	}
+	for i := range e.desired {
+		e.desired[i] += e.incr[i]
+	}
+
+	for i := 1; i < 4; i++ {
+		d := e.desired[i] - e.pos[i]
+		if (d >= 1 && e.pos[i+1]-e.pos[i] > 1) || (d <= -1 && e.pos[i-1]-e.pos[i] < -1) {
+			sign := math.Copysign(1, d)
+			h := e.parabolic(i, sign)
+			if e.heights[i-1] < h && h < e.heights[i+1] {
+				e.heights[i] = h
+			} else {
+				e.heights[i] = e.linear(i, sign)
+			}
+			e.pos[i] += sign
+		}
+	}
+}
+
+// Value returns the current estimate, or NaN if nothing has been observed.
+// With fewer than five observations the exact nearest-rank quantile is returned.
+func (e *P2) Value() float64 {
+	if e.count == 0 {
+		return math.NaN()
+	}
+	if e.count < 5 {
+		sorted := make([]float64, e.count)
+		copy(sorted, e.heights[:e.count])
+		sort.Float64s(sorted)
+		idx := int(math.Ceil(e.p*float64(e.count))) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		return sorted[idx]
+	}
+	return e.heights[2]
+}
+
+func (e *P2) parabolic(i int, d float64) float64 {
+	q, n := e.heights, e.pos
+	return q[i] + d/(n[i+1]-n[i-1])*
+		((n[i]-n[i-1]+d)*(q[i+1]-q[i])/(n[i+1]-n[i])+
+			(n[i+1]-n[i]-d)*(q[i]-q[i-1])/(n[i]-n[i-1]))
+}
+
+func (e *P2) linear(i int, d float64) float64 {
+	j := i + int(d)
+	return e.heights[i] + d*(e.heights[j]-e.heights[i])/(e.pos[j]-e.pos[i])
+}
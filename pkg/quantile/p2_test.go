@@ -0,0 +1,102 @@
+package quantile
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestP2(t *testing.T) {
+	testCases := []struct {
+		name      string
+		p         float64
+		values    []float64
+		expected  float64
+		tolerance float64
+	}{
+		{
+			name:     "empty",
+			p:        0.5,
+			expected: math.NaN(),
+		},
+		{
+			name:     "fewer_than_five_is_exact",
+			p:        0.5,
+			values:   []float64{4, 1, 3},
+			expected: 3,
+		},
+		{
+			name:     "single_value_p99",
+			p:        0.99,
+			values:   []float64{7},
+			expected: 7,
+		},
+		{
+			name:      "uniform_median",
+			p:         0.5,
+			values:    uniform(10000),
+			expected:  50,
+			tolerance: 2,
+		},
+		{
+			name:      "uniform_p95",
+			p:         0.95,
+			values:    uniform(10000),
+			expected:  95,
+			tolerance: 2,
+		},
+		{
+			name:      "uniform_p99",
+			p:         0.99,
+			values:    uniform(10000),
+			expected:  99,
+			tolerance: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := NewP2(tc.p)
+			for _, v := range tc.values {
+				e.Add(v)
+			}
+			got := e.Value()
+			if math.IsNaN(tc.expected) {
+				if !math.IsNaN(got) {
+					t.Errorf("expected NaN, got %.2f", got)
+				}
+				return
+			}
+			if math.Abs(got-tc.expected) > tc.tolerance {
+				t.Errorf("p%.0f: expected %.2f±%.2f, got %.2f", tc.p*100, tc.expected, tc.tolerance, got)
+			}
+		})
+	}
+}
+
+func TestP2Reset(t *testing.T) {
+	e := NewP2(0.5)
+	for _, v := range uniform(100) {
+		e.Add(v)
+	}
+	e.Reset()
+	if e.Count() != 0 {
+		t.Errorf("expected count 0 after reset, got %d", e.Count())
+	}
+	for i := 0; i < 100; i++ {
+		e.Add(1000)
+	}
+	if got := e.Value(); got != 1000 {
+		t.Errorf("expected 1000 after reset, got %.2f", got)
+	}
+}
+
+// uniform returns n pseudo-random values in [0, 100).
+func uniform(n int) []float64 {
+	r := rand.New(rand.NewSource(1))
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = r.Float64() * 100
+	}
+	return values
+}
@@ -0,0 +1,204 @@
+// Package remotewrite pushes the probe's metrics to a Prometheus remote-write
+// endpoint, for setups where the probe cannot be scraped.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// finalPushTimeout bounds the push Run makes on shutdown.
+const finalPushTimeout = 5 * time.Second
+
+// Client sends snapshots of a gatherer using remote-write protocol 1.0.
+type Client struct {
+	url      string
+	username string
+	password string
+	target   []label // job and instance, which a scrape would attach
+	gatherer prometheus.Gatherer
+	client   *http.Client
+}
+
+// NewClient returns a Client that pushes metrics from gatherer to url, labelled
+// with job and instance like scraped series. Basic auth is used when username is
+// not empty.
+func NewClient(url, job, instance, username, password string, gatherer prometheus.Gatherer) *Client {
+	return &Client{
+		url:      url,
+		username: username,
+		password: password,
+		target:   []label{{"instance", instance}, {"job", job}},
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Run pushes every interval until ctx is done, and once more then, within
+// finalPushTimeout, so the last results before shutdown are not lost. Failures
+// are logged and the next push is attempted on schedule, so a slow or
+// unavailable receiver never stalls probing.
+func (c *Client) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.Background(), finalPushTimeout)
+			defer cancel()
+			if err := c.Push(final); err != nil {
+				log.Printf("final remote write failed: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := c.Push(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("remote write failed: %v", err)
+			}
+		}
+	}
+}
+
+// Push gathers the current metrics and sends them in a single write request.
+func (c *Client) Push(ctx context.Context) error {
+	families, err := c.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gathering metrics: %w", err)
+	}
+	body := snappy.Encode(nil, encode(toTimeSeries(families, c.target), time.Now().UnixMilli()))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building remote write request: %w", err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending remote write request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+type label struct {
+	name, value string
+}
+
+type timeSeries struct {
+	labels []label // sorted by name, including __name__
+	value  float64
+}
+
+// toTimeSeries flattens metric families the way a scrape would: histograms and
+// summaries become their _bucket/quantile, _sum and _count series, and every
+// series gets the target labels it does not carry itself.
+func toTimeSeries(families []*dto.MetricFamily, target []label) []timeSeries {
+	var series []timeSeries
+	for _, f := range families {
+		name := f.GetName()
+		for _, m := range f.Metric {
+			add := func(suffix string, value float64, extra ...label) {
+				labels := []label{{"__name__", name + suffix}}
+				for _, l := range m.Label {
+					labels = append(labels, label{l.GetName(), l.GetValue()})
+				}
+				labels = append(labels, extra...)
+				for _, t := range target {
+					if !slices.ContainsFunc(labels, func(l label) bool { return l.name == t.name }) {
+						labels = append(labels, t)
+					}
+				}
+				sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+				series = append(series, timeSeries{labels: labels, value: value})
+			}
+
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add("_bucket", float64(b.GetCumulativeCount()), label{"le", formatFloat(b.GetUpperBound())})
+				}
+				add("_bucket", float64(h.GetSampleCount()), label{"le", "+Inf"})
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add("", q.GetValue(), label{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encode marshals a prometheus.WriteRequest protobuf:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encode(series []timeSeries, timestampMs int64) []byte {
+	var req []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, lb)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(timestampMs))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
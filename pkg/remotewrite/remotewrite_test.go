@@ -0,0 +1,192 @@
+package remotewrite
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestToTimeSeries(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "g"}, []string{"endpoint"})
+	hist := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "h", Buckets: []float64{1, 5}})
+	reg.MustRegister(gauge, hist)
+	gauge.WithLabelValues("10.0.0.1").Set(3)
+	hist.Observe(2)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	got := make(map[string]float64)
+	for _, s := range toTimeSeries(families, []label{{"instance", "probe-a"}, {"job", "corednsprobe"}}) {
+		key := ""
+		for _, l := range s.labels {
+			key += l.name + "=" + l.value + ","
+		}
+		got[key] = s.value
+	}
+
+	expected := map[string]float64{
+		"__name__=g,endpoint=10.0.0.1,instance=probe-a,job=corednsprobe,": 3,
+		"__name__=h_bucket,instance=probe-a,job=corednsprobe,le=1,":       0,
+		"__name__=h_bucket,instance=probe-a,job=corednsprobe,le=5,":       1,
+		"__name__=h_bucket,instance=probe-a,job=corednsprobe,le=+Inf,":    1,
+		"__name__=h_sum,instance=probe-a,job=corednsprobe,":               2,
+		"__name__=h_count,instance=probe-a,job=corednsprobe,":             1,
+	}
+	if len(got) != len(expected) {
+		t.Errorf("expected %d series, got %d: %v", len(expected), len(got), got)
+	}
+	for key, value := range expected {
+		if v, ok := got[key]; !ok || v != value {
+			t.Errorf("series %s: expected %v, got %v (present %v)", key, value, v, ok)
+		}
+	}
+}
+
+func TestPush(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "coredns_probe_test"})
+	reg.MustRegister(gauge)
+	gauge.Set(42)
+
+	var series []decodedSeries
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "probe" || pass != "secret" {
+			t.Errorf("expected basic auth probe/secret, got %q/%q (%v)", user, pass, ok)
+		}
+		if enc := r.Header.Get("Content-Encoding"); enc != "snappy" {
+			t.Errorf("expected snappy encoding, got %q", enc)
+		}
+		compressed, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("reading body: %v", err)
+		}
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Fatalf("snappy decode: %v", err)
+		}
+		series = decodeWriteRequest(t, body)
+	}))
+	defer server.Close()
+
+	if err := NewClient(server.URL, "corednsprobe", "probe-a", "probe", "secret", reg).Push(context.Background()); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if len(series) != 1 {
+		t.Fatalf("expected 1 series, got %d", len(series))
+	}
+	if series[0].labels["__name__"] != "coredns_probe_test" || series[0].value != 42 || series[0].timestamp == 0 {
+		t.Errorf("unexpected series %+v", series[0])
+	}
+	if series[0].labels["job"] != "corednsprobe" || series[0].labels["instance"] != "probe-a" {
+		t.Errorf("expected job and instance labels, got %v", series[0].labels)
+	}
+}
+
+func TestRunFinalPush(t *testing.T) {
+	pushes := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes <- struct{}{}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// An hour-long interval never ticks, so the only push is the final one.
+	NewClient(server.URL, "corednsprobe", "probe-a", "", "", prometheus.NewRegistry()).Run(ctx, time.Hour)
+	select {
+	case <-pushes:
+	default:
+		t.Error("expected a final push when the context is done")
+	}
+}
+
+func TestPushError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	if err := NewClient(server.URL, "corednsprobe", "probe-a", "", "", prometheus.NewRegistry()).Push(context.Background()); err == nil {
+		t.Error("expected error for 400 response, got nil")
+	}
+}
+
+type decodedSeries struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// decodeWriteRequest parses the subset of the WriteRequest protobuf that encode produces.
+func decodeWriteRequest(t *testing.T, b []byte) []decodedSeries {
+	t.Helper()
+	var series []decodedSeries
+	forEachField(t, b, func(num protowire.Number, v []byte, _ uint64) {
+		s := decodedSeries{labels: make(map[string]string)}
+		forEachField(t, v, func(num protowire.Number, v []byte, _ uint64) {
+			switch num {
+			case 1:
+				var name, value string
+				forEachField(t, v, func(num protowire.Number, v []byte, _ uint64) {
+					if num == 1 {
+						name = string(v)
+					} else {
+						value = string(v)
+					}
+				})
+				s.labels[name] = value
+			case 2:
+				forEachField(t, v, func(num protowire.Number, _ []byte, n uint64) {
+					if num == 1 {
+						s.value = math.Float64frombits(n)
+					} else {
+						s.timestamp = int64(n)
+					}
+				})
+			}
+		})
+		series = append(series, s)
+	})
+	return series
+}
+
+func forEachField(t *testing.T, b []byte, fn func(protowire.Number, []byte, uint64)) {
+	t.Helper()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("bad tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				t.Fatalf("bad bytes: %v", protowire.ParseError(n))
+			}
+			fn(num, v, 0)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			fn(num, nil, v)
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			fn(num, nil, v)
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %v", typ)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Package tracing exports a span for every probe query over OTLP/HTTP, so probe
+// latency can be seen next to the DNS spans of applications in the same backend.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serviceName is the service.name of the exported spans.
+const serviceName = "corednsprobe"
+
+// tracer creates the query spans. Until Start is called it comes from the
+// global no-op provider, so spans cost next to nothing without an endpoint.
+var tracer = otel.Tracer("github.com/paulgmiller/corednsprobe")
+
+// Start exports spans to the OTLP/HTTP collector at endpoint, e.g.
+// http://otel-collector:4318, with attrs as resource attributes. Without a path,
+// the standard /v1/traces is used. The returned function flushes pending spans
+// and must be called before exiting.
+func Start(ctx context.Context, endpoint string, attrs map[string]string) (func(context.Context) error, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q, expected a URL such as http://otel-collector:4318", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %w", err)
+	}
+	return install(exporter, attrs).Shutdown, nil
+}
+
+// install makes spans go to exporter, in batches.
+func install(exporter sdktrace.SpanExporter, attrs map[string]string) *sdktrace.TracerProvider {
+	kvs := []attribute.KeyValue{attribute.String("service.name", serviceName)}
+	for k, v := range attrs {
+		kvs = append(kvs, attribute.String(k, v))
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(kvs...)),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer("github.com/paulgmiller/corednsprobe")
+	return provider
+}
+
+// Query is the span of one probe query.
+type Query struct {
+	span trace.Span
+}
+
+// StartQuery starts the span of a query for name to endpoint. The returned
+// context carries it, for spans of the lookup itself.
+func StartQuery(ctx context.Context, endpoint, proto, qtype, name string) (context.Context, Query) {
+	ctx, span := tracer.Start(ctx, "dns.probe",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("endpoint", endpoint),
+			attribute.String("query_domain", name),
+			attribute.String("query_type", qtype),
+			attribute.String("proto", proto),
+		))
+	return ctx, Query{span: span}
+}
+
+// End records the outcome of the query and ends its span. A reason other than
+// empty or "slow" marks the span as failed.
+func (q Query) End(status, reason string, rtt time.Duration) {
+	q.span.SetAttributes(
+		attribute.String("status", status),
+		attribute.Float64("rtt_ms", float64(rtt.Nanoseconds())/1e6),
+	)
+	if reason != "" {
+		q.span.SetAttributes(attribute.String("reason", reason))
+	}
+	if reason != "" && reason != "slow" {
+		q.span.SetStatus(codes.Error, reason)
+	}
+	q.span.End()
+}
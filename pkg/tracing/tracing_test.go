@@ -0,0 +1,52 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestQuerySpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := install(exporter, map[string]string{"k8s.cluster.name": "prod"})
+
+	_, q := StartQuery(context.Background(), "10.0.0.1", "udp", "A", "bing.com")
+	q.End("success", "", 2500*time.Microsecond)
+	_, q = StartQuery(context.Background(), "10.0.0.2", "udp", "A", "bing.com")
+	q.End("error", "servfail", time.Millisecond)
+	if err := provider.ForceFlush(context.Background()); err != nil {
+		t.Fatalf("ForceFlush: %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range spans[0].Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs["endpoint"].AsString() != "10.0.0.1" || attrs["query_domain"].AsString() != "bing.com" ||
+		attrs["status"].AsString() != "success" || attrs["rtt_ms"].AsFloat64() != 2.5 {
+		t.Errorf("unexpected attributes %v", spans[0].Attributes)
+	}
+	if spans[0].Status.Code == codes.Error {
+		t.Errorf("expected a successful query not to be an error")
+	}
+	if spans[1].Status.Code != codes.Error || spans[1].Status.Description != "servfail" {
+		t.Errorf("expected the failed query to be an error with its reason, got %v", spans[1].Status)
+	}
+	if v, ok := spans[0].Resource.Set().Value("k8s.cluster.name"); !ok || v.AsString() != "prod" {
+		t.Errorf("expected the resource attributes on the spans")
+	}
+}
+
+func TestStartInvalidEndpoint(t *testing.T) {
+	if _, err := Start(context.Background(), "otel-collector:4318", nil); err == nil {
+		t.Error("expected an error for an endpoint without a scheme")
+	}
+}
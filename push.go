@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/paulgmiller/corednsprobe/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// pushJob is the job the metrics are grouped under on the Pushgateway, and
+// labelled with when remote written.
+const pushJob = "corednsprobe"
+
+// pushTimeout bounds a single push, so an unavailable Pushgateway cannot stall
+// the summary or shutdown.
+const pushTimeout = 10 * time.Second
+
+// pusher sends the metrics to the Pushgateway given by --pushgateway-url; nil
+// when pushing is disabled.
+var pusher *push.Pusher
+
+// newPusher returns a Pusher for url that groups the metrics by job and by
+// instance, so that replicas do not overwrite each other.
+func newPusher(url string) *push.Pusher {
+	return push.New(url, pushJob).Gatherer(metrics.Gatherer()).Grouping("instance", pushInstance())
+}
+
+// pushInstance is the instance label of pushed and remote-written metrics: the
+// hostname, which is the pod name.
+func pushInstance() string {
+	instance, err := os.Hostname()
+	if err != nil {
+		log.Printf("getting the hostname for the instance label: %v", err)
+		return "unknown"
+	}
+	return instance
+}
+
+// pushMetrics replaces this instance's metrics on the Pushgateway with the
+// current ones. Failures are logged rather than returned, like remote writes.
+func pushMetrics(ctx context.Context) {
+	if pusher == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, pushTimeout)
+	defer cancel()
+	if err := pusher.PushContext(ctx); err != nil {
+		log.Printf("pushing metrics to the Pushgateway: %v", err)
+	}
+}
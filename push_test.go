@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulgmiller/corednsprobe/pkg/metrics"
+)
+
+func TestPushMetrics(t *testing.T) {
+	type request struct {
+		method, path, body string
+	}
+	requests := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{r.Method, r.URL.Path, string(body)}
+	}))
+	defer server.Close()
+
+	if err := metrics.Register(); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	metrics.RecordQuery("10.0.8.1", metrics.TestPositive, "A", "udp", metrics.QuerySuccess, "", time.Millisecond)
+	pusher = newPusher(server.URL)
+	defer func() { pusher = nil }()
+	pushMetrics(context.Background())
+
+	r := <-requests
+	host, _ := os.Hostname()
+	if expected := "/metrics/job/corednsprobe/instance/" + host; r.method != http.MethodPut || r.path != expected {
+		t.Errorf("expected PUT %s, got %s %s", expected, r.method, r.path)
+	}
+	if !strings.Contains(r.body, "coredns_probe_queries_total") {
+		t.Errorf("expected the probe metrics in the push")
+	}
+}
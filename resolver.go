@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/paulgmiller/corednsprobe/pkg/criteria"
+	"github.com/paulgmiller/corednsprobe/pkg/metrics"
+)
+
+// lookupQuery sends the probe queries: lookupThrough, or lookupResolver once
+// initLookup fell back to it.
+var lookupQuery = lookupThrough
+
+// checkDNSClient reports whether the miekg/dns clients can send the queries as
+// configured, e.g. whether a UDP socket can be opened and a query with the
+// options of --dns-flags packs. It is a variable so that tests can simulate a
+// failure.
+var checkDNSClient = func() error {
+	for _, proto := range protocols {
+		if proto == "doh" {
+			if dohClient == nil {
+				return errors.New("no DNS-over-HTTPS client")
+			}
+		} else if dnsClients[proto] == nil {
+			return fmt.Errorf("no DNS client for %s", proto)
+		}
+		if proto == "udp" {
+			conn, err := net.ListenPacket("udp", ":0")
+			if err != nil {
+				return fmt.Errorf("opening a UDP socket: %w", err)
+			}
+			conn.Close()
+		}
+	}
+	if _, err := newQuery(".", dns.StringToType[queryType]).Pack(); err != nil {
+		return fmt.Errorf("packing a query: %w", err)
+	}
+	return nil
+}
+
+// initLookup checks the miekg/dns path and, if it cannot be used, falls back to
+// lookupResolver with a warning, so that basic probing keeps working. Features
+// that need miekg/dns are then off: query options, retries, search domains and
+// the truncation test. coredns_probe_degraded reports the fallback. DNS-over-TLS
+// and DNS-over-HTTPS have no fallback, so their failure is returned.
+func initLookup() error {
+	err := checkDNSClient()
+	metrics.SetDegraded(err != nil)
+	if err == nil {
+		return nil
+	}
+	for _, proto := range protocols {
+		if proto != "udp" && proto != "tcp" {
+			return fmt.Errorf("initializing the DNS client: %w; --protocol %s has no fallback", err, proto)
+		}
+	}
+	log.Printf("WARNING: initializing the DNS client failed, falling back to net.Resolver without query options, retries, search domains or the truncation test: %v", err)
+	lookupQuery, truncationDomain = lookupResolver, ""
+	return nil
+}
+
+// lookupResolver is the degraded lookupThrough built on net.Resolver: it sends
+// the queries of the Go resolver for name to hostPort over proto, "udp" or "tcp",
+// without retries. The Go resolver does not expose the response code, so
+// NXDOMAIN also covers NOERROR responses without answers, and SERVFAIL covers
+// REFUSED and other server failures.
+func lookupResolver(ctx context.Context, hostPort, proto, name string) ([]string, time.Duration, error) {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: queryTimeout}
+			return d.DialContext(ctx, proto, hostPort)
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	// A fully qualified name keeps the Go resolver from applying its search list.
+	if queryType != "PTR" {
+		name = dns.Fqdn(name)
+	}
+	start := time.Now()
+	answers, err := resolve(ctx, resolver, queryType, name)
+	return answers, time.Since(start), resolverError(err)
+}
+
+// resolve looks up one record type through resolver and renders the answers like
+// answerStrings.
+func resolve(ctx context.Context, resolver *net.Resolver, qtype, name string) ([]string, error) {
+	switch qtype {
+	case "A", "AAAA":
+		network := "ip4"
+		if qtype == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := resolver.LookupNetIP(ctx, network, name)
+		answers := make([]string, len(ips))
+		for i, ip := range ips {
+			answers[i] = ip.String()
+		}
+		return answers, err
+	case "TXT":
+		return resolver.LookupTXT(ctx, name)
+	case "MX":
+		mxs, err := resolver.LookupMX(ctx, name)
+		answers := make([]string, len(mxs))
+		for i, mx := range mxs {
+			answers[i] = fmt.Sprintf("%d %s", mx.Pref, mx.Host)
+		}
+		return answers, err
+	case "SRV":
+		_, srvs, err := resolver.LookupSRV(ctx, "", "", name)
+		answers := make([]string, len(srvs))
+		for i, srv := range srvs {
+			answers[i] = fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target)
+		}
+		return answers, err
+	case "NS":
+		nss, err := resolver.LookupNS(ctx, name)
+		answers := make([]string, len(nss))
+		for i, ns := range nss {
+			answers[i] = ns.Host
+		}
+		return answers, err
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return []string{cname}, nil
+	case "PTR":
+		return resolver.LookupAddr(ctx, name)
+	default:
+		return nil, fmt.Errorf("unsupported query type %q", qtype)
+	}
+}
+
+// resolverError turns the net.DNSError of a failed lookup into the
+// criteria.RcodeError lookupThrough would have returned, as far as it can tell.
+func resolverError(err error) error {
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.IsTimeout {
+		return err
+	}
+	switch {
+	case dnsErr.IsNotFound:
+		return &criteria.RcodeError{Rcode: criteria.RcodeNXDomain}
+	case dnsErr.IsTemporary:
+		return &criteria.RcodeError{Rcode: criteria.RcodeServFail}
+	}
+	return err
+}
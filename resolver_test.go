@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/paulgmiller/corednsprobe/pkg/criteria"
+	"github.com/paulgmiller/corednsprobe/pkg/dnstest"
+)
+
+// TestCheckDNSClient checks that a working setup, which can open a UDP socket, is
+// not reported as degraded.
+func TestCheckDNSClient(t *testing.T) {
+	queryType, protocols = "A", []string{"udp", "tcp"}
+	if err := checkDNSClient(); err != nil {
+		t.Errorf("expected the DNS client to work, got %v", err)
+	}
+}
+
+// TestInitLookupFallback simulates a DNS client that fails to initialize and
+// checks that probing falls back to net.Resolver and still resolves.
+func TestInitLookupFallback(t *testing.T) {
+	server := dnstest.Start(t)
+	server.Handle("ok.example", dnstest.Response{Answers: []string{"192.0.2.1"}})
+	queryType, queryTimeout, protocols, truncationDomain = "A", time.Second, []string{"udp", "tcp"}, "big.example"
+	defer func(check func() error) {
+		checkDNSClient, lookupQuery, truncationDomain = check, lookupThrough, ""
+	}(checkDNSClient)
+	checkDNSClient = func() error { return errors.New("broken") }
+
+	if err := initLookup(); err != nil {
+		t.Fatalf("expected a fallback, got %v", err)
+	}
+	if truncationDomain != "" {
+		t.Errorf("expected the truncation test to be off, got %q", truncationDomain)
+	}
+	for _, proto := range protocols {
+		answers, _, err := lookupQuery(context.Background(), server.Addr, proto, "ok.example")
+		if err != nil || !slices.Equal(answers, []string{"192.0.2.1"}) {
+			t.Errorf("%s: expected [192.0.2.1], got %v, %v", proto, answers, err)
+		}
+	}
+	_, _, err := lookupQuery(context.Background(), server.Addr, "udp", "missing.example")
+	var rcodeErr *criteria.RcodeError
+	if !errors.As(err, &rcodeErr) || rcodeErr.Rcode != criteria.RcodeNXDomain {
+		t.Errorf("expected NXDOMAIN, got %v", err)
+	}
+
+	protocols = []string{"dot"}
+	if err := initLookup(); err == nil {
+		t.Error("expected an error for DNS-over-TLS, which has no fallback")
+	}
+}
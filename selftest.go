@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// SelfTestCmd is the selftest subcommand; it has no options of its own.
+type SelfTestCmd struct{}
+
+// check is one independent self-test step. run returns an optional detail for
+// the PASS line, or an error.
+type check struct {
+	name string
+	run  func(ctx context.Context) (string, error)
+}
+
+// runSelfTest reports pass/fail for each check on w and returns whether all passed.
+// With servers, the --servers list, it only dials those and needs no cluster.
+// Otherwise it checks the discovery source that mode, the --discovery-mode,
+// resolves to.
+func runSelfTest(ctx context.Context, w io.Writer, servers []string, mode string) bool {
+	if len(servers) > 0 {
+		return runChecks(ctx, w, staticSelfTestChecks(servers, 2*time.Second))
+	}
+	client, err := newClient()
+	if err != nil {
+		fmt.Fprintf(w, "FAIL  kubernetes client: %v\n", err)
+		return false
+	}
+	if mode = strings.ToLower(mode); mode == discoveryAuto {
+		mode = detectDiscoveryMode(ctx, client)
+	}
+	return runChecks(ctx, w, selfTestChecks(client, mode, 2*time.Second))
+}
+
+// selfTestChecks verifies, without sending DNS queries, what the probe needs at
+// startup: API access, RBAC for discovery, the Service, and a reachable endpoint.
+// mode is the discovery source, discoveryEndpointSlices or discoveryEndpoints.
+func selfTestChecks(client kubernetes.Interface, mode string, dialTimeout time.Duration) []check {
+	var eps []endpoint
+	discover := check{
+		name: "EndpointSlices can be listed",
+		run: func(ctx context.Context) (string, error) {
+			slices, err := client.DiscoveryV1().EndpointSlices(namespace).
+				List(ctx, metav1.ListOptions{LabelSelector: sliceLabel + "=" + serviceName})
+			if err != nil {
+				return "", err
+			}
+			eps = endpointsFromSlices(slices.Items, nil, probeNotReady)
+			if len(eps) == 0 {
+				return "", fmt.Errorf("no endpoints in %d EndpointSlices for %s/%s", len(slices.Items), namespace, serviceName)
+			}
+			return fmt.Sprintf("%d endpoints", len(eps)), nil
+		},
+	}
+	if mode == discoveryEndpoints {
+		discover = check{
+			name: "Endpoints can be read",
+			run: func(ctx context.Context) (string, error) {
+				legacy, err := client.CoreV1().Endpoints(namespace).Get(ctx, serviceName, metav1.GetOptions{})
+				if err != nil {
+					return "", err
+				}
+				eps = endpointsFromEndpoints(legacy, nil, probeNotReady)
+				if len(eps) == 0 {
+					return "", fmt.Errorf("no endpoints in Endpoints %s/%s", namespace, serviceName)
+				}
+				return fmt.Sprintf("%d endpoints", len(eps)), nil
+			},
+		}
+	}
+	return []check{
+		{
+			name: "Kubernetes API reachable",
+			run: func(ctx context.Context) (string, error) {
+				v, err := client.Discovery().ServerVersion()
+				if err != nil {
+					return "", err
+				}
+				return "server version " + v.GitVersion, nil
+			},
+		},
+		{
+			name: fmt.Sprintf("Service %s/%s exists", namespace, serviceName),
+			run: func(ctx context.Context) (string, error) {
+				_, err := client.CoreV1().Services(namespace).Get(ctx, serviceName, metav1.GetOptions{})
+				return "", err
+			},
+		},
+		discover,
+		dialCheck(&eps, dialTimeout),
+	}
+}
+
+// staticSelfTestChecks verifies that the --servers list parses and that one of
+// its servers is reachable, like selfTestChecks does for discovered endpoints.
+func staticSelfTestChecks(servers []string, dialTimeout time.Duration) []check {
+	var eps []endpoint
+	return []check{
+		{
+			name: "Servers can be parsed",
+			run: func(context.Context) (string, error) {
+				var err error
+				eps, err = staticEndpoints(servers)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("%d servers", len(eps)), nil
+			},
+		},
+		dialCheck(&eps, dialTimeout),
+	}
+}
+
+// dialCheck passes once one of the endpoints found by an earlier check accepts a
+// TCP connection on its DNS port.
+func dialCheck(eps *[]endpoint, dialTimeout time.Duration) check {
+	return check{
+		name: "An endpoint accepts TCP connections on its DNS port",
+		run: func(ctx context.Context) (string, error) {
+			if len(*eps) == 0 {
+				return "", errors.New("no endpoints discovered")
+			}
+			var errs []error
+			for _, ep := range *eps {
+				d := net.Dialer{Timeout: dialTimeout}
+				conn, err := d.DialContext(ctx, "tcp", ep.hostPortFor("tcp"))
+				if err == nil {
+					conn.Close()
+					return "connected to " + ep.hostPortFor("tcp"), nil
+				}
+				errs = append(errs, err)
+			}
+			return "", errors.Join(errs...)
+		},
+	}
+}
+
+// runChecks runs every check, even after a failure, so each reports independently.
+func runChecks(ctx context.Context, w io.Writer, checks []check) bool {
+	ok := true
+	for _, c := range checks {
+		detail, err := c.run(ctx)
+		switch {
+		case err != nil:
+			ok = false
+			fmt.Fprintf(w, "FAIL  %s: %v\n", c.name, err)
+		case detail != "":
+			fmt.Fprintf(w, "PASS  %s: %s\n", c.name, detail)
+		default:
+			fmt.Fprintf(w, "PASS  %s\n", c.name)
+		}
+	}
+	return ok
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSelfTestChecks(t *testing.T) {
+	namespace, serviceName = "kube-system", "kube-dns"
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	port, _ := strconv.Atoi(strings.TrimPrefix(l.Addr().String(), "127.0.0.1:"))
+
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "kube-dns", Namespace: "kube-system"}}
+	slice := func(addr string) *v1.EndpointSlice {
+		name, udp, p := "dns", corev1.ProtocolUDP, int32(port)
+		return &v1.EndpointSlice{
+			ObjectMeta:  metav1.ObjectMeta{Name: "kube-dns-" + addr, Namespace: "kube-system", Labels: map[string]string{sliceLabel: "kube-dns"}},
+			AddressType: v1.AddressTypeIPv4,
+			Ports:       []v1.EndpointPort{{Name: &name, Protocol: &udp, Port: &p}},
+			Endpoints:   []v1.Endpoint{{Addresses: []string{addr}}},
+		}
+	}
+
+	legacy := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-dns", Namespace: "kube-system"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: "127.0.0.1"}},
+			Ports:     []corev1.EndpointPort{{Name: "dns", Protocol: corev1.ProtocolUDP, Port: int32(port)}},
+		}},
+	}
+
+	testCases := []struct {
+		name     string
+		mode     string
+		objects  []runtime.Object
+		expectOK bool
+		expected []string
+	}{
+		{
+			name:     "all_pass",
+			mode:     discoveryEndpointSlices,
+			objects:  []runtime.Object{service, slice("127.0.0.1")},
+			expectOK: true,
+			expected: []string{"PASS  Kubernetes API", "PASS  Service kube-system/kube-dns", "PASS  EndpointSlices can be listed: 1 endpoints", "PASS  An endpoint accepts TCP"},
+		},
+		{
+			name:     "legacy_endpoints",
+			mode:     discoveryEndpoints,
+			objects:  []runtime.Object{service, legacy},
+			expectOK: true,
+			expected: []string{"PASS  Kubernetes API", "PASS  Service kube-system/kube-dns", "PASS  Endpoints can be read: 1 endpoints", "PASS  An endpoint accepts TCP"},
+		},
+		{
+			name:     "missing_service_and_endpoints",
+			mode:     discoveryEndpointSlices,
+			expectOK: false,
+			expected: []string{"PASS  Kubernetes API", "FAIL  Service kube-system/kube-dns", "FAIL  EndpointSlices can be listed: no endpoints", "FAIL  An endpoint accepts TCP"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(tc.objects...)
+			var out bytes.Buffer
+			ok := runChecks(context.Background(), &out, selfTestChecks(client, tc.mode, time.Second))
+			if ok != tc.expectOK {
+				t.Errorf("expected ok=%v, got %v:\n%s", tc.expectOK, ok, out.String())
+			}
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			if len(lines) != len(tc.expected) {
+				t.Fatalf("expected %d lines, got %d:\n%s", len(tc.expected), len(lines), out.String())
+			}
+			for i, prefix := range tc.expected {
+				if !strings.HasPrefix(lines[i], prefix) {
+					t.Errorf("line %d: expected prefix %q, got %q", i, prefix, lines[i])
+				}
+			}
+		})
+	}
+}
+
+func TestStaticSelfTestChecks(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	testCases := []struct {
+		name     string
+		servers  []string
+		expectOK bool
+		expected []string
+	}{
+		{
+			name:     "reachable",
+			servers:  []string{l.Addr().String()},
+			expectOK: true,
+			expected: []string{"PASS  Servers can be parsed: 1 servers", "PASS  An endpoint accepts TCP connections on its DNS port: connected to " + l.Addr().String()},
+		},
+		{
+			name:     "invalid",
+			servers:  []string{"dns.example.com"},
+			expectOK: false,
+			expected: []string{"FAIL  Servers can be parsed", "FAIL  An endpoint accepts TCP"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			ok := runChecks(context.Background(), &out, staticSelfTestChecks(tc.servers, time.Second))
+			if ok != tc.expectOK {
+				t.Errorf("expected ok=%v, got %v:\n%s", tc.expectOK, ok, out.String())
+			}
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			if len(lines) != len(tc.expected) {
+				t.Fatalf("expected %d lines, got %d:\n%s", len(tc.expected), len(lines), out.String())
+			}
+			for i, prefix := range tc.expected {
+				if !strings.HasPrefix(lines[i], prefix) {
+					t.Errorf("line %d: expected prefix %q, got %q", i, prefix, lines[i])
+				}
+			}
+		})
+	}
+}
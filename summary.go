@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulgmiller/corednsprobe/pkg/metrics"
+)
+
+// writeSummary emits the summary of the window of length elapsed in the
+// --log-format to summaryOut. With advance set, the next window starts now, the
+// summary is kept for /summary.json and the cluster success ratio and, with
+// --outlier-threshold, the outlier gauges are updated, also when summaryOut is
+// nil and nothing is written.
+func writeSummary(servers []string, discovered map[string]endpoint, stats []*epStats, elapsed time.Duration, advance bool) {
+	windows := make([]summaryWindow, len(stats))
+	for i, st := range stats {
+		windows[i] = st.summaryWindow(advance)
+	}
+	outliers := make([]string, len(servers))
+	if outlierThreshold > 0 {
+		outliers = findOutliers(servers, discovered, windows, outlierThreshold)
+		if advance {
+			for i, ip := range servers {
+				metrics.SetOutlier(ip, outliers[i] != "")
+			}
+		}
+	}
+	var cluster *float64 // in percent, nil without queries to weigh
+	if ratio, ok := clusterSuccess(servers, discovered, windows); ok {
+		cluster = ptr(ratio * 100)
+		if advance {
+			metrics.SetClusterSuccessRatio(ratio)
+		}
+	}
+	if advance {
+		latestSummary.Store(newSummaryJSON(servers, discovered, windows, outliers, cluster, elapsed))
+	}
+	switch {
+	case summaryOut == nil:
+	case logFormat == "json":
+		logSummary(summaryOut, servers, discovered, windows, outliers, cluster, elapsed)
+	default:
+		printSummary(summaryOut, servers, discovered, stats, windows, outliers, cluster, elapsed)
+	}
+}
+
+// printSummary writes the human-readable summary block to out, headed by the
+// cluster success in percent, if any, and marking the endpoints with an outlier
+// reason. With --summary-problems-only, only the endpoints with problems are
+// listed, most severe first, see problems. stats is only used for the last
+// health check result.
+func printSummary(out io.Writer, servers []string, discovered map[string]endpoint, stats []*epStats, windows []summaryWindow, outliers []string, cluster *float64, elapsed time.Duration) {
+	header := fmt.Sprintf("[summary] last %.0f s:", elapsed.Seconds())
+	if cluster != nil {
+		header += fmt.Sprintf(" cluster success %.1f %%", *cluster)
+	}
+	order := summaryOrder(servers, discovered, windows, outliers)
+	if problemsOnly {
+		if cluster != nil {
+			header += ","
+		}
+		if len(order) == 0 {
+			header += " no problems"
+		} else {
+			header += fmt.Sprintf(" %d of %d endpoints with problems", len(order), len(servers))
+		}
+	}
+	fmt.Fprintln(out, header)
+	for _, i := range order {
+		ip, w := servers[i], windows[i]
+		if w.total == 0 {
+			fmt.Fprintf(out, "  %s → no queries\n", ip)
+			continue
+		}
+		var outlier string
+		if outliers[i] != "" {
+			outlier = "  OUTLIER (" + outliers[i] + ")"
+		}
+		fmt.Fprintf(out, "  %s → %s%s%s%s%s\n", ip, formatRate(w.counts), formatPercentiles(w), stats[i].healthSuffix(), discovered[ip].summarySuffix(), outlier)
+		if reasons := formatReasons(w.reasons); reasons != "" {
+			fmt.Fprintf(out, "      failures: %s\n", reasons)
+		}
+		for n, name := range shardNames {
+			if c := w.names[n]; c.total > 0 {
+				fmt.Fprintf(out, "      %s → %s\n", name, formatRate(c))
+			}
+		}
+		if c := w.negative; c.total > 0 {
+			fmt.Fprintf(out, "      negative %s → %s\n", negativeDomain, formatRate(c))
+		}
+		if c := w.truncation; c.total > 0 {
+			fmt.Fprintf(out, "      truncation %s → %s\n", truncationDomain, formatRate(c))
+		}
+	}
+	fmt.Fprintln(out)
+}
+
+// logSummary writes one structured slog record per endpoint to out as JSON, for
+// log pipelines that index fields rather than parse text, preceded by a "cluster
+// summary" record with the cluster success in percent, if any. Like
+// printSummary, --summary-problems-only leaves out the endpoints without
+// problems.
+func logSummary(out io.Writer, servers []string, discovered map[string]endpoint, windows []summaryWindow, outliers []string, cluster *float64, elapsed time.Duration) {
+	logger := slog.New(slog.NewJSONHandler(out, nil))
+	order := summaryOrder(servers, discovered, windows, outliers)
+	if cluster != nil {
+		attrs := []any{slog.Float64("window_s", elapsed.Seconds()), slog.Float64("cluster_success_pct", *cluster)}
+		if problemsOnly {
+			attrs = append(attrs, slog.Int("problems", len(order)))
+		}
+		logger.Info("cluster summary", attrs...)
+	}
+	for _, i := range order {
+		ip, w := servers[i], windows[i]
+		ok := w.total - w.fail
+		attrs := []any{
+			slog.String("endpoint", ip),
+			slog.String("pod", discovered[ip].Pod),
+			slog.Float64("window_s", elapsed.Seconds()),
+			slog.Int64("total", w.total),
+			slog.Int64("success", ok),
+			slog.Int64("fail", w.fail),
+			slog.Int64("slow", w.slow),
+		}
+		if w.total > 0 {
+			attrs = append(attrs, slog.Float64("success_pct", float64(ok)/float64(w.total)*100))
+		}
+		if ok > 0 {
+			attrs = append(attrs, slog.Float64("avg_rtt_ms", float64(w.rttNanos)/float64(ok)/1e6))
+		}
+		if !math.IsNaN(w.rttP50) {
+			attrs = append(attrs, slog.Float64("p50_ms", w.rttP50), slog.Float64("p90_ms", w.rttP90), slog.Float64("p99_ms", w.rttP99))
+		}
+		if reasons := formatReasons(w.reasons); reasons != "" {
+			attrs = append(attrs, slog.String("failures", reasons))
+		}
+		if c := w.negative; c.total > 0 {
+			attrs = append(attrs, slog.Int64("negative_total", c.total), slog.Int64("negative_fail", c.fail))
+		}
+		if c := w.truncation; c.total > 0 {
+			attrs = append(attrs, slog.Int64("truncation_total", c.total), slog.Int64("truncation_fail", c.fail))
+		}
+		if outliers[i] != "" {
+			attrs = append(attrs, slog.String("outlier", outliers[i]))
+		}
+		if weight := weightOf(ip, discovered[ip]); weight != 1 {
+			attrs = append(attrs, slog.Float64("weight", weight))
+		}
+		logger.Info("summary", attrs...)
+	}
+}
+
+// summaryOrder returns the indexes of the endpoints to list in a summary: all of
+// them in order, or with --summary-problems-only those of problems.
+func summaryOrder(servers []string, discovered map[string]endpoint, windows []summaryWindow, outliers []string) []int {
+	if problemsOnly {
+		return problems(servers, discovered, windows, outliers)
+	}
+	order := make([]int, len(servers))
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
+
+// formatRate renders the success, failure and slow rates and the average
+// successful RTT of a summary line. Slow queries are included in the successes.
+func formatRate(c counts) string {
+	ok := c.total - c.fail
+	pct := func(n int64) float64 { return float64(n) / float64(c.total) * 100 }
+	avgRTTms := "n/a"
+	if ok > 0 {
+		avgRTTms = fmt.Sprintf("%.2f ms", float64(c.rttNanos)/float64(ok)/1e6)
+	}
+	return fmt.Sprintf("success %.1f %% (%d/%d)  fail %.1f %%  slow %.1f %%  avgRTT %s",
+		pct(ok), ok, c.total, pct(c.fail), pct(c.slow), avgRTTms)
+}
+
+// formatPercentiles renders the RTT percentiles of a summary line, or "" without
+// successes.
+func formatPercentiles(w summaryWindow) string {
+	if math.IsNaN(w.rttP50) {
+		return ""
+	}
+	return fmt.Sprintf("  p50 %.2f ms  p90 %.2f ms  p99 %.2f ms", w.rttP50, w.rttP90, w.rttP99)
+}
+
+// latestSummary is the summary of the last completed window, served on
+// /summary.json.
+var latestSummary atomic.Pointer[summaryJSON]
+
+// summaryJSON is a summary as served on /summary.json, with the fields of the
+// JSON summary records.
+type summaryJSON struct {
+	Time              time.Time         `json:"time"`
+	WindowS           float64           `json:"window_s"`
+	ClusterSuccessPct *float64          `json:"cluster_success_pct,omitempty"`
+	Endpoints         []endpointSummary `json:"endpoints"`
+}
+
+// endpointSummary is the summary of one endpoint in a summaryJSON. Rates and RTTs
+// are left out without queries or successes to compute them from.
+type endpointSummary struct {
+	Endpoint   string           `json:"endpoint"`
+	Pod        string           `json:"pod,omitempty"`
+	Total      int64            `json:"total"`
+	Success    int64            `json:"success"`
+	Fail       int64            `json:"fail"`
+	Slow       int64            `json:"slow"`
+	SuccessPct *float64         `json:"success_pct,omitempty"`
+	AvgRTTms   *float64         `json:"avg_rtt_ms,omitempty"`
+	P50ms      *float64         `json:"p50_ms,omitempty"`
+	P90ms      *float64         `json:"p90_ms,omitempty"`
+	P99ms      *float64         `json:"p99_ms,omitempty"`
+	Failures   map[string]int64 `json:"failures,omitempty"`
+	Outlier    string           `json:"outlier,omitempty"`
+	Weight     float64          `json:"weight"`
+}
+
+func newSummaryJSON(servers []string, discovered map[string]endpoint, windows []summaryWindow, outliers []string, cluster *float64, elapsed time.Duration) *summaryJSON {
+	s := &summaryJSON{Time: time.Now(), WindowS: elapsed.Seconds(), ClusterSuccessPct: cluster, Endpoints: make([]endpointSummary, len(servers))}
+	for i, ip := range servers {
+		w := windows[i]
+		ok := w.total - w.fail
+		e := endpointSummary{Endpoint: ip, Pod: discovered[ip].Pod, Total: w.total, Success: ok, Fail: w.fail, Slow: w.slow, Outlier: outliers[i], Weight: weightOf(ip, discovered[ip])}
+		if w.total > 0 {
+			e.SuccessPct = ptr(float64(ok) / float64(w.total) * 100)
+		}
+		if ok > 0 {
+			e.AvgRTTms = ptr(float64(w.rttNanos) / float64(ok) / 1e6)
+		}
+		if !math.IsNaN(w.rttP50) {
+			e.P50ms, e.P90ms, e.P99ms = ptr(w.rttP50), ptr(w.rttP90), ptr(w.rttP99)
+		}
+		for r, n := range w.reasons {
+			if e.Failures == nil {
+				e.Failures = make(map[string]int64)
+			}
+			e.Failures[string(r)] = n
+		}
+		s.Endpoints[i] = e
+	}
+	return s
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// summaryHandler serves the summary of the last completed window as JSON, for
+// tools that want the probe's view without parsing logs or querying Prometheus.
+// It answers 503 until the first summary.
+func summaryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		s := latestSummary.Load()
+		if s == nil {
+			http.Error(w, "no summary yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(s); err != nil {
+			log.Printf("writing /summary.json: %v", err)
+		}
+	})
+}
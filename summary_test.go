@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/paulgmiller/corednsprobe/pkg/criteria"
+	"github.com/paulgmiller/corednsprobe/pkg/metrics"
+)
+
+func TestLogSummary(t *testing.T) {
+	var buf bytes.Buffer
+	st := newEpStats(0)
+	st.c = counts{total: 4, fail: 1, rttNanos: 6e6}
+	st.recordFailure(criteria.ReasonTimeout)
+	windows := []summaryWindow{st.summaryWindow(true)}
+	logSummary(&buf, []string{"10.0.0.1"}, map[string]endpoint{"10.0.0.1": {Addr: "10.0.0.1", Pod: "coredns-a"}}, windows, []string{"avg RTT"}, nil, 10*time.Second)
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("parsing %q: %v", buf.String(), err)
+	}
+	expected := map[string]any{
+		"msg":         "summary",
+		"window_s":    10.0,
+		"endpoint":    "10.0.0.1",
+		"pod":         "coredns-a",
+		"total":       4.0,
+		"success":     3.0,
+		"fail":        1.0,
+		"success_pct": 75.0,
+		"avg_rtt_ms":  2.0,
+		"failures":    "timeout: 1",
+		"outlier":     "avg RTT",
+	}
+	for k, v := range expected {
+		if record[k] != v {
+			t.Errorf("expected %s %v, got %v", k, v, record[k])
+		}
+	}
+}
+
+func TestWriteSummaryOutput(t *testing.T) {
+	defer func() { summaryOut = nil }()
+	servers := []string{"10.0.0.1"}
+	discovered := map[string]endpoint{"10.0.0.1": {Addr: "10.0.0.1"}}
+	st := newEpStats(0)
+	st.add(metrics.QuerySuccess, criteria.ReasonNone, time.Millisecond)
+
+	var buf bytes.Buffer
+	summaryOut = &buf
+	writeSummary(servers, discovered, []*epStats{st}, 10*time.Second, false)
+	if expected := "  10.0.0.1 → success 100.0 % (1/1)"; !strings.Contains(buf.String(), expected) {
+		t.Errorf("expected the summary to contain %q, got %q", expected, buf.String())
+	}
+
+	// With --summary-output none nothing is written, but the window still ends.
+	summaryOut = nil
+	writeSummary(servers, discovered, []*epStats{st}, 10*time.Second, true)
+	if w := st.summaryWindow(false); w.total != 0 {
+		t.Errorf("expected the window to end without output, got %+v", w)
+	}
+}
+
+func TestSummaryHandler(t *testing.T) {
+	latestSummary.Store(nil)
+	defer latestSummary.Store(nil)
+	handler := summaryHandler()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/summary.json", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 before the first summary, got %d", rec.Code)
+	}
+
+	st := newEpStats(0)
+	for _, ms := range []int{1, 2, 3, 100} {
+		rtt := time.Duration(ms) * time.Millisecond
+		st.add(metrics.QuerySuccess, criteria.ReasonNone, rtt)
+		st.observeRTT(rtt)
+	}
+	st.add(metrics.QueryTimeout, criteria.ReasonTimeout, time.Second)
+	st.recordFailure(criteria.ReasonTimeout)
+	writeSummary([]string{"10.0.0.1"}, map[string]endpoint{"10.0.0.1": {Addr: "10.0.0.1", Pod: "coredns-a"}}, []*epStats{st}, 10*time.Second, true)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/summary.json", nil))
+	var got summaryJSON
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("parsing %q: %v", rec.Body.String(), err)
+	}
+	if got.WindowS != 10 || len(got.Endpoints) != 1 {
+		t.Fatalf("expected a 10 s window with 1 endpoint, got %+v", got)
+	}
+	if got.ClusterSuccessPct == nil || *got.ClusterSuccessPct != 80 {
+		t.Errorf("expected a cluster success of 80 %%, got %v", got.ClusterSuccessPct)
+	}
+	e := got.Endpoints[0]
+	if e.Endpoint != "10.0.0.1" || e.Pod != "coredns-a" || e.Total != 5 || e.Fail != 1 || e.Failures["timeout"] != 1 || e.Weight != 1 {
+		t.Errorf("unexpected endpoint summary %+v", e)
+	}
+	// The average hides the slow query that the tail percentiles show.
+	if e.AvgRTTms == nil || *e.AvgRTTms != 26.5 || e.P50ms == nil || *e.P50ms != 2 || e.P90ms == nil || *e.P90ms != 100 || e.P99ms == nil || *e.P99ms != 100 {
+		t.Errorf("expected avg 26.5 ms, p50 2 ms, p90 100 ms and p99 100 ms, got %+v", e)
+	}
+}
+
+func TestSummaryWindow(t *testing.T) {
+	shardNames = []string{"a.example."}
+	defer func() { shardNames = nil }()
+	st := newEpStats(1)
+	record := func(n int, reason criteria.Reason) {
+		for range n {
+			status := metrics.QuerySuccess
+			if reason != criteria.ReasonNone {
+				status = metrics.QueryError
+				st.recordFailure(reason)
+			}
+			st.add(status, reason, time.Millisecond)
+			st.names[0].add(status, reason, time.Millisecond)
+		}
+	}
+
+	record(3, criteria.ReasonNone)
+	record(1, criteria.ReasonTimeout)
+	if w := st.summaryWindow(true); w.total != 4 || w.fail != 1 || w.names[0].total != 4 || formatReasons(w.reasons) != "timeout: 1" {
+		t.Errorf("first window: expected 4 queries and 1 timeout, got %+v", w)
+	}
+
+	record(2, criteria.ReasonNone)
+	record(1, criteria.Reason("servfail"))
+	// An on-demand summary shows the current window without ending it.
+	if w := st.summaryWindow(false); w.total != 3 || w.fail != 1 {
+		t.Errorf("on-demand window: expected 3 queries and 1 failure, got %+v", w)
+	}
+	w := st.summaryWindow(true)
+	if w.total != 3 || w.fail != 1 || w.names[0].total != 3 || formatReasons(w.reasons) != "servfail: 1" {
+		t.Errorf("second window: expected only the queries since the first, got %+v", w)
+	}
+	if w := st.summaryWindow(true); w.total != 0 || len(w.reasons) != 0 {
+		t.Errorf("empty window: expected no queries, got %+v", w)
+	}
+}
+
+func TestSummaryWindowConcurrentProbes(t *testing.T) {
+	st := newEpStats(0)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 10000 {
+				status := metrics.QuerySuccess
+				if i%2 == 0 {
+					status = metrics.QueryError
+				}
+				st.add(status, criteria.ReasonNone, time.Millisecond)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Windows taken while probes are running must never have more failures
+	// than queries, which would show a success rate above 100%.
+	var total int64
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		w := st.summaryWindow(true)
+		if w.fail < 0 || w.fail > w.total || w.rttNanos != (w.total-w.fail)*int64(time.Millisecond) {
+			t.Fatalf("inconsistent window %+v", w.counts)
+		}
+		total += w.total
+	}
+	if total != 40000 {
+		t.Errorf("expected the windows to add up to 40000 queries, got %d", total)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/paulgmiller/corednsprobe/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// targets is the set of CoreDNS endpoints being probed, kept current by
+// watchEndpoints as CoreDNS pods come and go.
+type targets struct {
+	shards int        // number of shard names, for new epStats
+	pinned []endpoint // probed in addition to every update, e.g. the Service ClusterIP
+
+	// The slices and map are replaced, never modified, on update, so snapshots
+	// can be used without holding mu.
+	mu         sync.Mutex
+	servers    []string
+	discovered map[string]endpoint
+	stats      []*epStats // parallel to servers
+
+	removed []string // endpoints whose metrics are still to be deleted, see takeRemoved
+	listed  bool     // whether the initial list was applied, after which new endpoints start cold
+}
+
+func newTargets(shards int, pinned ...endpoint) *targets {
+	return &targets{shards: shards, pinned: pinned, discovered: make(map[string]endpoint)}
+}
+
+// snapshot returns the current endpoint addresses, their endpoints and their
+// stats, parallel to the addresses.
+func (t *targets) snapshot() ([]string, map[string]endpoint, []*epStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.servers, t.discovered, t.stats
+}
+
+// update replaces the probed endpoints with eps followed by the pinned ones.
+// Endpoints that are still present keep their stats; new ones start from zero and
+// those that disappeared are queued for takeRemoved. CoreDNS pods new since the
+// initial list enter their --coldstart-window, see runColdStart.
+func (t *targets) update(eps []endpoint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	eps = append(slices.Clip(eps), t.pinned...)
+	old := make(map[string]*epStats, len(t.servers))
+	for i, addr := range t.servers {
+		old[addr] = t.stats[i]
+	}
+
+	servers := make([]string, 0, len(eps))
+	discovered := make(map[string]endpoint, len(eps))
+	stats := make([]*epStats, 0, len(eps))
+	var added, cold []string
+	now := time.Now()
+	for _, ep := range eps {
+		st, ok := old[ep.Addr]
+		if !ok {
+			st = newEpStats(t.shards)
+			st.target = ep.Target
+			added = append(added, ep.Addr)
+			if t.listed && coldStartWindow > 0 && ep.Target == targetPod {
+				st.coldUntil = now.Add(coldStartWindow)
+				cold = append(cold, ep.Addr)
+			}
+		}
+		servers = append(servers, ep.Addr)
+		discovered[ep.Addr] = ep
+		stats = append(stats, st)
+		metrics.SetEndpointReady(ep.Addr, ep.Ready)
+		pod := ep.Pod
+		if pod == "" && ep.Target == targetPod {
+			// Keeps pods without a targetRef apart when grouping by pod.
+			pod = ep.Addr
+		}
+		metrics.SetEndpointInfo(ep.Addr, pod, ep.Node, ep.Zone, string(ep.Family), ep.Target)
+	}
+	var removed []string
+	for _, addr := range t.servers {
+		if _, ok := discovered[addr]; !ok {
+			removed = append(removed, addr)
+		}
+	}
+	t.removed = append(t.removed, removed...)
+
+	if len(added) > 0 || len(removed) > 0 {
+		log.Printf("CoreDNS endpoints changed: added %v, removed %v, now %d %v", added, removed, len(servers), servers)
+	}
+	if len(cold) > 0 {
+		log.Printf("Probing new CoreDNS endpoints %v every %v for %v", cold, coldStartEvery, coldStartWindow)
+	}
+	t.servers, t.discovered, t.stats, t.listed = servers, discovered, stats, true
+}
+
+// drift compares the probed endpoints with eps, a fresh list, and returns the
+// addresses of those in eps that are not probed or probed with other details, and
+// of those probed but no longer in eps. Pinned endpoints are not compared.
+func (t *targets) drift(eps []endpoint) (missing, stale []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fresh := make(map[string]bool, len(eps))
+	for _, ep := range eps {
+		fresh[ep.Addr] = true
+		if t.discovered[ep.Addr] != ep {
+			missing = append(missing, ep.Addr)
+		}
+	}
+	for _, addr := range t.servers {
+		if !fresh[addr] && !slices.ContainsFunc(t.pinned, func(p endpoint) bool { return p.Addr == addr }) {
+			stale = append(stale, addr)
+		}
+	}
+	return missing, stale
+}
+
+// takeRemoved returns the endpoints removed since the last call. The probe loop
+// deletes their metrics once no query from an older snapshot can still record
+// to them, so that no stale series is recreated.
+func (t *targets) takeRemoved() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	removed := t.removed
+	t.removed = nil
+	return removed
+}
+
+// watchEndpoints keeps t in sync with the EndpointSlices of the CoreDNS Service
+// until ctx is done. It returns once the initial list has been applied; the
+// informer retries failed lists, and an error is returned only if none succeeded
+// within discoveryTimeout. With reconcileEvery set, the endpoints are also
+// reconciled with a fresh list at that interval as a safety net for the watch.
+func watchEndpoints(ctx context.Context, client kubernetes.Interface, svc *corev1.Service, t *targets) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = sliceLabel + "=" + serviceName
+		}))
+	slicesInformer := factory.Discovery().V1().EndpointSlices()
+	informer, lister := slicesInformer.Informer(), slicesInformer.Lister()
+
+	resync := func() {
+		items, err := lister.List(labels.Everything())
+		if err != nil {
+			log.Printf("listing cached EndpointSlices: %v", err)
+			return
+		}
+		// Sort by name so the probe order does not depend on the cache's map order.
+		slices.SortFunc(items, func(a, b *v1.EndpointSlice) int {
+			return cmp.Compare(a.Name, b.Name)
+		})
+		esList := make([]v1.EndpointSlice, len(items))
+		for i, es := range items {
+			esList[i] = *es
+		}
+		t.update(probedEndpoints(esList, svc))
+	}
+	onChange := func() {
+		// Events for the initial list are covered by the resync after it.
+		if informer.HasSynced() {
+			resync()
+		}
+	}
+	// The informer reports failed lists and dropped watches here before retrying them.
+	if err := informer.SetWatchErrorHandlerWithContext(func(ctx context.Context, r *cache.Reflector, err error) {
+		if !errors.Is(err, io.EOF) && !apierrors.IsResourceExpired(err) && !apierrors.IsGone(err) {
+			metrics.RecordDiscoveryError()
+		}
+		cache.DefaultWatchErrorHandler(ctx, r, err)
+	}); err != nil {
+		return fmt.Errorf("watching EndpointSlices: %w", err)
+	}
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { onChange() },
+		UpdateFunc: func(any, any) { onChange() },
+		DeleteFunc: func(any) { onChange() },
+	}); err != nil {
+		return fmt.Errorf("watching EndpointSlices: %w", err)
+	}
+
+	start := time.Now()
+	factory.Start(ctx.Done())
+	syncCtx, cancel := withDiscoveryTimeout(ctx)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), informer.HasSynced) {
+		return fmt.Errorf("listing EndpointSlices for %s/%s: %w", namespace, serviceName, syncCtx.Err())
+	}
+	// Only the initial list, including its retries, is timed; the informer's
+	// relists after a lost watch are not.
+	metrics.RecordDiscoveryDuration(time.Since(start))
+	resync()
+
+	// A missed watch event leaves the informer's cache, and with it t, out of
+	// date until the slice changes again or, for a missed delete, for good. The
+	// fresh list replaces the cache so that later events do not bring the drift
+	// back. An event applied between the list and the replacement is undone, but
+	// the next reconciliation corrects that in turn.
+	reconcile := func() {
+		list, err := client.DiscoveryV1().EndpointSlices(namespace).
+			List(ctx, metav1.ListOptions{LabelSelector: sliceLabel + "=" + serviceName})
+		if err != nil {
+			if ctx.Err() == nil {
+				metrics.RecordDiscoveryError()
+				log.Printf("listing EndpointSlices to reconcile the probed endpoints: %v", err)
+			}
+			return
+		}
+		missing, stale := t.drift(probedEndpoints(list.Items, svc))
+		if len(missing) == 0 && len(stale) == 0 {
+			return
+		}
+		metrics.RecordEndpointDrift(len(missing) + len(stale))
+		log.Printf("probed endpoints drifted from the EndpointSlices, correcting: missing or changed %v, stale %v", missing, stale)
+		items := make([]any, len(list.Items))
+		for i := range list.Items {
+			items[i] = &list.Items[i]
+		}
+		if err := informer.GetIndexer().Replace(items, list.ResourceVersion); err != nil {
+			log.Printf("replacing cached EndpointSlices: %v", err)
+			return
+		}
+		resync()
+	}
+	if reconcileEvery > 0 {
+		go func() {
+			ticker := time.NewTicker(reconcileEvery)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					reconcile()
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// pollEndpoints is the lighter alternative to watchEndpoints: it lists the
+// EndpointSlices once and then every interval until ctx is done. The first list
+// is retried with backoff, and an error is returned only if it did not succeed
+// within discoveryTimeout. The returned channel is closed once polling stopped.
+func pollEndpoints(ctx context.Context, client kubernetes.Interface, svc *corev1.Service, t *targets, interval time.Duration) (<-chan struct{}, error) {
+	return poll(ctx, t, interval, func() ([]endpoint, error) {
+		endpointSlices, err := client.DiscoveryV1().EndpointSlices(namespace).
+			List(ctx, metav1.ListOptions{LabelSelector: sliceLabel + "=" + serviceName})
+		if err != nil {
+			return nil, fmt.Errorf("listing EndpointSlices for %s/%s: %w", namespace, serviceName, err)
+		}
+		return probedEndpoints(endpointSlices.Items, svc), nil
+	})
+}
+
+// pollLegacyEndpoints is pollEndpoints for clusters that do not serve
+// EndpointSlices: it reads the core/v1 Endpoints of the Service instead.
+func pollLegacyEndpoints(ctx context.Context, client kubernetes.Interface, svc *corev1.Service, t *targets, interval time.Duration) (<-chan struct{}, error) {
+	return poll(ctx, t, interval, func() ([]endpoint, error) {
+		eps, err := client.CoreV1().Endpoints(namespace).Get(ctx, serviceName, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("getting Endpoints %s/%s: %w", namespace, serviceName, err)
+		}
+		return inZone(endpointsFromEndpoints(eps, svc, probeNotReady)), nil
+	})
+}
+
+// poll updates t with the endpoints from list once and then every interval until
+// ctx is done, see pollEndpoints.
+func poll(ctx context.Context, t *targets, interval time.Duration, list func() ([]endpoint, error)) (<-chan struct{}, error) {
+	update := func() error {
+		start := time.Now()
+		eps, err := list()
+		metrics.RecordDiscoveryDuration(time.Since(start))
+		if err != nil {
+			metrics.RecordDiscoveryError()
+			return err
+		}
+		t.update(eps)
+		return nil
+	}
+	listCtx, cancel := withDiscoveryTimeout(ctx)
+	defer cancel()
+	for backoff := initialDiscoveryBackoff; ; backoff = min(2*backoff, maxDiscoveryBackoff) {
+		err := update()
+		if err == nil {
+			break
+		}
+		log.Printf("%v, retrying in %v", err, backoff)
+		select {
+		case <-listCtx.Done():
+			return nil, fmt.Errorf("%w, giving up after %v", err, discoveryTimeout)
+		case <-time.After(backoff):
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := update(); err != nil && ctx.Err() == nil {
+					log.Printf("rediscovering endpoints, keeping the current ones: %v", err)
+				}
+			}
+		}
+	}()
+	return done, nil
+}
+
+// Values of --discovery-mode.
+const (
+	discoveryAuto           = "auto"
+	discoveryEndpointSlices = "endpointslices"
+	discoveryEndpoints      = "endpoints"
+)
+
+// legacyPollInterval is how often the Endpoints API is polled without
+// --discovery-interval, since only EndpointSlices are watched.
+const legacyPollInterval = 30 * time.Second
+
+// detectDiscoveryMode picks discoveryEndpoints if the cluster does not serve the
+// EndpointSlice API or the probe may not list it, and discoveryEndpointSlices
+// otherwise, including on other errors, which discovery retries.
+func detectDiscoveryMode(ctx context.Context, client kubernetes.Interface) string {
+	_, err := client.DiscoveryV1().EndpointSlices(namespace).
+		List(ctx, metav1.ListOptions{LabelSelector: sliceLabel + "=" + serviceName, Limit: 1})
+	if apierrors.IsNotFound(err) || apierrors.IsForbidden(err) {
+		log.Printf("EndpointSlices are unavailable, falling back to the Endpoints API: %v", err)
+		return discoveryEndpoints
+	}
+	return discoveryEndpointSlices
+}
+
+// Bounds of the delay between retries of the first EndpointSlice list.
+var (
+	initialDiscoveryBackoff = time.Second
+	maxDiscoveryBackoff     = 30 * time.Second
+)
+
+// withDiscoveryTimeout bounds the initial discovery by discoveryTimeout; zero
+// leaves it bounded only by ctx.
+func withDiscoveryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if discoveryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, discoveryTimeout)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/paulgmiller/corednsprobe/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWatchEndpoints(t *testing.T) {
+	namespace, serviceName = "kube-system", "kube-dns"
+	slice := func(name string, addrs ...string) *v1.EndpointSlice {
+		es := &v1.EndpointSlice{
+			ObjectMeta:  metav1.ObjectMeta{Name: name, Namespace: "kube-system", Labels: map[string]string{sliceLabel: "kube-dns"}},
+			AddressType: v1.AddressTypeIPv4,
+		}
+		for _, addr := range addrs {
+			es.Endpoints = append(es.Endpoints, v1.Endpoint{Addresses: []string{addr}})
+		}
+		return es
+	}
+	other := slice("other", "10.0.9.9")
+	other.Labels[sliceLabel] = "other"
+	client := fake.NewClientset(slice("kube-dns-a", "10.0.0.1", "10.0.0.2"), other)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tg := newTargets(0)
+	if err := watchEndpoints(ctx, client, nil, tg); err != nil {
+		t.Fatalf("watchEndpoints: %v", err)
+	}
+	servers, _, stats := tg.snapshot()
+	if expected := []string{"10.0.0.1", "10.0.0.2"}; !slices.Equal(servers, expected) {
+		t.Fatalf("expected initial servers %v, got %v", expected, servers)
+	}
+	stats[0].c.total = 5
+
+	// 10.0.0.2 is rescheduled to 10.0.0.3.
+	esClient := client.DiscoveryV1().EndpointSlices("kube-system")
+	if _, err := esClient.Update(ctx, slice("kube-dns-a", "10.0.0.1", "10.0.0.3"), metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("updating EndpointSlice: %v", err)
+	}
+	expected := []string{"10.0.0.1", "10.0.0.3"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		servers, _, stats = tg.snapshot()
+		if slices.Equal(servers, expected) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected servers %v after update, got %v", expected, servers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := stats[0].load().total; got != 5 {
+		t.Errorf("expected the remaining endpoint to keep its stats, got total %d", got)
+	}
+	if got := stats[1].load().total; got != 0 {
+		t.Errorf("expected the new endpoint to start from zero, got total %d", got)
+	}
+	if removed := tg.takeRemoved(); !slices.Equal(removed, []string{"10.0.0.2"}) {
+		t.Errorf("expected 10.0.0.2 to be queued for metric deletion, got %v", removed)
+	}
+	if removed := tg.takeRemoved(); len(removed) != 0 {
+		t.Errorf("expected removed endpoints to be returned once, got %v", removed)
+	}
+}
+
+// TestWatchEndpointsReconcile drops every watch event, as if they were missed,
+// and checks that reconciling with a fresh list corrects the probed endpoints.
+func TestWatchEndpointsReconcile(t *testing.T) {
+	namespace, serviceName, reconcileEvery = "kube-system", "kube-dns", 20*time.Millisecond
+	defer func() { reconcileEvery = 0 }()
+	slice := func(addrs ...string) *v1.EndpointSlice {
+		es := &v1.EndpointSlice{
+			ObjectMeta:  metav1.ObjectMeta{Name: "kube-dns-a", Namespace: "kube-system", Labels: map[string]string{sliceLabel: "kube-dns"}},
+			AddressType: v1.AddressTypeIPv4,
+		}
+		for _, addr := range addrs {
+			es.Endpoints = append(es.Endpoints, v1.Endpoint{Addresses: []string{addr}})
+		}
+		return es
+	}
+	client := fake.NewClientset(slice("10.0.0.1", "10.0.0.2"))
+	client.PrependWatchReactor("endpointslices", func(k8stesting.Action) (bool, watch.Interface, error) {
+		return true, watch.NewFake(), nil
+	})
+	if err := metrics.Register(); err != nil {
+		t.Fatalf("registering metrics: %v", err)
+	}
+	before := driftCount(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tg := newTargets(0)
+	if err := watchEndpoints(ctx, client, nil, tg); err != nil {
+		t.Fatalf("watchEndpoints: %v", err)
+	}
+	// 10.0.0.2 is rescheduled to 10.0.0.3 without the watch noticing.
+	if _, err := client.DiscoveryV1().EndpointSlices("kube-system").Update(ctx, slice("10.0.0.1", "10.0.0.3"), metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("updating EndpointSlice: %v", err)
+	}
+	expected := []string{"10.0.0.1", "10.0.0.3"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if servers, _, _ := tg.snapshot(); slices.Equal(servers, expected) {
+			break
+		}
+		if time.Now().After(deadline) {
+			servers, _, _ := tg.snapshot()
+			t.Fatalf("expected servers %v after reconciling, got %v", expected, servers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 10.0.0.3 was missing and 10.0.0.2 stale.
+	if got := driftCount(t) - before; got != 2 {
+		t.Errorf("expected a drift of 2 endpoints, got %v", got)
+	}
+}
+
+// driftCount returns coredns_probe_endpoint_drift_total.
+func driftCount(t *testing.T) float64 {
+	t.Helper()
+	families, err := metrics.Gatherer().Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == "coredns_probe_endpoint_drift_total" {
+			return family.Metric[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestTargetsColdStart(t *testing.T) {
+	coldStartWindow = time.Minute
+	defer func() { coldStartWindow = 0 }()
+	pod := func(addr string) endpoint {
+		return endpoint{Addr: addr, Port: 53, Family: v1.AddressTypeIPv4, Ready: true, Target: targetPod}
+	}
+	tg := newTargets(0, endpoint{Addr: "10.96.0.10", Port: 53, Family: v1.AddressTypeIPv4, Ready: true, Target: targetService})
+
+	// Endpoints of the initial list were not just started.
+	tg.update([]endpoint{pod("10.0.0.1")})
+	tg.update([]endpoint{pod("10.0.0.1"), pod("10.0.0.2")})
+	servers, _, stats := tg.snapshot()
+	for i, addr := range servers {
+		cold := time.Now().Before(stats[i].coldUntil)
+		if expected := addr == "10.0.0.2"; cold != expected {
+			t.Errorf("%s: expected cold %v, got %v", addr, expected, cold)
+		}
+	}
+}
+
+func TestPollEndpoints(t *testing.T) {
+	namespace, serviceName = "kube-system", "kube-dns"
+	slice := &v1.EndpointSlice{
+		ObjectMeta:  metav1.ObjectMeta{Name: "kube-dns-a", Namespace: "kube-system", Labels: map[string]string{sliceLabel: "kube-dns"}},
+		AddressType: v1.AddressTypeIPv4,
+		Endpoints:   []v1.Endpoint{{Addresses: []string{"10.0.0.1"}}},
+	}
+	client := fake.NewClientset(slice)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tg := newTargets(0, endpoint{Addr: "10.96.0.10", Port: 53, Family: v1.AddressTypeIPv4, Ready: true, Target: targetService})
+	done, err := pollEndpoints(ctx, client, nil, tg, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("pollEndpoints: %v", err)
+	}
+	// Later tests change the globals the poll reads, so it must have stopped.
+	defer func() { cancel(); <-done }()
+	if servers, _, _ := tg.snapshot(); !slices.Equal(servers, []string{"10.0.0.1", "10.96.0.10"}) {
+		t.Fatalf("expected initial servers [10.0.0.1 10.96.0.10], got %v", servers)
+	}
+
+	if err := client.DiscoveryV1().EndpointSlices("kube-system").Delete(ctx, "kube-dns-a", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("deleting EndpointSlice: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		servers, _, _ := tg.snapshot()
+		if slices.Equal(servers, []string{"10.96.0.10"}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected only the pinned ClusterIP after the slice was deleted, got %v", servers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPollEndpointsRetries(t *testing.T) {
+	namespace, serviceName = "kube-system", "kube-dns"
+	initialDiscoveryBackoff, discoveryTimeout = 10*time.Millisecond, 200*time.Millisecond
+	defer func() { initialDiscoveryBackoff, discoveryTimeout = time.Second, 0 }()
+
+	slice := &v1.EndpointSlice{
+		ObjectMeta:  metav1.ObjectMeta{Name: "kube-dns-a", Namespace: "kube-system", Labels: map[string]string{sliceLabel: "kube-dns"}},
+		AddressType: v1.AddressTypeIPv4,
+		Endpoints:   []v1.Endpoint{{Addresses: []string{"10.0.0.1"}}},
+	}
+	testCases := []struct {
+		name      string
+		failures  int
+		expectErr bool
+	}{
+		{name: "transient", failures: 2},
+		{name: "persistent", failures: 1000, expectErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewClientset(slice)
+			lists := 0
+			client.PrependReactor("list", "endpointslices", func(k8stesting.Action) (bool, runtime.Object, error) {
+				lists++
+				if lists <= tc.failures {
+					return true, nil, errors.New("connection refused")
+				}
+				return false, nil, nil
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tg := newTargets(0)
+			done, err := pollEndpoints(ctx, client, nil, tg, time.Hour)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected discovery to give up")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("pollEndpoints: %v", err)
+			}
+			defer func() { cancel(); <-done }()
+			if servers, _, _ := tg.snapshot(); !slices.Equal(servers, []string{"10.0.0.1"}) {
+				t.Errorf("expected servers [10.0.0.1] after retrying, got %v", servers)
+			}
+		})
+	}
+}
+
+func TestDetectDiscoveryMode(t *testing.T) {
+	namespace, serviceName = "kube-system", "kube-dns"
+	resource := schema.GroupResource{Group: "discovery.k8s.io", Resource: "endpointslices"}
+	testCases := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{name: "served", expected: discoveryEndpointSlices},
+		{name: "not_served", err: apierrors.NewNotFound(resource, ""), expected: discoveryEndpoints},
+		{name: "forbidden", err: apierrors.NewForbidden(resource, "", errors.New("no RBAC")), expected: discoveryEndpoints},
+		{name: "transient", err: errors.New("connection refused"), expected: discoveryEndpointSlices},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewClientset()
+			if tc.err != nil {
+				client.PrependReactor("list", "endpointslices", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tc.err
+				})
+			}
+			if got := detectDiscoveryMode(context.Background(), client); got != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestPollLegacyEndpoints(t *testing.T) {
+	namespace, serviceName = "kube-system", "kube-dns"
+	client := fake.NewClientset(&corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-dns", Namespace: "kube-system"},
+		Subsets:    []corev1.EndpointSubset{{Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}}}},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tg := newTargets(0)
+	done, err := pollLegacyEndpoints(ctx, client, nil, tg, time.Hour)
+	if err != nil {
+		t.Fatalf("pollLegacyEndpoints: %v", err)
+	}
+	defer func() { cancel(); <-done }()
+	if servers, _, _ := tg.snapshot(); !slices.Equal(servers, []string{"10.0.0.1"}) {
+		t.Errorf("expected servers [10.0.0.1], got %v", servers)
+	}
+}
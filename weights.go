@@ -0,0 +1,114 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// endpointWeight is one label=value=weight entry of --endpoint-weight.
+type endpointWeight struct {
+	label  string // endpoint, pod, node, zone or target, as on coredns_probe_endpoint_info
+	value  string
+	weight float64
+}
+
+// endpointWeights weigh the endpoints in the cluster success ratio and the
+// problems-only summary; populated in main().
+var endpointWeights []endpointWeight
+
+// weightLabels are the labels --endpoint-weight can match on.
+var weightLabels = []string{"endpoint", "pod", "node", "zone", "target"}
+
+// parseEndpointWeights parses the label=value=weight entries of --endpoint-weight.
+// The weight follows the last "=", so that values may contain one. Weights must
+// be finite and not negative.
+func parseEndpointWeights(entries []string) ([]endpointWeight, error) {
+	weights := make([]endpointWeight, 0, len(entries))
+	for _, entry := range entries {
+		label, rest, _ := strings.Cut(entry, "=")
+		i := strings.LastIndex(rest, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("expected label=value=weight, got %q", entry)
+		}
+		if !slices.Contains(weightLabels, label) {
+			return nil, fmt.Errorf("unknown label %q, expected one of %s", label, strings.Join(weightLabels, ", "))
+		}
+		w, err := strconv.ParseFloat(rest[i+1:], 64)
+		if err != nil || w < 0 || math.IsInf(w, 0) || math.IsNaN(w) {
+			return nil, fmt.Errorf("%s: expected a weight of 0 or more, got %q", entry, rest[i+1:])
+		}
+		weights = append(weights, endpointWeight{label: label, value: rest[:i], weight: w})
+	}
+	return weights, nil
+}
+
+// weightOf returns the weight of the endpoint at addr: that of the last matching
+// --endpoint-weight entry, or 1.
+func weightOf(addr string, ep endpoint) float64 {
+	weight := 1.0
+	for _, w := range endpointWeights {
+		var v string
+		switch w.label {
+		case "endpoint":
+			v = addr
+		case "pod":
+			v = ep.Pod
+		case "node":
+			v = ep.Node
+		case "zone":
+			v = ep.Zone
+		case "target":
+			v = ep.Target
+		}
+		if v == w.value {
+			weight = w.weight
+		}
+	}
+	return weight
+}
+
+// clusterSuccess returns the weighted mean of the success ratios of the positive
+// queries to each endpoint in windows, Σ wᵢ·okᵢ/totalᵢ / Σ wᵢ over the endpoints
+// with queries, and false if there are none or all their weights are 0.
+func clusterSuccess(servers []string, discovered map[string]endpoint, windows []summaryWindow) (float64, bool) {
+	var sum, weights float64
+	for i, ip := range servers {
+		w := windows[i]
+		if w.total == 0 {
+			continue
+		}
+		weight := weightOf(ip, discovered[ip])
+		sum += weight * float64(w.total-w.fail) / float64(w.total)
+		weights += weight
+	}
+	if weights == 0 {
+		return 0, false
+	}
+	return sum / weights, true
+}
+
+// problems returns the indexes of the endpoints with failures of any kind or an
+// outlier mark in windows, most severe first, for --summary-problems-only. The
+// severity of an endpoint is its weight times its share of failed positive
+// queries; endpoints of weight 0 are left out.
+func problems(servers []string, discovered map[string]endpoint, windows []summaryWindow, outliers []string) []int {
+	var idx []int
+	severity := make([]float64, len(servers))
+	for i, ip := range servers {
+		w := windows[i]
+		weight := weightOf(ip, discovered[ip])
+		if weight == 0 || (len(w.reasons) == 0 && w.fail == 0 && outliers[i] == "") {
+			continue
+		}
+		if w.total > 0 {
+			severity[i] = weight * float64(w.fail) / float64(w.total)
+		}
+		idx = append(idx, i)
+	}
+	slices.SortStableFunc(idx, func(a, b int) int { return cmp.Compare(severity[b], severity[a]) })
+	return idx
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulgmiller/corednsprobe/pkg/criteria"
+	"github.com/paulgmiller/corednsprobe/pkg/metrics"
+)
+
+func TestParseEndpointWeights(t *testing.T) {
+	weights, err := parseEndpointWeights([]string{"zone=eastus-1=3", "endpoint=fd00::10=0.5", "target=baseline=0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []endpointWeight{{"zone", "eastus-1", 3}, {"endpoint", "fd00::10", 0.5}, {"target", "baseline", 0}}
+	if !slices.Equal(weights, expected) {
+		t.Errorf("expected %v, got %v", expected, weights)
+	}
+	for _, entry := range []string{"zone", "zone=eastus-1", "region=eastus=2", "zone=eastus-1=-1", "zone=eastus-1=x", "zone=eastus-1=Inf"} {
+		if _, err := parseEndpointWeights([]string{entry}); err == nil {
+			t.Errorf("%q: expected an error", entry)
+		}
+	}
+}
+
+func TestWeightOf(t *testing.T) {
+	endpointWeights = []endpointWeight{{"zone", "eastus-1", 3}, {"node", "node-b", 2}, {"endpoint", "10.0.0.3", 0}}
+	defer func() { endpointWeights = nil }()
+	testCases := []struct {
+		addr     string
+		ep       endpoint
+		expected float64
+	}{
+		{addr: "10.0.0.1", ep: endpoint{Zone: "eastus-1", Node: "node-a"}, expected: 3},
+		{addr: "10.0.0.2", ep: endpoint{Zone: "eastus-1", Node: "node-b"}, expected: 2}, // the last match wins
+		{addr: "10.0.0.3", ep: endpoint{Zone: "eastus-1"}, expected: 0},
+		{addr: "10.0.0.4", ep: endpoint{Zone: "eastus-2"}, expected: 1},
+	}
+	for _, tc := range testCases {
+		if got := weightOf(tc.addr, tc.ep); got != tc.expected {
+			t.Errorf("%s: expected weight %v, got %v", tc.addr, tc.expected, got)
+		}
+	}
+}
+
+func TestClusterSuccess(t *testing.T) {
+	servers := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	discovered := map[string]endpoint{
+		"10.0.0.1": {Addr: "10.0.0.1", Zone: "eastus-1"},
+		"10.0.0.2": {Addr: "10.0.0.2", Zone: "eastus-2"},
+		"10.0.0.3": {Addr: "10.0.0.3", Zone: "eastus-2"},
+	}
+	windows := []summaryWindow{
+		{counts: counts{total: 10, fail: 5}},
+		{counts: counts{total: 10}},
+		{}, // no queries, left out
+	}
+
+	if got, ok := clusterSuccess(servers, discovered, windows); !ok || got != 0.75 {
+		t.Errorf("expected the unweighted mean 0.75, got %v, %v", got, ok)
+	}
+	endpointWeights = []endpointWeight{{"zone", "eastus-1", 3}}
+	defer func() { endpointWeights = nil }()
+	// (3 × 0.5 + 1 × 1) / (3 + 1)
+	if got, ok := clusterSuccess(servers, discovered, windows); !ok || math.Abs(got-0.625) > 1e-9 {
+		t.Errorf("expected the weighted mean 0.625, got %v, %v", got, ok)
+	}
+	endpointWeights = []endpointWeight{{"target", "", 0}}
+	if got, ok := clusterSuccess(servers, discovered, windows); ok {
+		t.Errorf("expected no ratio with all weights 0, got %v", got)
+	}
+}
+
+func TestPrintSummaryProblemsOnly(t *testing.T) {
+	problemsOnly = true
+	endpointWeights = []endpointWeight{{"zone", "eastus-1", 10}}
+	defer func() { problemsOnly, endpointWeights = false, nil }()
+
+	servers := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	discovered := map[string]endpoint{
+		"10.0.0.1": {Addr: "10.0.0.1", Zone: "eastus-2", Ready: true},
+		"10.0.0.2": {Addr: "10.0.0.2", Zone: "eastus-2", Ready: true},
+		"10.0.0.3": {Addr: "10.0.0.3", Zone: "eastus-1", Ready: true},
+	}
+	stats := []*epStats{newEpStats(0), newEpStats(0), newEpStats(0)}
+	for range 4 {
+		stats[0].add(metrics.QueryTimeout, criteria.ReasonTimeout, time.Second)
+		stats[0].recordFailure(criteria.ReasonTimeout)
+		stats[1].add(metrics.QuerySuccess, criteria.ReasonNone, time.Millisecond)
+	}
+	// A remote endpoint failing every query is less severe than a local one
+	// failing a quarter of them.
+	stats[2].add(metrics.QueryError, criteria.ReasonIO, time.Millisecond)
+	stats[2].recordFailure(criteria.ReasonIO)
+	for range 3 {
+		stats[2].add(metrics.QuerySuccess, criteria.ReasonNone, time.Millisecond)
+	}
+
+	var buf bytes.Buffer
+	summaryOut = &buf
+	defer func() { summaryOut = nil }()
+	writeSummary(servers, discovered, stats, 10*time.Second, false)
+	out := buf.String()
+
+	// (1 × 0 + 1 × 1 + 10 × 0.75) / 12
+	if header := "[summary] last 10 s: cluster success 70.8 %, 2 of 3 endpoints with problems\n"; !strings.HasPrefix(out, header) {
+		t.Errorf("expected the summary to start with %q, got %q", header, out)
+	}
+	if strings.Contains(out, "10.0.0.2 →") {
+		t.Errorf("expected the healthy endpoint to be left out, got %q", out)
+	}
+	if local, remote := strings.Index(out, "10.0.0.3 →"), strings.Index(out, "10.0.0.1 →"); local < 0 || remote < 0 || local > remote {
+		t.Errorf("expected the local endpoint listed before the remote one, got %q", out)
+	}
+}